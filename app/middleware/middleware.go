@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -45,6 +46,26 @@ func ContentTypeJSON(next http.Handler) http.Handler {
 	})
 }
 
+// httpClientKey is the request context key of the client set by HTTPClient.
+type httpClientKey struct{}
+
+// HTTPClient makes client available to handlers through HTTPClientFrom, so
+// that their outgoing requests use it, e.g. a client that goes through tor
+func HTTPClient(client *http.Client) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), httpClientKey{}, client)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// HTTPClientFrom returns the client set by HTTPClient, or nil if there is none
+func HTTPClientFrom(ctx context.Context) *http.Client {
+	client, _ := ctx.Value(httpClientKey{}).(*http.Client)
+	return client
+}
+
 // responseWriter wraps http.ResponseWriter to ensure headers can be set after writing
 type responseWriter struct {
 	http.ResponseWriter
@@ -148,3 +148,17 @@ func TestMiddlewareChain(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPClient(t *testing.T) {
+	client := &http.Client{}
+	var got *http.Client
+	handler := HTTPClient(client)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = HTTPClientFrom(r.Context())
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Same(t, client, got)
+
+	// Without the middleware there is no client
+	assert.Nil(t, HTTPClientFrom(httptest.NewRequest("GET", "/", nil).Context()))
+}
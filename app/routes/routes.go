@@ -44,11 +44,20 @@ func SetupRoutes() *mux.Router {
 
 // SetupMVCRoutes defines the MVC application's routes and returns a router, using the provided Badger DB.
 func SetupMVCRoutes(db *badger.DB) *mux.Router {
+	return SetupMVCRoutesWithClient(db, nil)
+}
+
+// SetupMVCRoutesWithClient is SetupMVCRoutes with an HTTP client for outgoing requests,
+// which handlers get from middleware.HTTPClientFrom. The client may be nil.
+func SetupMVCRoutesWithClient(db *badger.DB, client *http.Client) *mux.Router {
 	router := mux.NewRouter()
 
 	// Apply global middleware
 	router.Use(middleware.Logger)
 	router.Use(middleware.Recoverer)
+	if client != nil {
+		router.Use(middleware.HTTPClient(client))
+	}
 
 	postController := controllers.NewPostControllerWithDB(db)
 	commentController := controllers.NewCommentControllerWithDB(db)
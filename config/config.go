@@ -0,0 +1,360 @@
+// Package config loads the project configuration shared by all commands:
+// built-in defaults, overridden by cheeseburger.yaml, overridden by
+// CHEESEBURGER_* environment variables. Command line flags take their
+// defaults from the result, so a flag always has the last word.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cheeseburger/keys"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is read when no configuration file is named explicitly. It is
+// optional; an explicitly named file must exist.
+const DefaultFile = "cheeseburger.yaml"
+
+// FileEnv names a configuration file to use instead of DefaultFile.
+const FileEnv = "CHEESEBURGER_CONFIG"
+
+// Config is the effective configuration.
+type Config struct {
+	Paths    Paths    `yaml:"paths"`
+	Serve    Serve    `yaml:"serve"`
+	Vanity   Vanity   `yaml:"vanity"`
+	Coverage Coverage `yaml:"coverage"`
+
+	// source and overrides record where the values came from, for print.
+	source    string
+	overrides []string
+}
+
+// Paths are the on-disk locations of the project's data.
+type Paths struct {
+	DB      string `yaml:"db"`
+	Backups string `yaml:"backups"`
+	// Vanity holds one directory per named key bundle.
+	Vanity string `yaml:"vanity"`
+	// TorData holds one persistent tor DataDirectory per service.
+	TorData string `yaml:"tor_data"`
+	// AdminSocket is where a serving cheeseburger answers cheeseburger
+	// status; empty disables it.
+	AdminSocket string `yaml:"admin_socket"`
+}
+
+// Serve holds the defaults of the serving commands' flags.
+type Serve struct {
+	VanityName string `yaml:"vanity_name"`
+	// Backend is "unix" for a private socket between tor and the HTTP
+	// server, or "tcp" for the loopback ListenPort.
+	Backend       string        `yaml:"backend"`
+	ListenPort    int           `yaml:"listen_port"`
+	SocksPort     int           `yaml:"socks_port"`
+	ControlPort   int           `yaml:"control_port"`
+	TorPath       string        `yaml:"tor_path"`
+	TorControl    string        `yaml:"tor_control"`
+	TorrcInclude  string        `yaml:"torrc_include"`
+	DoSPreset     string        `yaml:"dos_preset"`
+	StatsInterval time.Duration `yaml:"stats_interval"`
+	// ClearnetAddr also serves the site on clearnet, advertising the onion
+	// with Onion-Location; ClearnetCert and ClearnetKey enable HTTPS.
+	ClearnetAddr string `yaml:"clearnet_addr"`
+	ClearnetCert string `yaml:"clearnet_cert"`
+	ClearnetKey  string `yaml:"clearnet_key"`
+	// Cache sets the Cache-Control header of static files by glob.
+	Cache []CacheRule `yaml:"cache"`
+}
+
+// CacheRule sends Control as the Cache-Control header of the static files
+// matching Pattern. A pattern containing a slash is matched against the
+// whole URL path, otherwise against the file name; the first matching rule
+// wins.
+type CacheRule struct {
+	Pattern string `yaml:"pattern"`
+	Control string `yaml:"control"`
+}
+
+// Validate checks that the rule has a well-formed pattern and a value.
+func (r CacheRule) Validate() error {
+	if r.Pattern == "" {
+		return fmt.Errorf("cache rule without a pattern")
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid cache pattern %q: %v", r.Pattern, err)
+	}
+	if strings.TrimSpace(r.Control) == "" || strings.ContainsAny(r.Control, "\r\n") {
+		return fmt.Errorf("invalid Cache-Control %q for %s", r.Control, r.Pattern)
+	}
+	return nil
+}
+
+// Vanity holds the defaults of the vanity search flags.
+type Vanity struct {
+	// Workers is the number of search goroutines; 0 uses every CPU.
+	Workers  int           `yaml:"workers"`
+	Progress time.Duration `yaml:"progress"`
+}
+
+// Coverage configures the coverage command.
+type Coverage struct {
+	// Threshold is the percentage below which files are listed as poorly
+	// covered.
+	Threshold float64  `yaml:"threshold"`
+	Packages  []string `yaml:"packages"`
+}
+
+// Default returns the built-in configuration.
+func Default() *Config {
+	return &Config{
+		Paths: Paths{
+			DB:          filepath.Join("data", "badger"),
+			Backups:     filepath.Join("data", "backups"),
+			Vanity:      filepath.Join("data", "vanity"),
+			TorData:     filepath.Join("data", "tor"),
+			AdminSocket: filepath.Join("data", "admin.sock"),
+		},
+		Serve: Serve{
+			Backend:    "unix",
+			ListenPort: 8080,
+			SocksPort:  9050,
+			DoSPreset:  "off",
+		},
+		Vanity: Vanity{
+			Progress: 5 * time.Second,
+		},
+		Coverage: Coverage{
+			Threshold: 80,
+			Packages:  []string{"./..."},
+		},
+		source: "defaults",
+	}
+}
+
+// Load returns the effective configuration. path names the configuration
+// file; if it is empty $CHEESEBURGER_CONFIG is used, and failing that
+// cheeseburger.yaml if it exists.
+func Load(path string) (*Config, error) {
+	c := Default()
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	explicit := path != ""
+	if !explicit {
+		path = DefaultFile
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := c.parse(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		c.source = path
+	case os.IsNotExist(err) && !explicit:
+	default:
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parse overlays the YAML document in data onto c. Unknown keys are
+// rejected so that a typo does not silently leave a default in place.
+func (c *Config) parse(data []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// envVar is a setting that can be overridden from the environment.
+type envVar struct {
+	name   string
+	target interface{}
+}
+
+func (c *Config) envVars() []envVar {
+	return []envVar{
+		{"CHEESEBURGER_DB_PATH", &c.Paths.DB},
+		{"CHEESEBURGER_BACKUP_DIR", &c.Paths.Backups},
+		{"CHEESEBURGER_VANITY_DIR", &c.Paths.Vanity},
+		{"CHEESEBURGER_TOR_DATA_DIR", &c.Paths.TorData},
+		{"CHEESEBURGER_ADMIN_SOCKET", &c.Paths.AdminSocket},
+		{"CHEESEBURGER_VANITY_NAME", &c.Serve.VanityName},
+		{"CHEESEBURGER_BACKEND", &c.Serve.Backend},
+		{"CHEESEBURGER_LISTEN_PORT", &c.Serve.ListenPort},
+		{"CHEESEBURGER_SOCKS_PORT", &c.Serve.SocksPort},
+		{"CHEESEBURGER_CONTROL_PORT", &c.Serve.ControlPort},
+		{"CHEESEBURGER_TOR_PATH", &c.Serve.TorPath},
+		{"CHEESEBURGER_TOR_CONTROL", &c.Serve.TorControl},
+		{"CHEESEBURGER_TORRC_INCLUDE", &c.Serve.TorrcInclude},
+		{"CHEESEBURGER_DOS_PRESET", &c.Serve.DoSPreset},
+		{"CHEESEBURGER_STATS_INTERVAL", &c.Serve.StatsInterval},
+		{"CHEESEBURGER_CLEARNET_ADDR", &c.Serve.ClearnetAddr},
+		{"CHEESEBURGER_CLEARNET_CERT", &c.Serve.ClearnetCert},
+		{"CHEESEBURGER_CLEARNET_KEY", &c.Serve.ClearnetKey},
+		{"CHEESEBURGER_VANITY_WORKERS", &c.Vanity.Workers},
+		{"CHEESEBURGER_VANITY_PROGRESS", &c.Vanity.Progress},
+		{"CHEESEBURGER_COVERAGE_THRESHOLD", &c.Coverage.Threshold},
+	}
+}
+
+// applyEnv overrides settings from the environment variables that are set.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	for _, v := range c.envVars() {
+		s, ok := lookup(v.name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch p := v.target.(type) {
+		case *string:
+			*p = s
+		case *int:
+			*p, err = strconv.Atoi(s)
+		case *float64:
+			*p, err = strconv.ParseFloat(s, 64)
+		case *time.Duration:
+			*p, err = time.ParseDuration(s)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s=%q", v.name, s)
+		}
+		c.overrides = append(c.overrides, v.name)
+	}
+	return nil
+}
+
+// Validate checks the values for consistency.
+func (c *Config) Validate() error {
+	for name, p := range map[string]string{
+		"paths.db": c.Paths.DB, "paths.backups": c.Paths.Backups,
+		"paths.vanity": c.Paths.Vanity, "paths.tor_data": c.Paths.TorData,
+	} {
+		if p == "" {
+			return fmt.Errorf("%s must not be empty", name)
+		}
+	}
+
+	s := c.Serve
+	if s.VanityName != "" {
+		if err := keys.ValidateName(s.VanityName); err != nil {
+			return fmt.Errorf("invalid serve.vanity_name: %v", err)
+		}
+	}
+	if s.Backend != "unix" && s.Backend != "tcp" {
+		return fmt.Errorf("serve.backend must be unix or tcp, not %q", s.Backend)
+	}
+	if s.ListenPort <= 0 || s.ListenPort > 65535 {
+		return fmt.Errorf("invalid serve.listen_port %d", s.ListenPort)
+	}
+	if s.SocksPort < 0 || s.SocksPort > 65535 {
+		return fmt.Errorf("invalid serve.socks_port %d", s.SocksPort)
+	}
+	if s.ControlPort < 0 || s.ControlPort > 65535 {
+		return fmt.Errorf("invalid serve.control_port %d", s.ControlPort)
+	}
+	if s.ControlPort != 0 && s.ControlPort == s.SocksPort {
+		return fmt.Errorf("serve.socks_port and serve.control_port are both %d", s.SocksPort)
+	}
+	if s.ListenPort == s.SocksPort || s.ListenPort == s.ControlPort {
+		return fmt.Errorf("serve.listen_port %d is also a tor port", s.ListenPort)
+	}
+	if s.TorControl != "" && (s.TorPath != "" || s.TorrcInclude != "") {
+		return fmt.Errorf("serve.tor_control cannot be combined with serve.tor_path or serve.torrc_include")
+	}
+	if s.StatsInterval < 0 {
+		return fmt.Errorf("invalid serve.stats_interval %s", s.StatsInterval)
+	}
+	if (s.ClearnetCert == "") != (s.ClearnetKey == "") {
+		return fmt.Errorf("serve.clearnet_cert and serve.clearnet_key must be set together")
+	}
+	for _, r := range s.Cache {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("serve.cache: %v", err)
+		}
+	}
+
+	if c.Vanity.Workers < 0 {
+		return fmt.Errorf("invalid vanity.workers %d", c.Vanity.Workers)
+	}
+	if c.Vanity.Progress <= 0 {
+		return fmt.Errorf("vanity.progress must be positive")
+	}
+	if c.Coverage.Threshold < 0 || c.Coverage.Threshold > 100 {
+		return fmt.Errorf("coverage.threshold must be between 0 and 100")
+	}
+	if len(c.Coverage.Packages) == 0 {
+		return fmt.Errorf("coverage.packages must not be empty")
+	}
+	return nil
+}
+
+// Print writes the effective configuration as YAML, preceded by comments
+// naming the file and environment variables it was loaded from.
+func (c *Config) Print(w io.Writer) error {
+	fmt.Fprintf(w, "# Loaded from: %s\n", c.source)
+	if len(c.overrides) > 0 {
+		fmt.Fprintf(w, "# Environment overrides: %s\n", strings.Join(c.overrides, ", "))
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// RunConfig handles "cheeseburger config" subcommands and returns an exit
+// code.
+func RunConfig(c *Config, args []string) int {
+	if len(args) != 1 {
+		printConfigHelp()
+		return 1
+	}
+	switch args[0] {
+	case "print":
+		if err := c.Print(os.Stdout); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		return 0
+	case "help":
+		printConfigHelp()
+		return 0
+	default:
+		fmt.Printf("Unknown config command: %s\n\n", args[0])
+		printConfigHelp()
+		return 1
+	}
+}
+
+// printConfigHelp prints help for config subcommands.
+func printConfigHelp() {
+	helpText := `Usage: cheeseburger [--config <file>] config <command>
+
+Settings are read from cheeseburger.yaml (or --config, or $CHEESEBURGER_CONFIG),
+then from CHEESEBURGER_* environment variables. Command line flags override both.
+
+Commands:
+  print                           Show the effective configuration
+  help                            Display this help message
+`
+	fmt.Println(helpText)
+}
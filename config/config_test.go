@@ -0,0 +1,110 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "cheeseburger.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	c := Default()
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, filepath.Join("data", "badger"), c.Paths.DB)
+	assert.Equal(t, 8080, c.Serve.ListenPort)
+	assert.Equal(t, filepath.Join("data", "admin.sock"), c.Paths.AdminSocket)
+
+	c.Paths.AdminSocket = ""
+	assert.NoError(t, c.Validate(), "an empty admin socket disables it")
+}
+
+func TestLoadFileAndEnv(t *testing.T) {
+	path := writeConfig(t, `
+paths:
+  db: /srv/blog/badger
+serve:
+  vanity_name: myblog
+  listen_port: 8181
+  stats_interval: 1m
+  cache:
+    - pattern: /assets/*
+      control: public, max-age=31536000, immutable
+    - pattern: "*.html"
+      control: no-cache
+coverage:
+  threshold: 90
+`)
+	t.Setenv("CHEESEBURGER_LISTEN_PORT", "8282")
+	t.Setenv("CHEESEBURGER_VANITY_PROGRESS", "10s")
+	c, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "/srv/blog/badger", c.Paths.DB)
+	assert.Equal(t, filepath.Join("data", "backups"), c.Paths.Backups, "unset keys keep their default")
+	assert.Equal(t, "myblog", c.Serve.VanityName)
+	assert.Equal(t, 8282, c.Serve.ListenPort, "the environment overrides the file")
+	assert.Equal(t, time.Minute, c.Serve.StatsInterval)
+	assert.Equal(t, []CacheRule{
+		{Pattern: "/assets/*", Control: "public, max-age=31536000, immutable"},
+		{Pattern: "*.html", Control: "no-cache"},
+	}, c.Serve.Cache)
+	assert.Equal(t, 10*time.Second, c.Vanity.Progress)
+	assert.Equal(t, 90.0, c.Coverage.Threshold)
+
+	var out bytes.Buffer
+	require.NoError(t, c.Print(&out))
+	assert.Contains(t, out.String(), "# Loaded from: "+path)
+	assert.Contains(t, out.String(), "CHEESEBURGER_LISTEN_PORT, CHEESEBURGER_VANITY_PROGRESS")
+	assert.Contains(t, out.String(), "listen_port: 8282")
+	assert.Contains(t, out.String(), "stats_interval: 1m0s")
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+
+	c, err := Load("")
+	require.NoError(t, err)
+	assert.Equal(t, Default().Serve, c.Serve)
+
+	t.Setenv(FileEnv, "missing.yaml")
+	_, err = Load("")
+	assert.Error(t, err, "an explicitly named file must exist")
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, content := range []string{
+		"serve:\n  listen_prot: 8080\n",
+		"serve:\n  listen_port: 0\n",
+		"serve:\n  backend: udp\n",
+		"serve:\n  socks_port: 9051\n  control_port: 9051\n",
+		"serve:\n  listen_port: 9050\n",
+		"serve:\n  vanity_name: ../etc\n",
+		"serve:\n  vanity_name: myblog.retiring\n",
+		"serve:\n  tor_control: 127.0.0.1:9051\n  tor_path: /usr/bin/tor\n",
+		"serve:\n  cache:\n    - pattern: \"[a-\"\n      control: no-cache\n",
+		"serve:\n  cache:\n    - pattern: \"*.css\"\n",
+		"paths:\n  db: \"\"\n",
+		"vanity:\n  progress: 0s\n",
+		"coverage:\n  threshold: 120\n",
+		"coverage:\n  packages: []\n",
+	} {
+		_, err := Load(writeConfig(t, content))
+		assert.Error(t, err, content)
+	}
+
+	t.Setenv("CHEESEBURGER_SOCKS_PORT", "many")
+	_, err := Load(writeConfig(t, ""))
+	assert.ErrorContains(t, err, "CHEESEBURGER_SOCKS_PORT")
+}
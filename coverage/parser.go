@@ -3,6 +3,7 @@ package coverage
 
 import (
 	"bufio"
+	"cheeseburger/config"
 	"encoding/json"
 	"fmt"
 	"go/ast"
@@ -327,7 +328,7 @@ func printUncoveredFunctions(coverageData map[string]*FileCoverage, asJSON bool)
 // RunCoverage is the entry point for the coverage command.
 // It runs "go test -coverprofile=<tempfile>" to generate a coverage profile,
 // parses the output, displays a summary, and then outputs the uncovered function targets.
-func RunCoverage(args []string) {
+func RunCoverage(cfg *config.Config, args []string) {
 	// Check for a JSON output flag.
 	jsonOutput := false
 	var remainingArgs []string
@@ -339,14 +340,14 @@ func RunCoverage(args []string) {
 		}
 	}
 
-	// Determine test packages (default: "./...")
+	// Determine test packages (default: coverage.packages)
 	testArgs := []string{"test", "-coverprofile", ""}
 	if len(remainingArgs) >= 1 && remainingArgs[0] != "" {
 		// Allow user to specify packages or test arguments if needed.
 		testArgs = append(testArgs, remainingArgs...)
 	} else {
 		// Default test target.
-		testArgs = append(testArgs, "./...")
+		testArgs = append(testArgs, cfg.Coverage.Packages...)
 	}
 
 	// Create a temporary file for coverage output.
@@ -377,8 +378,8 @@ func RunCoverage(args []string) {
 	}
 
 	printCoverageSummary(coverageData)
-	// Print files with less than 80% coverage (threshold can be adjusted).
-	printLowCoverage(coverageData, 80.0)
+	// Print files below the configured coverage threshold.
+	printLowCoverage(coverageData, cfg.Coverage.Threshold)
 	// Map uncovered regions to functions, using the JSON flag if set.
 	printUncoveredFunctions(coverageData, jsonOutput)
 }
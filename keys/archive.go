@@ -0,0 +1,109 @@
+package keys
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// maxArchiveFile bounds the size of a single file read from an archive. Key
+// bundle files are tiny; anything larger is not a bundle.
+const maxArchiveFile = 64 << 10
+
+// Export verifies the bundle in dir and writes it to w as a gzipped tar
+// archive holding a single directory named after the bundle. The archive
+// contains the secret key and must be protected accordingly.
+func Export(dir string, w io.Writer) error {
+	b, err := Verify(dir)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     b.Name + "/",
+		Mode:     0700,
+		ModTime:  now,
+	}); err != nil {
+		return err
+	}
+	for _, f := range filesIn(dir) {
+		data, err := os.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(b.Name, f),
+			Mode:     0600,
+			Size:     int64(len(data)),
+			ModTime:  now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ImportArchive reads an archive written by Export and saves the bundle it
+// contains into dstDir. Files other than the bundle files are ignored.
+func ImportArchive(r io.Reader, dstDir string) (*Bundle, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a key archive: %v", err)
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Base(hdr.Name)
+		known := name == SealedKeyFile
+		for _, f := range bundleFiles {
+			known = known || f == name
+		}
+		if !known {
+			continue
+		}
+		if _, dup := files[name]; dup {
+			return nil, fmt.Errorf("key archive holds more than one %s", name)
+		}
+		if hdr.Size > maxArchiveFile {
+			return nil, fmt.Errorf("%s in key archive is too large", name)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxArchiveFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from key archive: %v", name, err)
+		}
+		files[name] = data
+	}
+	_, plain := files[SecretKeyFile]
+	_, sealed := files[SealedKeyFile]
+	if !plain && !sealed {
+		return nil, fmt.Errorf("key archive does not contain %s", SecretKeyFile)
+	}
+	return writeBundle(files, dstDir)
+}
@@ -0,0 +1,255 @@
+package keys
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base32"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AuthorizedClientsDir is the subdirectory of a HiddenServiceDir where tor
+// looks for the public keys of clients allowed to discover the service.
+const AuthorizedClientsDir = "authorized_clients"
+
+// clientKeyEncoding is the unpadded base32 tor uses for x25519 keys.
+var clientKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Client is a client authorized to reach a restricted-discovery onion
+// service.
+type Client struct {
+	Name      string
+	PublicKey []byte // x25519
+}
+
+// EncodedKey returns the client's public key as tor's unpadded base32, the
+// form ADD_ONION expects in ClientAuthV3.
+func (c Client) EncodedKey() string {
+	return clientKeyEncoding.EncodeToString(c.PublicKey)
+}
+
+// AuthLine returns the contents of the client's .auth file.
+func (c Client) AuthLine() string {
+	return "descriptor:x25519:" + c.EncodedKey()
+}
+
+// AuthPrivateLine returns the .auth_private line a client puts in its tor's
+// ClientOnionAuthDir to reach onionAddress.
+func AuthPrivateLine(onionAddress string, privateKey []byte) string {
+	return strings.TrimSuffix(onionAddress, ".onion") + ":descriptor:x25519:" + clientKeyEncoding.EncodeToString(privateKey)
+}
+
+// validateClientName rejects client names that are not usable as a file
+// name in authorized_clients.
+func validateClientName(name string) error {
+	if err := ValidateName(name); err != nil || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid client name %q", name)
+	}
+	return nil
+}
+
+// AddClient generates an x25519 keypair for a new client of the bundle in
+// dir and writes its public key to authorized_clients/<name>.auth. The
+// private key is returned and not stored anywhere.
+func AddClient(dir, name string) (*Client, []byte, error) {
+	if err := validateClientName(name); err != nil {
+		return nil, nil, err
+	}
+	clientsDir := filepath.Join(dir, AuthorizedClientsDir)
+	if err := os.MkdirAll(clientsDir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create %s: %v", AuthorizedClientsDir, err)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &Client{Name: name, PublicKey: priv.PublicKey().Bytes()}
+
+	path := filepath.Join(clientsDir, name+".auth")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, nil, fmt.Errorf("client %s already exists; revoke it first", name)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	_, err = fmt.Fprintln(f, c.AuthLine())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, nil, fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	return c, priv.Bytes(), nil
+}
+
+// parseAuthFile parses the contents of a .auth file.
+func parseAuthFile(data []byte) ([]byte, error) {
+	line := strings.TrimSpace(string(data))
+	parts := strings.Split(line, ":")
+	if len(parts) != 3 || parts[0] != "descriptor" || parts[1] != "x25519" {
+		return nil, fmt.Errorf("expected descriptor:x25519:<key>")
+	}
+	key, err := clientKeyEncoding.DecodeString(parts[2])
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid x25519 public key")
+	}
+	return key, nil
+}
+
+// Clients returns the clients authorized for the bundle in dir, sorted by
+// name. A bundle without authorized_clients has none.
+func Clients(dir string) ([]Client, error) {
+	clientsDir := filepath.Join(dir, AuthorizedClientsDir)
+	entries, err := os.ReadDir(clientsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", AuthorizedClientsDir, err)
+	}
+	var clients []Client
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".auth")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(clientsDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseAuthFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name(), err)
+		}
+		clients = append(clients, Client{Name: name, PublicKey: key})
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return clients, nil
+}
+
+// RevokeClient removes a client of the bundle in dir.
+func RevokeClient(dir, name string) error {
+	if err := validateClientName(name); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(dir, AuthorizedClientsDir, name+".auth"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no client named %s", name)
+	}
+	return err
+}
+
+// RunClients handles "cheeseburger clients" subcommands for the bundles
+// under baseDir and returns an exit code.
+func RunClients(baseDir string, args []string) int {
+	if len(args) < 1 {
+		printClientsHelp()
+		return 1
+	}
+
+	fs := flag.NewFlagSet("clients "+args[0], flag.ContinueOnError)
+	vanityName := fs.String("vanity-name", "", "key bundle whose clients to manage")
+	switch args[0] {
+	case "add", "list", "revoke":
+	case "help":
+		printClientsHelp()
+		return 0
+	default:
+		fmt.Printf("Unknown clients command: %s\n\n", args[0])
+		printClientsHelp()
+		return 1
+	}
+	positional, err := parseArgs(fs, args[1:])
+	if err != nil {
+		return 1
+	}
+	name := *vanityName
+	if name == "" {
+		name = "default"
+	}
+	dir, err := bundleDir(baseDir, name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	bundle, err := Inspect(dir)
+	if err != nil {
+		fmt.Printf("Error: no usable key bundle %s: %v\n", name, err)
+		return 1
+	}
+
+	if args[0] == "list" {
+		if len(positional) != 0 {
+			fmt.Println("Error: usage: clients list --vanity-name <name>")
+			return 1
+		}
+		return listClientsCommand(bundle)
+	}
+	if len(positional) != 1 {
+		fmt.Printf("Error: usage: clients %s <client> --vanity-name <name>\n", args[0])
+		return 1
+	}
+	if args[0] == "add" {
+		return addClientCommand(bundle, positional[0])
+	}
+	if err := RevokeClient(dir, positional[0]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Revoked client %s of %s; restart the service for it to take effect\n", positional[0], bundle.OnionAddress)
+	return 0
+}
+
+// printClientsHelp prints help for clients subcommands.
+func printClientsHelp() {
+	helpText := `Usage: cheeseburger clients <command> [--vanity-name <name>]
+
+Restrict discovery of an onion service to authorized clients (tor v3 client
+authorization). Once a service has at least one client, nobody else can reach it.
+
+Commands:
+  add <client>                    Authorize a new client and print its .auth_private line
+  list                            List authorized clients
+  revoke <client>                 Remove a client
+  help                            Display this help message
+
+The service must be restarted for changes to take effect.
+`
+	fmt.Println(helpText)
+}
+
+func addClientCommand(bundle *Bundle, name string) int {
+	c, priv, err := AddClient(bundle.Dir, name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Authorized client %s for %s\n", c.Name, bundle.OnionAddress)
+	fmt.Printf("Give %s the following line, to be saved as %s.auth_private in the ClientOnionAuthDir of their tor.\n", c.Name, c.Name)
+	fmt.Printf("It is not stored anywhere and cannot be shown again:\n\n")
+	fmt.Printf("%s\n\n", AuthPrivateLine(bundle.OnionAddress, priv))
+	fmt.Println("Restart the service for the change to take effect.")
+	return 0
+}
+
+func listClientsCommand(bundle *Bundle) int {
+	clients, err := Clients(bundle.Dir)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	if len(clients) == 0 {
+		fmt.Printf("No authorized clients; %s is reachable by anyone who knows the address\n", bundle.OnionAddress)
+		return 0
+	}
+	for _, c := range clients {
+		fmt.Printf("%-20s  %s\n", c.Name, c.EncodedKey())
+	}
+	return 0
+}
@@ -0,0 +1,90 @@
+package keys
+
+import (
+	"crypto/ecdh"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddListRevokeClients(t *testing.T) {
+	dir := newBundle(t, t.TempDir(), "staging")
+
+	clients, err := Clients(dir)
+	require.NoError(t, err)
+	assert.Empty(t, clients)
+
+	bob, bobPriv, err := AddClient(dir, "bob")
+	require.NoError(t, err)
+	alice, _, err := AddClient(dir, "alice")
+	require.NoError(t, err)
+	_, _, err = AddClient(dir, "alice")
+	assert.Error(t, err, "clients are not silently replaced")
+	_, _, err = AddClient(dir, "../alice")
+	assert.Error(t, err)
+
+	// The private key belongs to the stored public key.
+	priv, err := ecdh.X25519().NewPrivateKey(bobPriv)
+	require.NoError(t, err)
+	assert.Equal(t, bob.PublicKey, priv.PublicKey().Bytes())
+
+	data, err := os.ReadFile(filepath.Join(dir, AuthorizedClientsDir, "bob.auth"))
+	require.NoError(t, err)
+	assert.Equal(t, "descriptor:x25519:"+bob.EncodedKey()+"\n", string(data))
+	assert.Len(t, bob.EncodedKey(), 52)
+	info, err := os.Stat(filepath.Join(dir, AuthorizedClientsDir, "bob.auth"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	clients, err = Clients(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []Client{*alice, *bob}, clients)
+
+	require.NoError(t, RevokeClient(dir, "alice"))
+	assert.Error(t, RevokeClient(dir, "alice"))
+	clients, err = Clients(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []Client{*bob}, clients)
+
+	// Clients do not affect bundle verification.
+	_, err = Verify(dir)
+	assert.NoError(t, err)
+}
+
+func TestClientsRejectsMalformedAuthFile(t *testing.T) {
+	dir := newBundle(t, t.TempDir(), "staging")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, AuthorizedClientsDir), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, AuthorizedClientsDir, "eve.auth"), []byte("descriptor:x25519:short\n"), 0600))
+	_, err := Clients(dir)
+	assert.Error(t, err)
+}
+
+func TestAuthPrivateLine(t *testing.T) {
+	addr := strings.Repeat("a", 56) + ".onion"
+	line := AuthPrivateLine(addr, make([]byte, 32))
+	assert.Equal(t, strings.Repeat("a", 56)+":descriptor:x25519:"+strings.Repeat("A", 52), line)
+}
+
+func TestRunClientsCommands(t *testing.T) {
+	baseDir := t.TempDir()
+	dir := newBundle(t, baseDir, "blog")
+
+	assert.Equal(t, 0, RunClients(baseDir, []string{"list", "--vanity-name", "blog"}))
+	assert.Equal(t, 0, RunClients(baseDir, []string{"add", "alice", "--vanity-name", "blog"}))
+	assert.Equal(t, 1, RunClients(baseDir, []string{"add", "alice", "--vanity-name", "blog"}))
+	assert.Equal(t, 0, RunClients(baseDir, []string{"list", "--vanity-name", "blog"}))
+	assert.Equal(t, 1, RunClients(baseDir, []string{"add", "bob", "--vanity-name", "missing"}))
+	assert.Equal(t, 1, RunClients(baseDir, []string{"bogus"}))
+
+	clients, err := Clients(dir)
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	assert.Equal(t, "alice", clients[0].Name)
+
+	assert.Equal(t, 0, RunClients(baseDir, []string{"revoke", "--vanity-name", "blog", "alice"}))
+	assert.Equal(t, 1, RunClients(baseDir, []string{"revoke", "--vanity-name", "blog", "alice"}))
+}
@@ -0,0 +1,462 @@
+package keys
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cheeseburger/vanity"
+)
+
+// RunKeys handles "cheeseburger keys" subcommands for the bundles under
+// baseDir and returns an exit code.
+func RunKeys(baseDir string, args []string) int {
+	if len(args) < 1 {
+		printKeysHelp()
+		return 1
+	}
+
+	switch args[0] {
+	case "list":
+		return listCommand(baseDir)
+	case "inspect":
+		return withName(baseDir, args[1:], inspectCommand)
+	case "verify":
+		return verifyCommand(baseDir, args[1:])
+	case "import":
+		return importCommand(baseDir, args[1:])
+	case "export":
+		return exportCommand(baseDir, args[1:])
+	case "delete":
+		return deleteCommand(baseDir, args[1:])
+	case "encrypt":
+		return encryptCommand(baseDir, args[1:], true)
+	case "decrypt":
+		return encryptCommand(baseDir, args[1:], false)
+	case "rotate":
+		return rotateCommand(baseDir, args[1:])
+	case "help":
+		printKeysHelp()
+		return 0
+	default:
+		fmt.Printf("Unknown keys command: %s\n\n", args[0])
+		printKeysHelp()
+		return 1
+	}
+}
+
+// printKeysHelp prints help for keys subcommands.
+func printKeysHelp() {
+	helpText := `Usage: cheeseburger keys <command>
+
+Commands:
+  list                            List key bundles under data/vanity
+  inspect <name>                  Show address, fingerprint and creation info
+  verify <name> [--fix]           Check bundle consistency (--fix tightens permissions first)
+  import <dir|archive> --name <n> Import a tor HiddenServiceDir or an exported archive
+  export <name> [-o file]         Write a portable .tar.gz archive (contains the secret key!)
+  delete <name> [--yes]           Overwrite and remove a bundle
+  encrypt <name>                  Seal the secret key with a passphrase
+  decrypt <name>                  Restore the plaintext secret key
+                                  (both accept --passphrase-fd N or CHEESEBURGER_PASSPHRASE)
+  rotate --vanity-name <name>     Move the service to a new key, keeping the old onion
+                                  published for --overlap (default 720h) with a signed
+                                  announcement of the new address
+         [--successor <bundle>]   Use this bundle's key, e.g. a vanity search result
+         [--successor-passphrase-fd N]
+                                  Read the passphrase of an encrypted successor from fd N
+         [--finish [--yes]]       Retire the old onion and delete its key
+         [--verify <file>]        Check a downloaded announcement
+  help                            Display this help message
+`
+	fmt.Println(helpText)
+}
+
+// parseArgs parses flags that may appear before or after the positional
+// arguments, returning the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// bundleDir validates a bundle name and resolves it under baseDir.
+func bundleDir(baseDir, name string) (string, error) {
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+	return vanity.BundleDir(baseDir, name), nil
+}
+
+// withName runs f for the single bundle under baseDir named in args.
+func withName(baseDir string, args []string, f func(dir string) int) int {
+	if len(args) != 1 {
+		fmt.Println("Error: exactly one key bundle name required")
+		return 1
+	}
+	dir, err := bundleDir(baseDir, args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	return f(dir)
+}
+
+func listCommand(baseDir string) int {
+	names, err := List(baseDir)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	if len(names) == 0 {
+		fmt.Printf("No key bundles found in %s\n", baseDir)
+		return 0
+	}
+	for _, name := range names {
+		b, err := Inspect(filepath.Join(baseDir, name))
+		if err != nil {
+			fmt.Printf("%-20s  (unreadable: %v)\n", name, err)
+			continue
+		}
+		status := ""
+		if !b.Complete {
+			status = "  (incomplete: no vanity.json)"
+		} else if b.Encrypted {
+			status = "  (encrypted)"
+		}
+		if old, err := Inspect(RetiringDir(b.Dir)); err == nil {
+			status += fmt.Sprintf("  (rotated from %s, still published)", old.OnionAddress)
+		}
+		fmt.Printf("%-20s  %s%s\n", name, b.OnionAddress, status)
+	}
+	return 0
+}
+
+func inspectCommand(dir string) int {
+	b, err := Inspect(dir)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	printBundle(b)
+	return 0
+}
+
+func printBundle(b *Bundle) {
+	fmt.Printf("Name:         %s\n", b.Name)
+	fmt.Printf("Directory:    %s\n", b.Dir)
+	fmt.Printf("Address:      %s\n", b.OnionAddress)
+	fmt.Printf("Public key:   %x\n", []byte(b.PublicKey))
+	fmt.Printf("Fingerprint:  %s\n", b.Fingerprint)
+	if !b.Created.IsZero() {
+		fmt.Printf("Created:      %s\n", b.Created.Format(time.RFC3339))
+	}
+	if b.Attempts > 0 {
+		fmt.Printf("Attempts:     %d\n", b.Attempts)
+	}
+	if b.Encrypted {
+		fmt.Printf("Encrypted:    yes\n")
+	}
+	if !b.Complete {
+		fmt.Printf("Status:       incomplete (no vanity.json)\n")
+	}
+	if r := b.Rotation; r != nil {
+		fmt.Printf("Rotated from: %s on %s\n", r.Old, r.Issued.Format(time.RFC3339))
+		if _, err := os.Stat(RetiringDir(b.Dir)); err == nil {
+			fmt.Printf("Retiring:     %s stays published until %s\n", r.Old, r.Retires.Format(time.RFC3339))
+		}
+	}
+}
+
+func verifyCommand(baseDir string, args []string) int {
+	fs := flag.NewFlagSet("keys verify", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "restrict permissions to the current user before verifying")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 1
+	}
+	return withName(baseDir, positional, func(dir string) int {
+		if *fix {
+			if err := FixPermissions(dir); err != nil {
+				fmt.Printf("Error: failed to fix permissions: %v\n", err)
+				return 1
+			}
+		}
+		b, err := Verify(dir)
+		if err != nil {
+			fmt.Printf("Verification failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("OK: %s (%s)\n", b.OnionAddress, b.Fingerprint)
+		return 0
+	})
+}
+
+func importCommand(baseDir string, args []string) int {
+	fs := flag.NewFlagSet("keys import", flag.ContinueOnError)
+	name := fs.String("name", "", "name of the new key bundle")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 1
+	}
+	if len(positional) != 1 || *name == "" {
+		fmt.Println("Error: usage: keys import <hidden-service-dir|archive> --name <name>")
+		return 1
+	}
+	dst, err := bundleDir(baseDir, *name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	src := positional[0]
+	info, err := os.Stat(src)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	var b *Bundle
+	if info.IsDir() {
+		b, err = Import(src, dst)
+	} else {
+		var f *os.File
+		if f, err = os.Open(src); err == nil {
+			b, err = ImportArchive(f, dst)
+			f.Close()
+		}
+	}
+	if err != nil {
+		fmt.Printf("Import failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Imported %s into %s\n", b.OnionAddress, dst)
+	return 0
+}
+
+func exportCommand(baseDir string, args []string) int {
+	fs := flag.NewFlagSet("keys export", flag.ContinueOnError)
+	output := fs.String("o", "", "archive to write (default <name>.tar.gz, - for stdout)")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 1
+	}
+	return withName(baseDir, positional, func(dir string) int {
+		path := *output
+		if path == "" {
+			path = filepath.Base(dir) + ".tar.gz"
+		}
+		var w io.Writer = os.Stdout
+		if path != "-" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := Export(dir, w); err != nil {
+			if path != "-" {
+				os.Remove(path)
+			}
+			fmt.Printf("Export failed: %v\n", err)
+			return 1
+		}
+		if path != "-" {
+			fmt.Printf("Exported %s to %s; it contains the secret key, keep it safe\n", filepath.Base(dir), path)
+		}
+		return 0
+	})
+}
+
+func deleteCommand(baseDir string, args []string) int {
+	fs := flag.NewFlagSet("keys delete", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 1
+	}
+	return withName(baseDir, positional, func(dir string) int {
+		if _, err := os.Stat(dir); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		if !*yes {
+			fmt.Printf("Are you sure you want to delete %s? The onion address will be lost forever. [y/N] ", dir)
+			var response string
+			fmt.Scanln(&response)
+			if response != "y" && response != "Y" {
+				fmt.Println("Operation cancelled")
+				return 0
+			}
+		}
+		if err := Delete(dir); err != nil {
+			fmt.Printf("Delete failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Deleted %s\n", dir)
+		return 0
+	})
+}
+
+func encryptCommand(baseDir string, args []string, encrypt bool) int {
+	fs := flag.NewFlagSet("keys encrypt", flag.ContinueOnError)
+	fd := fs.Int("passphrase-fd", -1, "read the passphrase from this file descriptor")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 1
+	}
+	return withName(baseDir, positional, func(dir string) int {
+		prompt := fmt.Sprintf("Passphrase for %s: ", filepath.Base(dir))
+		if encrypt {
+			prompt = fmt.Sprintf("New passphrase for %s: ", filepath.Base(dir))
+		}
+		passphrase, err := ReadPassphrase(*fd, prompt, encrypt)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		if encrypt {
+			err = Encrypt(dir, passphrase)
+		} else {
+			err = Decrypt(dir, passphrase)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		if encrypt {
+			fmt.Printf("Encrypted the secret key of %s\n", dir)
+		} else {
+			fmt.Printf("Decrypted the secret key of %s\n", dir)
+		}
+		return 0
+	})
+}
+
+func rotateCommand(baseDir string, args []string) int {
+	fs := flag.NewFlagSet("keys rotate", flag.ContinueOnError)
+	name := fs.String("vanity-name", "", "key bundle to rotate")
+	overlap := fs.Duration("overlap", DefaultOverlap, "how long the old onion stays published")
+	successor := fs.String("successor", "", "bundle holding the new key (default: a random key)")
+	finish := fs.Bool("finish", false, "retire the old onion and delete its key")
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	verify := fs.String("verify", "", "check the rotation announcement in this file")
+	fd := fs.Int("passphrase-fd", -1, "read the passphrase from this file descriptor")
+	successorFD := fs.Int("successor-passphrase-fd", -1, "read the passphrase of the successor bundle from this file descriptor")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 1
+	}
+	if len(positional) != 0 {
+		fmt.Println("Error: usage: keys rotate --vanity-name <name> [--overlap D] [--successor <bundle>] | --finish | --verify <file>")
+		return 1
+	}
+	if *verify != "" {
+		return verifyRotationCommand(*verify)
+	}
+	dir, err := bundleDir(baseDir, *name)
+	if err != nil {
+		fmt.Printf("Error: %v (use --vanity-name)\n", err)
+		return 1
+	}
+	if *finish {
+		return finishRotationCommand(dir, *yes)
+	}
+	if *overlap < 0 {
+		fmt.Println("Error: --overlap must not be negative")
+		return 1
+	}
+
+	opts := RotateOptions{Overlap: *overlap}
+	if *successor != "" {
+		if opts.Successor, err = bundleDir(baseDir, *successor); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		if opts.Successor == dir {
+			fmt.Println("Error: a bundle cannot succeed itself")
+			return 1
+		}
+		if isEncrypted(opts.Successor) {
+			opts.SuccessorPassphrase, err = ReadPassphrase(*successorFD, fmt.Sprintf("Passphrase for the successor %s: ", *successor), false)
+			if err != nil {
+				fmt.Printf("Error: successor: %v\n", err)
+				return 1
+			}
+		}
+	}
+	if isEncrypted(dir) {
+		opts.Passphrase, err = ReadPassphrase(*fd, fmt.Sprintf("Passphrase for %s: ", *name), false)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+	}
+	r, err := Rotate(dir, opts)
+	if err != nil {
+		fmt.Printf("Rotation failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Rotated %s: %s -> %s\n", *name, r.Old, r.New)
+	fmt.Printf("The old key is kept in %s; the old onion stays published next to the new one until %s.\n",
+		RetiringDir(dir), r.Retires.Format(time.RFC3339))
+	fmt.Println("Restart serving to publish both. They serve the announcement signed by the old key at /.well-known/onion-rotation.txt.")
+	if clients, err := Clients(dir); err == nil && len(clients) > 0 {
+		fmt.Printf("%d authorized client(s) carried over; each needs a new .auth_private line for %s with its existing key.\n", len(clients), r.New)
+	}
+	return 0
+}
+
+func finishRotationCommand(dir string, yes bool) int {
+	retiring := RetiringDir(dir)
+	old, err := Inspect(retiring)
+	if err != nil {
+		fmt.Printf("Error: %s has no key being retired\n", filepath.Base(dir))
+		return 1
+	}
+	if !yes {
+		fmt.Printf("Retire %s and delete its key? The old address will be lost forever. [y/N] ", old.OnionAddress)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Operation cancelled")
+			return 0
+		}
+	}
+	if err := FinishRotation(dir); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Retired %s; restart serving to stop publishing it before its overlap ends\n", old.OnionAddress)
+	return 0
+}
+
+func verifyRotationCommand(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	r, err := ParseRotation(data)
+	if err != nil {
+		fmt.Printf("Verification failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Good signature by %s\n", r.Old)
+	fmt.Printf("New address:  %s\n", r.New)
+	fmt.Printf("Announced:    %s\n", r.Issued.Format(time.RFC3339))
+	fmt.Printf("Old retires:  %s\n", r.Retires.Format(time.RFC3339))
+	return 0
+}
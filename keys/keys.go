@@ -0,0 +1,440 @@
+// Package keys manages onion service key bundles: the directories under
+// data/vanity holding tor's hs_ed25519_secret_key, hs_ed25519_public_key and
+// hostname files plus cheeseburger's vanity.json.
+package keys
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cheeseburger/vanity"
+)
+
+// Files making up a key bundle. vanity.json is written last, so its presence
+// marks a complete bundle.
+const (
+	SecretKeyFile = "hs_ed25519_secret_key"
+	PublicKeyFile = "hs_ed25519_public_key"
+	HostnameFile  = "hostname"
+	MetadataFile  = "vanity.json"
+	// SealedKeyFile replaces SecretKeyFile in an encrypted bundle.
+	SealedKeyFile = "hs_ed25519_secret_key.enc"
+)
+
+// bundleFiles lists the bundle files in the order they are written.
+var bundleFiles = []string{SecretKeyFile, PublicKeyFile, HostnameFile, MetadataFile}
+
+// ErrEncrypted is returned when the secret key of an encrypted bundle is
+// needed; use Unlock instead.
+var ErrEncrypted = errors.New("secret key is encrypted")
+
+// filesIn returns the bundle files expected in dir, taking into account
+// whether its secret key is encrypted.
+func filesIn(dir string) []string {
+	if !isEncrypted(dir) {
+		return bundleFiles
+	}
+	return []string{SealedKeyFile, PublicKeyFile, HostnameFile, MetadataFile}
+}
+
+// isEncrypted reports whether dir holds an encrypted secret key and no
+// plaintext one.
+func isEncrypted(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, SecretKeyFile)); err == nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dir, SealedKeyFile))
+	return err == nil
+}
+
+// Bundle describes a key bundle. It never holds the secret key; use
+// ReadSecretKey for that.
+type Bundle struct {
+	Name         string
+	Dir          string
+	OnionAddress string // including ".onion"
+	PublicKey    ed25519.PublicKey
+	Fingerprint  string
+	Attempts     uint64
+	Created      time.Time
+	// Complete is false if vanity.json is missing, e.g. for a key tor
+	// generated itself.
+	Complete bool
+	// Encrypted is true if the secret key is sealed with a passphrase.
+	Encrypted bool
+	// Rotation is the announcement of the rotation that brought in this
+	// key, if any.
+	Rotation *Rotation
+}
+
+// Fingerprint returns an SSH style SHA256 fingerprint of an onion service
+// public key.
+func Fingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// ValidateName rejects bundle names that would escape the bundle directory
+// or clash with the directories a rotation keeps next to a bundle.
+func ValidateName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid key bundle name %q", name)
+	}
+	if strings.HasSuffix(name, RetiringSuffix) || strings.HasSuffix(name, stagingSuffix) {
+		return fmt.Errorf("invalid key bundle name %q: the suffixes %s and %s are reserved for key rotation", name, RetiringSuffix, stagingSuffix)
+	}
+	return nil
+}
+
+// List returns the names of all bundles under baseDir, sorted. Directories
+// without a secret key or vanity.json are skipped, as are the old and new
+// keys of a rotation, which belong to the bundle they are named after.
+func List(baseDir string) ([]string, error) {
+	entries, err := os.ReadDir(baseDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", baseDir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() || ValidateName(e.Name()) != nil {
+			continue
+		}
+		for _, f := range []string{SecretKeyFile, SealedKeyFile, MetadataFile} {
+			if _, err := os.Stat(filepath.Join(baseDir, e.Name(), f)); err == nil {
+				names = append(names, e.Name())
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ReadSecretKey returns the 64-byte expanded secret key stored in dir. It
+// returns ErrEncrypted for encrypted bundles.
+func ReadSecretKey(dir string) ([]byte, error) {
+	if isEncrypted(dir) {
+		return nil, ErrEncrypted
+	}
+	data, err := os.ReadFile(filepath.Join(dir, SecretKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret key file: %v", err)
+	}
+	expanded, err := vanity.ParseSecretKeyFile(data)
+	if err != nil {
+		return nil, err
+	}
+	return expanded, nil
+}
+
+// Inspect describes the bundle in dir. Only the secret key (plain or
+// encrypted) is required; the other files are not checked, see Verify for
+// that.
+func Inspect(dir string) (*Bundle, error) {
+	var pub ed25519.PublicKey
+	encrypted := isEncrypted(dir)
+	if encrypted {
+		data, err := os.ReadFile(filepath.Join(dir, SealedKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encrypted secret key: %v", err)
+		}
+		sk, err := parseSealedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		pub = sk.publicKey
+	} else {
+		expanded, err := ReadSecretKey(dir)
+		if err != nil {
+			return nil, err
+		}
+		pub, err = vanity.PublicKeyFromExpanded(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive public key from secret key: %v", err)
+		}
+	}
+	b := &Bundle{
+		Name:         filepath.Base(dir),
+		Dir:          dir,
+		OnionAddress: vanity.OnionAddress(pub) + ".onion",
+		PublicKey:    pub,
+		Fingerprint:  Fingerprint(pub),
+		Encrypted:    encrypted,
+	}
+	if info, err := os.Stat(filepath.Join(dir, filesIn(dir)[0])); err == nil {
+		b.Created = info.ModTime().UTC()
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, MetadataFile)); err == nil {
+		var vk vanity.VanityKey
+		if err := json.Unmarshal(data, &vk); err == nil {
+			b.Complete = true
+			b.Attempts = vk.Attempts
+			if t, err := time.Parse(time.RFC3339, vk.Timestamp); err == nil {
+				b.Created = t
+			}
+		}
+	}
+	if r, err := ReadRotation(dir); err == nil && r != nil && r.New == b.OnionAddress {
+		b.Rotation = r
+	}
+	return b, nil
+}
+
+// Verify checks that the bundle in dir is complete and consistent: the key
+// files have tor's headers, the public key and hostname belong to the secret
+// key, vanity.json agrees with them, and no other user can read the keys.
+// For an encrypted bundle the secret key itself is only checked by Unlock.
+func Verify(dir string) (*Bundle, error) {
+	files := make(map[string][]byte)
+	for _, f := range filesIn(dir) {
+		data, err := os.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", f, err)
+		}
+		files[f] = data
+	}
+	if _, err := verifyFiles(files); err != nil {
+		return nil, err
+	}
+	if err := checkPermissions(dir); err != nil {
+		return nil, err
+	}
+	b, err := Inspect(dir)
+	if err != nil {
+		return nil, err
+	}
+	if r, err := ReadRotation(dir); err != nil {
+		return nil, fmt.Errorf("%s: %v", RotationFile, err)
+	} else if r != nil && r.New != b.OnionAddress {
+		return nil, fmt.Errorf("%s announces %s, not this key", RotationFile, r.New)
+	}
+	return b, nil
+}
+
+// verifyFiles checks the consistency of bundle file contents and returns the
+// public key. A missing hostname or vanity.json is not an error.
+func verifyFiles(files map[string][]byte) (ed25519.PublicKey, error) {
+	var derived ed25519.PublicKey
+	if sealed, ok := files[SealedKeyFile]; ok && files[SecretKeyFile] == nil {
+		sk, err := parseSealedKey(sealed)
+		if err != nil {
+			return nil, err
+		}
+		derived = sk.publicKey
+	} else {
+		expanded, err := vanity.ParseSecretKeyFile(files[SecretKeyFile])
+		if err != nil {
+			return nil, err
+		}
+		derived, err = vanity.PublicKeyFromExpanded(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive public key from secret key: %v", err)
+		}
+	}
+	hostname := vanity.OnionAddress(derived) + ".onion"
+
+	if data, ok := files[PublicKeyFile]; ok {
+		stored, err := vanity.ParsePublicKeyFile(data)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(stored, derived) {
+			return nil, fmt.Errorf("public key mismatch: stored key does not match key derived from secret key")
+		}
+	}
+	if data, ok := files[HostnameFile]; ok {
+		if got := strings.TrimSpace(string(data)); got != hostname {
+			return nil, fmt.Errorf("hostname mismatch: %s does not belong to the secret key (%s)", got, hostname)
+		}
+	}
+	if data, ok := files[MetadataFile]; ok {
+		var vk vanity.VanityKey
+		if err := json.Unmarshal(data, &vk); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", MetadataFile, err)
+		}
+		if vk.OnionAddress != hostname {
+			return nil, fmt.Errorf("%s mismatch: expected %s but found %s", MetadataFile, hostname, vk.OnionAddress)
+		}
+		if vk.PublicKey != hex.EncodeToString(derived) {
+			return nil, fmt.Errorf("%s mismatch: public key does not belong to the secret key", MetadataFile)
+		}
+	}
+	return derived, nil
+}
+
+// checkPermissions makes sure tor will accept dir as a HiddenServiceDir and
+// that the key files are private.
+func checkPermissions(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %04o)", dir, info.Mode().Perm())
+	}
+	for _, f := range filesIn(dir) {
+		info, err := os.Stat(filepath.Join(dir, f))
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return fmt.Errorf("%s is accessible by other users (mode %04o)", f, info.Mode().Perm())
+		}
+	}
+	return nil
+}
+
+// FixPermissions restricts dir, its bundle files and authorized clients to
+// the current user.
+func FixPermissions(dir string) error {
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+	for _, f := range append([]string{SealedKeyFile}, bundleFiles...) {
+		err := os.Chmod(filepath.Join(dir, f), 0600)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	clientsDir := filepath.Join(dir, AuthorizedClientsDir)
+	entries, err := os.ReadDir(clientsDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(clientsDir, 0700); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			if err := os.Chmod(filepath.Join(clientsDir, e.Name()), 0600); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Import copies the key from an existing tor HiddenServiceDir into a new
+// bundle at dstDir. The source is verified first; its hostname and public
+// key files are optional because both can be derived from the secret key.
+func Import(srcDir, dstDir string) (*Bundle, error) {
+	files := make(map[string][]byte)
+	for _, f := range bundleFiles {
+		data, err := os.ReadFile(filepath.Join(srcDir, f))
+		if os.IsNotExist(err) && f != SecretKeyFile {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", f, err)
+		}
+		files[f] = data
+	}
+	return writeBundle(files, dstDir)
+}
+
+// writeBundle verifies files and writes them as a new bundle into dstDir,
+// filling in any derivable file that is missing.
+func writeBundle(files map[string][]byte, dstDir string) (*Bundle, error) {
+	pub, err := verifyFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []string{SecretKeyFile, SealedKeyFile, MetadataFile} {
+		if _, err := os.Stat(filepath.Join(dstDir, f)); err == nil {
+			return nil, fmt.Errorf("a key already exists in %s; choose another name or delete it first", dstDir)
+		}
+	}
+
+	if _, ok := files[PublicKeyFile]; !ok {
+		files[PublicKeyFile] = append([]byte(vanity.PublicKeyHeader), pub...)
+	}
+	hostname := vanity.OnionAddress(pub) + ".onion"
+	files[HostnameFile] = []byte(hostname + "\n")
+	if _, ok := files[MetadataFile]; !ok {
+		data, err := json.MarshalIndent(vanity.VanityKey{
+			OnionAddress: hostname,
+			PublicKey:    hex.EncodeToString(pub),
+			Timestamp:    time.Now().UTC().Format(time.RFC3339),
+		}, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		files[MetadataFile] = append(data, '\n')
+	}
+
+	if err := os.MkdirAll(dstDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+	for _, f := range append([]string{SealedKeyFile}, bundleFiles...) {
+		if _, ok := files[f]; !ok {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dstDir, f), files[f], 0600); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", f, err)
+		}
+	}
+	return Inspect(dstDir)
+}
+
+// Delete removes the bundle in dir. Every file is overwritten with random
+// data and synced before it is unlinked. On copy-on-write or journaling
+// filesystems and SSDs old blocks may survive regardless, so treat deleted
+// keys that were ever exposed as compromised.
+func Delete(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return shred(path, info.Size())
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// shred overwrites a file with random data before removing it.
+func shred(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to overwrite %s: %v", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,168 @@
+package keys
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cheeseburger/vanity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBundle saves a freshly generated key bundle under base/name.
+func newBundle(t *testing.T, base, name string) string {
+	t.Helper()
+	var seed [32]byte
+	copy(seed[:], name)
+	expanded := vanity.ExpandSeed(seed[:])
+	dir := filepath.Join(base, name)
+	_, err := vanity.SaveBundle(dir, expanded[:], 42)
+	require.NoError(t, err)
+	return dir
+}
+
+func TestListAndInspect(t *testing.T) {
+	base := t.TempDir()
+	newBundle(t, base, "blog")
+	newBundle(t, base, "alpha")
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "empty"), 0700))
+
+	names, err := List(base)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alpha", "blog"}, names)
+
+	names, err = List(filepath.Join(base, "missing"))
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	b, err := Inspect(filepath.Join(base, "blog"))
+	require.NoError(t, err)
+	assert.Equal(t, "blog", b.Name)
+	assert.Equal(t, vanity.OnionAddress(b.PublicKey)+".onion", b.OnionAddress)
+	assert.Equal(t, Fingerprint(b.PublicKey), b.Fingerprint)
+	assert.Contains(t, b.Fingerprint, "SHA256:")
+	assert.Equal(t, uint64(42), b.Attempts)
+	assert.True(t, b.Complete)
+	assert.False(t, b.Created.IsZero())
+}
+
+func TestVerify(t *testing.T) {
+	base := t.TempDir()
+	dir := newBundle(t, base, "blog")
+
+	b, err := Verify(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "blog", b.Name)
+
+	// Permissions tor would reject are reported and can be fixed.
+	require.NoError(t, os.Chmod(filepath.Join(dir, SecretKeyFile), 0644))
+	_, err = Verify(dir)
+	assert.ErrorContains(t, err, "accessible by other users")
+	require.NoError(t, FixPermissions(dir))
+	_, err = Verify(dir)
+	assert.NoError(t, err)
+
+	// A hostname belonging to another key is a mismatch.
+	other := newBundle(t, base, "other")
+	hostname, err := os.ReadFile(filepath.Join(other, HostnameFile))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, HostnameFile), hostname, 0600))
+	_, err = Verify(dir)
+	assert.ErrorContains(t, err, "hostname mismatch")
+
+	// So is a public key file from another key.
+	dir = newBundle(t, base, "third")
+	pub, err := os.ReadFile(filepath.Join(other, PublicKeyFile))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, PublicKeyFile), pub, 0600))
+	_, err = Verify(dir)
+	assert.ErrorContains(t, err, "public key mismatch")
+
+	// And a truncated secret key.
+	dir = newBundle(t, base, "fourth")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, SecretKeyFile), []byte("junk"), 0600))
+	_, err = Verify(dir)
+	assert.Error(t, err)
+}
+
+func TestImportHiddenServiceDir(t *testing.T) {
+	base := t.TempDir()
+	src := newBundle(t, base, "tor")
+	// A HiddenServiceDir written by tor has no vanity.json.
+	require.NoError(t, os.Remove(filepath.Join(src, MetadataFile)))
+	want, err := Inspect(src)
+	require.NoError(t, err)
+	assert.False(t, want.Complete)
+
+	dst := filepath.Join(base, "imported")
+	b, err := Import(src, dst)
+	require.NoError(t, err)
+	assert.Equal(t, want.OnionAddress, b.OnionAddress)
+	assert.True(t, b.Complete)
+	_, err = Verify(dst)
+	assert.NoError(t, err)
+
+	// Importing over an existing bundle is refused.
+	_, err = Import(src, dst)
+	assert.ErrorContains(t, err, "already exists")
+}
+
+func TestExportImportArchive(t *testing.T) {
+	base := t.TempDir()
+	dir := newBundle(t, base, "blog")
+
+	var archive bytes.Buffer
+	require.NoError(t, Export(dir, &archive))
+
+	dst := filepath.Join(base, "restored")
+	b, err := ImportArchive(bytes.NewReader(archive.Bytes()), dst)
+	require.NoError(t, err)
+	orig, err := Inspect(dir)
+	require.NoError(t, err)
+	assert.Equal(t, orig.OnionAddress, b.OnionAddress)
+	assert.Equal(t, orig.Attempts, b.Attempts, "metadata should survive the round trip")
+	_, err = Verify(dst)
+	assert.NoError(t, err)
+
+	_, err = ImportArchive(bytes.NewReader([]byte("not an archive")), filepath.Join(base, "bad"))
+	assert.Error(t, err)
+}
+
+func TestDelete(t *testing.T) {
+	base := t.TempDir()
+	dir := newBundle(t, base, "blog")
+	require.NoError(t, Delete(dir))
+	_, err := os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+	assert.Error(t, Delete(dir))
+}
+
+func TestValidateName(t *testing.T) {
+	assert.NoError(t, ValidateName("myblog"))
+	for _, name := range []string{"", ".", "..", "../etc", `a\b`, "myblog.retiring", "myblog.next"} {
+		assert.Error(t, ValidateName(name), name)
+	}
+}
+
+func TestRunKeysCommands(t *testing.T) {
+	baseDir := t.TempDir()
+	newBundle(t, baseDir, "blog")
+
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"list"}))
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"inspect", "blog"}))
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"verify", "blog", "--fix"}))
+	assert.Equal(t, 1, RunKeys(baseDir, []string{"inspect", "missing"}))
+	assert.Equal(t, 1, RunKeys(baseDir, []string{"inspect", "../blog"}))
+	assert.Equal(t, 1, RunKeys(baseDir, []string{"bogus"}))
+
+	archive := filepath.Join(t.TempDir(), "blog.tar.gz")
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"export", "blog", "-o", archive}))
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"import", archive, "--name", "copy"}))
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"delete", "--yes", "blog"}))
+	names, err := List(baseDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"copy"}, names)
+}
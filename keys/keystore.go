@@ -0,0 +1,217 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cheeseburger/vanity"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// kdfParams are the Argon2id parameters used to derive the sealing key from
+// a passphrase. They are stored with every sealed key so they can be raised
+// later without breaking existing bundles.
+type kdfParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory_kib"`
+	Threads uint8  `json:"threads"`
+}
+
+// defaultKDF follows the second recommended Argon2id option of RFC 9106. It
+// is a variable so tests can use cheaper parameters.
+var defaultKDF = kdfParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// maxKDFMemory bounds the memory a sealed key file may ask for (4 GiB), so a
+// crafted file cannot exhaust memory.
+const maxKDFMemory = 4 * 1024 * 1024
+
+// sealedKeyFile is the on-disk format of hs_ed25519_secret_key.enc. The
+// public key is stored in the clear so the bundle can be listed and verified
+// without the passphrase; it is bound to the ciphertext as associated data.
+type sealedKeyFile struct {
+	Version    int       `json:"version"`
+	PublicKey  string    `json:"public_key"`
+	KDF        string    `json:"kdf"`
+	Params     kdfParams `json:"kdf_params"`
+	Salt       []byte    `json:"salt"`
+	Cipher     string    `json:"cipher"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+
+	publicKey ed25519.PublicKey
+}
+
+// ErrWrongPassphrase is returned when a sealed key cannot be opened.
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted encrypted key")
+
+// sealedKeyAD returns the associated data binding a ciphertext to its key.
+func sealedKeyAD(publicKey string) []byte {
+	return []byte("cheeseburger sealed onion key v1\n" + publicKey)
+}
+
+// parseSealedKey decodes a sealed key file without opening it.
+func parseSealedKey(data []byte) (*sealedKeyFile, error) {
+	var sk sealedKeyFile
+	if err := json.Unmarshal(data, &sk); err != nil {
+		return nil, fmt.Errorf("encrypted secret key has invalid format: %v", err)
+	}
+	if sk.Version != 1 || sk.KDF != "argon2id" || sk.Cipher != "xchacha20-poly1305" {
+		return nil, fmt.Errorf("unsupported encrypted secret key (version %d, %s, %s)", sk.Version, sk.KDF, sk.Cipher)
+	}
+	pub, err := hex.DecodeString(sk.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("encrypted secret key has an invalid public key")
+	}
+	if len(sk.Nonce) != chacha20poly1305.NonceSizeX || len(sk.Salt) < 16 {
+		return nil, fmt.Errorf("encrypted secret key has an invalid nonce or salt")
+	}
+	if sk.Params.Time == 0 || sk.Params.Threads == 0 || sk.Params.Memory == 0 || sk.Params.Memory > maxKDFMemory {
+		return nil, fmt.Errorf("encrypted secret key has invalid key derivation parameters")
+	}
+	sk.publicKey = pub
+	return &sk, nil
+}
+
+// Seal encrypts an expanded secret key with a key derived from passphrase
+// (Argon2id) using XChaCha20-Poly1305, returning the contents of a sealed key
+// file.
+func Seal(expanded, passphrase []byte) ([]byte, error) {
+	pub, err := vanity.PublicKeyFromExpanded(expanded)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	sk := sealedKeyFile{
+		Version:   1,
+		PublicKey: hex.EncodeToString(pub),
+		KDF:       "argon2id",
+		Params:    defaultKDF,
+		Salt:      make([]byte, 16),
+		Cipher:    "xchacha20-poly1305",
+		Nonce:     make([]byte, chacha20poly1305.NonceSizeX),
+	}
+	if _, err := rand.Read(sk.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(sk.Nonce); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(deriveKey(passphrase, &sk))
+	if err != nil {
+		return nil, err
+	}
+	sk.Ciphertext = aead.Seal(nil, sk.Nonce, expanded, sealedKeyAD(sk.PublicKey))
+	data, err := json.MarshalIndent(sk, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Open decrypts a sealed key file and checks that the secret key belongs to
+// the public key recorded in it.
+func Open(data, passphrase []byte) ([]byte, error) {
+	sk, err := parseSealedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(deriveKey(passphrase, sk))
+	if err != nil {
+		return nil, err
+	}
+	expanded, err := aead.Open(nil, sk.Nonce, sk.Ciphertext, sealedKeyAD(sk.PublicKey))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	pub, err := vanity.PublicKeyFromExpanded(expanded)
+	if err != nil || !pub.Equal(sk.publicKey) {
+		return nil, fmt.Errorf("encrypted secret key does not belong to %s", sk.PublicKey)
+	}
+	return expanded, nil
+}
+
+func deriveKey(passphrase []byte, sk *sealedKeyFile) []byte {
+	p := sk.Params
+	return argon2.IDKey(passphrase, sk.Salt, p.Time, p.Memory, p.Threads, chacha20poly1305.KeySize)
+}
+
+// Unlock returns the expanded secret key of the bundle in dir, decrypting it
+// with passphrase if the bundle is encrypted.
+func Unlock(dir string, passphrase []byte) ([]byte, error) {
+	if !isEncrypted(dir) {
+		return ReadSecretKey(dir)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, SealedKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted secret key: %v", err)
+	}
+	return Open(data, passphrase)
+}
+
+// Encrypt seals the secret key of the bundle in dir with passphrase and
+// securely removes the plaintext key file.
+func Encrypt(dir string, passphrase []byte) error {
+	if isEncrypted(dir) {
+		return fmt.Errorf("%s is already encrypted", dir)
+	}
+	if _, err := Verify(dir); err != nil {
+		return err
+	}
+	expanded, err := ReadSecretKey(dir)
+	if err != nil {
+		return err
+	}
+	sealed, err := Seal(expanded, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, SealedKeyFile), sealed); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, SecretKeyFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return shred(path, info.Size())
+}
+
+// Decrypt restores the plaintext secret key of the bundle in dir, for
+// example before exporting it to a plain tor HiddenServiceDir.
+func Decrypt(dir string, passphrase []byte) error {
+	if !isEncrypted(dir) {
+		return fmt.Errorf("%s is not encrypted", dir)
+	}
+	expanded, err := Unlock(dir, passphrase)
+	if err != nil {
+		return err
+	}
+	data := append([]byte(vanity.SecretKeyHeader), expanded...)
+	if err := writeFileAtomic(filepath.Join(dir, SecretKeyFile), data); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, SealedKeyFile))
+}
+
+// writeFileAtomic writes a private file via a temporary file and rename.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
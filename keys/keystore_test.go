@@ -0,0 +1,110 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cheeseburger/vanity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	// Keep the tests fast; the format records the parameters used.
+	defaultKDF = kdfParams{Time: 1, Memory: 64, Threads: 1}
+}
+
+func TestSealOpen(t *testing.T) {
+	var seed [32]byte
+	expanded := vanity.ExpandSeed(seed[:])
+
+	sealed, err := Seal(expanded[:], []byte("correct horse"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), string(expanded[:32]))
+
+	opened, err := Open(sealed, []byte("correct horse"))
+	require.NoError(t, err)
+	assert.Equal(t, expanded[:], opened)
+
+	_, err = Open(sealed, []byte("wrong"))
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+
+	// The recorded public key is authenticated with the ciphertext.
+	other := vanity.ExpandSeed([]byte("another seed, 32 bytes long....."))
+	otherPub, _ := vanity.PublicKeyFromExpanded(other[:])
+	sk, err := parseSealedKey(sealed)
+	require.NoError(t, err)
+	tampered := bytes.Replace(sealed, []byte(sk.PublicKey), []byte(hex.EncodeToString(otherPub)), 1)
+	_, err = Open(tampered, []byte("correct horse"))
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+
+	_, err = Seal(expanded[:], nil)
+	assert.Error(t, err)
+}
+
+func TestEncryptDecryptBundle(t *testing.T) {
+	base := t.TempDir()
+	dir := newBundle(t, base, "blog")
+	want, err := ReadSecretKey(dir)
+	require.NoError(t, err)
+	passphrase := []byte("hunter2")
+
+	require.NoError(t, Encrypt(dir, passphrase))
+	_, err = os.Stat(filepath.Join(dir, SecretKeyFile))
+	assert.True(t, os.IsNotExist(err), "plaintext key must be removed")
+	assert.Error(t, Encrypt(dir, passphrase))
+
+	// The bundle can still be listed, inspected and verified.
+	names, err := List(base)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"blog"}, names)
+	b, err := Verify(dir)
+	require.NoError(t, err)
+	assert.True(t, b.Encrypted)
+
+	_, err = ReadSecretKey(dir)
+	assert.ErrorIs(t, err, ErrEncrypted)
+	_, err = Unlock(dir, []byte("wrong"))
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+	got, err := Unlock(dir, passphrase)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// Encrypted bundles survive export and import without the passphrase.
+	var archive bytes.Buffer
+	require.NoError(t, Export(dir, &archive))
+	copyDir := filepath.Join(base, "copy")
+	b, err = ImportArchive(&archive, copyDir)
+	require.NoError(t, err)
+	assert.True(t, b.Encrypted)
+	got, err = Unlock(copyDir, passphrase)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	require.NoError(t, Decrypt(dir, passphrase))
+	got, err = ReadSecretKey(dir)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	_, err = Verify(dir)
+	assert.NoError(t, err)
+}
+
+func TestReadPassphrase(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	_, err = w.WriteString("from fd\nignored\n")
+	require.NoError(t, err)
+	w.Close()
+	p, err := ReadPassphrase(int(r.Fd()), "", false)
+	require.NoError(t, err)
+	assert.Equal(t, "from fd", string(p))
+
+	t.Setenv(PassphraseEnv, "from env")
+	p, err = ReadPassphrase(-1, "", false)
+	require.NoError(t, err)
+	assert.Equal(t, "from env", string(p))
+}
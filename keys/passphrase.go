@@ -0,0 +1,75 @@
+package keys
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// PassphraseEnv is the environment variable consulted for the passphrase of
+// an encrypted bundle when no file descriptor is given.
+const PassphraseEnv = "CHEESEBURGER_PASSPHRASE"
+
+// ReadPassphrase obtains a passphrase from, in order of preference, the file
+// descriptor fd (if fd >= 0), the CHEESEBURGER_PASSPHRASE environment
+// variable, or an interactive prompt on the terminal. With confirm the
+// prompt asks twice, for setting a new passphrase.
+func ReadPassphrase(fd int, prompt string, confirm bool) ([]byte, error) {
+	if fd >= 0 {
+		f := os.NewFile(uintptr(fd), "passphrase-fd")
+		if f == nil {
+			return nil, fmt.Errorf("invalid passphrase file descriptor %d", fd)
+		}
+		defer f.Close()
+		return readPassphraseLine(f)
+	}
+	if p, ok := os.LookupEnv(PassphraseEnv); ok {
+		if p == "" {
+			return nil, fmt.Errorf("%s is empty", PassphraseEnv)
+		}
+		return []byte(p), nil
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return nil, fmt.Errorf("a passphrase is required: run in a terminal, set %s or use --passphrase-fd", PassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %v", err)
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := term.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %v", err)
+		}
+		if string(again) != string(p) {
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	return p, nil
+}
+
+// readPassphraseLine reads the first line from r.
+func readPassphraseLine(r io.Reader) ([]byte, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read passphrase: %v", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	return []byte(line), nil
+}
@@ -0,0 +1,269 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cheeseburger/vanity"
+)
+
+const (
+	// RotationFile holds the signed announcement of a key rotation in the
+	// bundle of the new key.
+	RotationFile = "rotation.txt"
+	// RetiringSuffix is appended to the bundle name of the old key while
+	// it is still published next to its successor.
+	RetiringSuffix = ".retiring"
+	// stagingSuffix is appended to the bundle name while the new bundle of
+	// a rotation is assembled.
+	stagingSuffix = ".next"
+	// rotationHeader is the first line of an announcement.
+	rotationHeader = "onion-rotation v1"
+	// DefaultOverlap is how long the old onion stays published by default.
+	DefaultOverlap = 30 * 24 * time.Hour
+)
+
+// Rotation announces that the onion service at Old moved to New. It is
+// signed by the key of Old, so anyone who trusted the old address can check
+// that the new one belongs to the same operator.
+type Rotation struct {
+	Old     string // including ".onion"
+	New     string
+	Issued  time.Time
+	Retires time.Time
+	// Signature is the ed25519 signature of the old key over the
+	// announcement without its signature line.
+	Signature []byte
+}
+
+// message returns the signed part of the announcement.
+func (r *Rotation) message() []byte {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, rotationHeader)
+	fmt.Fprintf(&b, "old-address: %s\n", r.Old)
+	fmt.Fprintf(&b, "new-address: %s\n", r.New)
+	fmt.Fprintf(&b, "issued: %s\n", r.Issued.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "retires: %s\n", r.Retires.UTC().Format(time.RFC3339))
+	return b.Bytes()
+}
+
+// Marshal returns the announcement in its text form, as served from both
+// onions.
+func (r *Rotation) Marshal() []byte {
+	return append(r.message(), "signature: "+base64.StdEncoding.EncodeToString(r.Signature)+"\n"...)
+}
+
+// ParseRotation parses an announcement and checks its signature against
+// the old onion address.
+func ParseRotation(data []byte) (*Rotation, error) {
+	signed, sigLine, ok := bytes.Cut(data, []byte("signature: "))
+	if !ok {
+		return nil, fmt.Errorf("rotation announcement is not signed")
+	}
+	r := &Rotation{}
+	lines := strings.Split(strings.TrimSuffix(string(signed), "\n"), "\n")
+	if len(lines) != 5 || lines[0] != rotationHeader {
+		return nil, fmt.Errorf("not an onion rotation announcement")
+	}
+	for _, line := range lines[1:] {
+		key, value, _ := strings.Cut(line, ": ")
+		var err error
+		switch key {
+		case "old-address":
+			r.Old = value
+		case "new-address":
+			r.New = value
+		case "issued":
+			r.Issued, err = time.Parse(time.RFC3339, value)
+		case "retires":
+			r.Retires, err = time.Parse(time.RFC3339, value)
+		default:
+			err = fmt.Errorf("unexpected %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed rotation announcement: %v", err)
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigLine)))
+	if err != nil {
+		return nil, fmt.Errorf("malformed rotation signature: %v", err)
+	}
+	r.Signature = sig
+	oldKey, err := vanity.PublicKeyFromOnion(r.Old)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := vanity.PublicKeyFromOnion(r.New); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(r.message(), signed) || !ed25519.Verify(oldKey, signed, sig) {
+		return nil, fmt.Errorf("rotation announcement is not signed by %s", r.Old)
+	}
+	return r, nil
+}
+
+// ReadRotation returns the verified rotation announcement in the bundle in
+// dir, or nil if its key was never rotated in.
+func ReadRotation(dir string) (*Rotation, error) {
+	data, err := os.ReadFile(filepath.Join(dir, RotationFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseRotation(data)
+}
+
+// RetiringDir returns where the old key of the bundle in dir is kept while
+// it is being retired.
+func RetiringDir(dir string) string {
+	return filepath.Clean(dir) + RetiringSuffix
+}
+
+// RotateOptions control a key rotation.
+type RotateOptions struct {
+	// Passphrase unlocks an encrypted bundle; the new key is sealed with
+	// it as well.
+	Passphrase []byte
+	// SuccessorPassphrase unlocks an encrypted successor bundle.
+	SuccessorPassphrase []byte
+	// Successor is the directory of a bundle holding the new key, for
+	// example a vanity search result. It is deleted once its key has moved
+	// in. Empty generates a random key.
+	Successor string
+	// Overlap is how long the old onion stays published.
+	Overlap time.Duration
+}
+
+// Rotate replaces the key of the bundle in dir with a successor. The old
+// key moves to RetiringDir(dir) and a rotation announcement signed by it is
+// stored with the new key, which takes over the bundle name so that
+// everything serving it picks up the new address. Authorized clients are
+// carried over.
+func Rotate(dir string, opts RotateOptions) (*Rotation, error) {
+	retiring := RetiringDir(dir)
+	if _, err := os.Stat(retiring); err == nil {
+		return nil, fmt.Errorf("the previous rotation of %s is not finished; retire %s first", filepath.Base(dir), retiring)
+	}
+	old, err := Verify(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !old.Encrypted {
+		opts.Passphrase = nil
+	}
+	oldKey, err := Unlock(dir, opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	var newKey []byte
+	var attempts uint64
+	if opts.Successor != "" {
+		succ, err := Verify(opts.Successor)
+		if err != nil {
+			return nil, fmt.Errorf("successor: %v", err)
+		}
+		if newKey, err = Unlock(opts.Successor, opts.SuccessorPassphrase); err != nil {
+			return nil, fmt.Errorf("successor: %v", err)
+		}
+		attempts = succ.Attempts
+	} else {
+		var seed [32]byte
+		if _, err := rand.Read(seed[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate key: %v", err)
+		}
+		key := vanity.ExpandSeed(seed[:])
+		newKey = key[:]
+	}
+	newPub, err := vanity.PublicKeyFromExpanded(newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	r := &Rotation{
+		Old:     old.OnionAddress,
+		New:     vanity.OnionAddress(newPub) + ".onion",
+		Issued:  now,
+		Retires: now.Add(opts.Overlap),
+	}
+	if r.Old == r.New {
+		return nil, fmt.Errorf("the successor has the same key as %s", filepath.Base(dir))
+	}
+	if r.Signature, err = vanity.SignExpanded(oldKey, r.message()); err != nil {
+		return nil, err
+	}
+
+	// Assemble the new bundle next to the old one, then swap them.
+	staging := filepath.Clean(dir) + stagingSuffix
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	if _, err := vanity.SaveBundle(staging, newKey, attempts); err != nil {
+		return nil, err
+	}
+	err = copyClients(dir, staging)
+	if err == nil && old.Encrypted {
+		err = Encrypt(staging, opts.Passphrase)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(staging, RotationFile), r.Marshal(), 0600)
+	}
+	if err != nil {
+		Delete(staging)
+		return nil, err
+	}
+	if err := os.Rename(dir, retiring); err != nil {
+		Delete(staging)
+		return nil, fmt.Errorf("failed to move the old key aside: %v", err)
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		os.Rename(retiring, dir)
+		Delete(staging)
+		return nil, fmt.Errorf("failed to install the new key: %v", err)
+	}
+
+	if opts.Successor != "" {
+		if err := Delete(opts.Successor); err != nil {
+			return r, fmt.Errorf("rotated, but failed to delete the successor bundle: %v", err)
+		}
+	}
+	return r, nil
+}
+
+// copyClients copies the authorized clients of the bundle in src to dst.
+func copyClients(src, dst string) error {
+	clients, err := Clients(src)
+	if err != nil || len(clients) == 0 {
+		return err
+	}
+	clientsDir := filepath.Join(dst, AuthorizedClientsDir)
+	if err := os.MkdirAll(clientsDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", AuthorizedClientsDir, err)
+	}
+	for _, c := range clients {
+		if err := os.WriteFile(filepath.Join(clientsDir, c.Name+".auth"), []byte(c.AuthLine()+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FinishRotation retires the old key of the bundle in dir for good by
+// deleting it. The announcement stays with the new key.
+func FinishRotation(dir string) error {
+	retiring := RetiringDir(dir)
+	if _, err := os.Stat(retiring); os.IsNotExist(err) {
+		return fmt.Errorf("%s has no key being retired", filepath.Base(dir))
+	}
+	return Delete(retiring)
+}
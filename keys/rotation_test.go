@@ -0,0 +1,185 @@
+package keys
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"cheeseburger/vanity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotate(t *testing.T) {
+	base := t.TempDir()
+	dir := newBundle(t, base, "blog")
+	old, err := Inspect(dir)
+	require.NoError(t, err)
+	_, _, err = AddClient(dir, "alice")
+	require.NoError(t, err)
+
+	r, err := Rotate(dir, RotateOptions{Overlap: 48 * time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, old.OnionAddress, r.Old)
+	assert.NotEqual(t, r.Old, r.New)
+	assert.Equal(t, 48*time.Hour, r.Retires.Sub(r.Issued))
+
+	b, err := Verify(dir)
+	require.NoError(t, err, "the new key takes over the bundle name")
+	assert.Equal(t, r.New, b.OnionAddress)
+	assert.Equal(t, r, b.Rotation)
+	retired, err := Verify(RetiringDir(dir))
+	require.NoError(t, err)
+	assert.Equal(t, r.Old, retired.OnionAddress)
+	clients, err := Clients(dir)
+	require.NoError(t, err)
+	assert.Len(t, clients, 1, "authorized clients are carried over")
+
+	_, err = Rotate(dir, RotateOptions{})
+	assert.ErrorContains(t, err, "not finished")
+	require.NoError(t, FinishRotation(dir))
+	assert.NoDirExists(t, RetiringDir(dir))
+	assert.Error(t, FinishRotation(dir))
+	b, err = Verify(dir)
+	require.NoError(t, err)
+	assert.NotNil(t, b.Rotation, "the announcement outlives the old key")
+}
+
+func TestRotateEncryptedToSuccessor(t *testing.T) {
+	base := t.TempDir()
+	dir := newBundle(t, base, "blog")
+	passphrase := []byte("hunter2")
+	require.NoError(t, Encrypt(dir, passphrase))
+	successor := newBundle(t, base, "vanity-result")
+	want, err := Inspect(successor)
+	require.NoError(t, err)
+
+	_, err = Rotate(dir, RotateOptions{Passphrase: []byte("wrong"), Successor: successor})
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+	assert.DirExists(t, successor, "nothing changes on failure")
+
+	r, err := Rotate(dir, RotateOptions{Passphrase: passphrase, Successor: successor})
+	require.NoError(t, err)
+	assert.Equal(t, want.OnionAddress, r.New)
+	assert.NoDirExists(t, successor, "the successor's key moved in")
+	b, err := Verify(dir)
+	require.NoError(t, err)
+	assert.True(t, b.Encrypted, "the new key is sealed like the old one")
+	assert.Equal(t, uint64(42), b.Attempts)
+	_, err = Unlock(dir, passphrase)
+	assert.NoError(t, err)
+}
+
+func TestRotateToEncryptedSuccessor(t *testing.T) {
+	base := t.TempDir()
+	dir := newBundle(t, base, "blog")
+	passphrase := []byte("hunter2")
+	require.NoError(t, Encrypt(dir, passphrase))
+	successor := newBundle(t, base, "vanity-result")
+	successorPassphrase := []byte("correct horse")
+	require.NoError(t, Encrypt(successor, successorPassphrase))
+
+	_, err := Rotate(dir, RotateOptions{Passphrase: passphrase, Successor: successor})
+	assert.ErrorContains(t, err, "successor", "the successor has its own passphrase")
+	assert.DirExists(t, successor)
+
+	_, err = Rotate(dir, RotateOptions{Passphrase: passphrase, Successor: successor, SuccessorPassphrase: successorPassphrase})
+	require.NoError(t, err)
+	_, err = Unlock(dir, passphrase)
+	assert.NoError(t, err, "the new key is sealed with the bundle's passphrase")
+}
+
+func TestParseRotation(t *testing.T) {
+	var seed [32]byte
+	oldKey := vanity.ExpandSeed(seed[:])
+	oldPub, err := vanity.PublicKeyFromExpanded(oldKey[:])
+	require.NoError(t, err)
+	newKey := vanity.ExpandSeed([]byte("successor seed, 32 bytes long..."))
+	newPub, err := vanity.PublicKeyFromExpanded(newKey[:])
+	require.NoError(t, err)
+
+	issued := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	r := &Rotation{
+		Old:     vanity.OnionAddress(oldPub) + ".onion",
+		New:     vanity.OnionAddress(newPub) + ".onion",
+		Issued:  issued,
+		Retires: issued.Add(DefaultOverlap),
+	}
+	r.Signature, err = vanity.SignExpanded(oldKey[:], r.message())
+	require.NoError(t, err)
+	data := r.Marshal()
+
+	parsed, err := ParseRotation(data)
+	require.NoError(t, err)
+	assert.Equal(t, r, parsed)
+
+	for name, tampered := range map[string][]byte{
+		"new address": bytes.Replace(data, []byte(r.New), []byte(r.Old), 1),
+		"retirement":  bytes.Replace(data, []byte("2026-11-15"), []byte("2027-11-15"), 1),
+		"unsigned":    data[:bytes.Index(data, []byte("signature"))],
+	} {
+		_, err := ParseRotation(tampered)
+		assert.Error(t, err, name)
+	}
+
+	// Signed by the new key instead of the old one.
+	r.Signature, err = vanity.SignExpanded(newKey[:], r.message())
+	require.NoError(t, err)
+	_, err = ParseRotation(r.Marshal())
+	assert.ErrorContains(t, err, "not signed by")
+}
+
+func TestRunRotateCommands(t *testing.T) {
+	baseDir := t.TempDir()
+	dir := newBundle(t, baseDir, "blog")
+
+	assert.Equal(t, 1, RunKeys(baseDir, []string{"rotate"}), "a bundle name is required")
+	assert.Equal(t, 1, RunKeys(baseDir, []string{"rotate", "--vanity-name", "blog", "--successor", "blog"}))
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"rotate", "--vanity-name", "blog", "--overlap", "1h"}))
+	names, err := List(baseDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"blog"}, names, "the old key is listed with its bundle")
+	assert.DirExists(t, RetiringDir(dir))
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"list"}))
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"inspect", "blog"}))
+	assert.Equal(t, 1, RunKeys(baseDir, []string{"inspect", "blog.retiring"}))
+
+	announcement := filepath.Join(t.TempDir(), "onion-rotation.txt")
+	data, err := os.ReadFile(filepath.Join(dir, RotationFile))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(announcement, data, 0644))
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"rotate", "--verify", announcement}))
+	require.NoError(t, os.WriteFile(announcement, bytes.Replace(data, []byte("issued: 2"), []byte("issued: 3"), 1), 0644))
+	assert.Equal(t, 1, RunKeys(baseDir, []string{"rotate", "--verify", announcement}))
+
+	assert.Equal(t, 0, RunKeys(baseDir, []string{"rotate", "--vanity-name", "blog", "--finish", "--yes"}))
+	assert.Equal(t, 1, RunKeys(baseDir, []string{"rotate", "--vanity-name", "blog", "--finish", "--yes"}))
+	names, err = List(baseDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"blog"}, names)
+}
+
+func TestRunRotateToEncryptedSuccessor(t *testing.T) {
+	baseDir := t.TempDir()
+	newBundle(t, baseDir, "blog")
+	successor := newBundle(t, baseDir, "vanity-result")
+	require.NoError(t, Encrypt(successor, []byte("correct horse")))
+
+	// passphraseFD returns a descriptor to read passphrase from.
+	passphraseFD := func(passphrase string) string {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		_, err = w.WriteString(passphrase + "\n")
+		require.NoError(t, err)
+		w.Close()
+		return strconv.Itoa(int(r.Fd()))
+	}
+	rotate := []string{"rotate", "--vanity-name", "blog", "--successor", "vanity-result", "--successor-passphrase-fd"}
+	assert.Equal(t, 1, RunKeys(baseDir, append(rotate, passphraseFD("wrong"))))
+	assert.Equal(t, 0, RunKeys(baseDir, append(rotate, passphraseFD("correct horse"))))
+	assert.NoDirExists(t, successor)
+}
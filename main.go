@@ -1,7 +1,9 @@
 package main
 
 import (
+	"cheeseburger/config"
 	"cheeseburger/coverage"
+	"cheeseburger/keys"
 	"cheeseburger/service"
 	"cheeseburger/vanity"
 	"flag"
@@ -24,12 +26,17 @@ func main() {
 }
 
 func run() int {
+	configPath, ok := configFlag()
+	if !ok {
+		fmt.Println("Error: --config requires a file")
+		return 1
+	}
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: cheeseburger <command>")
 		return 1
 	}
-
 	cmd := strings.ToLower(os.Args[1])
+	// These work even when the configuration is broken.
 	switch cmd {
 	case "help":
 		printHelp()
@@ -37,28 +44,42 @@ func run() int {
 	case "version":
 		fmt.Printf("cheeseburger version %s\n", cliVersion)
 		return 0
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	switch cmd {
 	case "vanity":
 		// Remove the subcommand so flag parsing in vanity.RunVanity works correctly.
 		os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
-		vanity.RunVanity()
-		return 0
+		return vanity.RunVanity(vanity.Settings{
+			Dir:      cfg.Paths.Vanity,
+			Workers:  cfg.Vanity.Workers,
+			Progress: cfg.Vanity.Progress,
+		})
 	case "serve":
 		if len(os.Args) < 3 {
 			fmt.Println("Error: static directory path required for serve command")
 			return 1
 		}
 		staticDir := os.Args[2]
-		var vanityName string
-		for i := 3; i < len(os.Args); i++ {
-			if os.Args[i] == "--vanity-name" && i+1 < len(os.Args) {
-				vanityName = os.Args[i+1]
-				break
-			}
-		}
-		service.RunStaticTorServer(staticDir, vanityName)
+		service.RunStaticTorServer(cfg, staticDir, os.Args[3:])
 		return 0
 	case "mvc":
-		return service.HandleCommand(os.Args[2:])
+		return service.HandleCommand(cfg, os.Args[2:])
+	case "up":
+		return service.RunUp(cfg, os.Args[2:])
+	case "status":
+		return service.RunStatus(cfg, os.Args[2:])
+	case "keys":
+		return keys.RunKeys(cfg.Paths.Vanity, os.Args[2:])
+	case "clients":
+		return keys.RunClients(cfg.Paths.Vanity, os.Args[2:])
+	case "config":
+		return config.RunConfig(cfg, os.Args[2:])
 	case "coverage":
 		// Create a flag set for the coverage command.
 		coverageFlags := flag.NewFlagSet("coverage", flag.ExitOnError)
@@ -74,7 +95,7 @@ func run() int {
 		if *jsonFlag {
 			remainingArgs = append(remainingArgs, "--json")
 		}
-		coverage.RunCoverage(remainingArgs)
+		coverage.RunCoverage(cfg, remainingArgs)
 		return 0
 	default:
 		fmt.Printf("Unknown command: %s\n\n", os.Args[1])
@@ -83,21 +104,110 @@ func run() int {
 	}
 }
 
+// configFlag removes a leading --config <file> (or --config=<file>) from
+// os.Args and returns the file. ok is false if the file is missing.
+func configFlag() (path string, ok bool) {
+	if len(os.Args) < 2 {
+		return "", true
+	}
+	arg := os.Args[1]
+	switch {
+	case arg == "--config" || arg == "-config":
+		if len(os.Args) < 3 {
+			return "", false
+		}
+		path = os.Args[2]
+		os.Args = append([]string{os.Args[0]}, os.Args[3:]...)
+	case strings.HasPrefix(arg, "--config=") || strings.HasPrefix(arg, "-config="):
+		_, path, _ = strings.Cut(arg, "=")
+		os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+	default:
+		return "", true
+	}
+	return path, path != ""
+}
+
 func printHelp() {
 	helpText := `Usage: cheeseburger <command> [options]
+       cheeseburger --config <file> <command> [options]
+
+Settings are read from cheeseburger.yaml (or --config, or $CHEESEBURGER_CONFIG) and
+CHEESEBURGER_* environment variables; command line flags override both.
 
 Commands:
   help                           Display this help message
   version                        Show version information
-  vanity [options]               Generate a vanity onion address (e.g., vanity --prefix test [--save])
+  vanity [options]               Generate a vanity onion address (e.g., vanity --prefix test [--name myblog] [--save])
+    [--json] [--progress 5s]     Stream progress and matches as JSON lines; set the report interval
+    [--timeout 1h] [--max-attempts N] [--checkpoint file]
+                                 Bound the search (exit code 3 if nothing matched) and resume statistics
+  vanity bench [--workers N]     Measure vanity search speed (keys/sec per worker)
+  vanity split [--name <name>]   Create a split key for delegating a search to an untrusted machine
+  vanity --base <key> --prefix x Search offsets for a split key (prints an offset, never a secret)
+  vanity combine --offset N [--name <name>] [--address <onion>]
+                                 Combine a split key with a found offset into a key bundle
   serve <static_directory>       Run static file server with Tor hidden service
+    [--vanity-name <name>]       Serve a previously generated vanity key
+    [--ephemeral]                Add the service over the control port; no keys on disk for tor
+    [--passphrase-fd N]          Read the passphrase of an encrypted key from fd N
+    [--tor-data-dir <path>]      Persistent tor DataDirectory (default data/tor/<name> for saved keys)
+    [--socks-port N]             Tor SOCKS port (default 9050, 0 disables it)
+    [--control-port N]           Tor control port (default: picked by tor)
+    [--backend unix|tcp]         Reach the HTTP server over a private socket (default) or loopback TCP
+    [--listen-socket <path>]     Unix socket of the HTTP server
+    [--listen-port N]            Loopback port of the HTTP server (default 8080, implies --backend tcp)
+    [--hs-port VIRT:TARGET]      Expose another local service on the onion (repeatable)
+    [--clearnet-addr <addr>]     Also serve on clearnet, advertising the onion with Onion-Location
+    [--clearnet-cert <pem>] [--clearnet-key <pem>]
+                                 Serve the clearnet listener over HTTPS
+    [--cache-control GLOB=VAL]   Cache-Control of the files matching GLOB (repeatable)
+    [--torrc-include <file>]     Append extra torrc directives via %include
+    [--tor-path <tor>]           Run a system tor instead of the embedded binary
+    [--tor-control <addr>]       Attach to a running tor's control port (host:port or unix:/path)
+    [--dos-preset <preset>]      DoS defenses: off (default), moderate or aggressive
+    [--pow] [--intro-dos]        Enable proof-of-work / intro point rate limiting
+    [--intro-dos-rate N] [--intro-dos-burst N]
+    [--pow-queue-rate N] [--pow-queue-burst N]
+    [--max-streams N] [--max-streams-close-circuit]
+                                 Override single settings of the preset
+    [--stats-interval 1m]        Log the service's circuit and stream counts
+    [--admin-socket <path>]      Answer cheeseburger status here (default data/admin.sock)
+  up [--sites sites.yaml]        Serve several static sites and MVC apps through one tor
+                                 (the sites file lists the sites; paths still come from cheeseburger.yaml)
+  status [--json|--prometheus]   Show tor, publication, traffic and database state of the running server
+    [--socket <path>]            Admin socket to ask (default data/admin.sock)
   mvc                           MVC blog commands:
     serve [--vanity-name <name>] Run the blog service (runs as Tor hidden service)
+          [--ephemeral]
     clean                        Clean the database
     init                         Initialize database
     backup                       Backup database
     restore [file]               Restore from backup
     help                         Show MVC help
+  keys                           Manage onion key bundles under data/vanity:
+    list                         List key bundles
+    inspect <name>               Show address, fingerprint and creation info
+    verify <name> [--fix]        Check bundle consistency
+    import <dir|archive> --name <name>
+                                 Import a tor HiddenServiceDir or an exported archive
+    export <name> [-o file]      Write a portable archive
+    delete <name> [--yes]        Securely remove a bundle
+    encrypt|decrypt <name>       Seal or unseal the secret key with a passphrase
+    rotate --vanity-name <name> [--overlap D] [--successor <bundle>]
+                                 Move to a new key; the old onion stays up for the
+                                 overlap (default 720h) with a signed announcement
+           [--successor-passphrase-fd N]
+                                 Read the passphrase of an encrypted successor from fd N
+    rotate --vanity-name <name> --finish [--yes]
+                                 Retire the old onion and delete its key
+    rotate --verify <file>       Check a downloaded rotation announcement
+  clients                        Restrict who can reach a service (v3 client authorization):
+    add <client> [--vanity-name <name>]
+                                 Authorize a client and print its .auth_private line
+    list [--vanity-name <name>]  List authorized clients
+    revoke <client> [--vanity-name <name>]
+                                 Remove a client
+  config print                   Show the effective configuration and where it came from
   coverage [--json]              Automatically run tests to generate a temporary coverage report and display its summary.
 `
 	fmt.Println(helpText)
@@ -115,6 +115,42 @@ func TestMain(t *testing.T) {
 			expectedExit:   1,
 			expectedOutput: "Error: static directory path required for serve command",
 		},
+		{
+			name:           "config print",
+			args:           []string{"cheeseburger", "config", "print"},
+			expectedExit:   0,
+			expectedOutput: "listen_port: 8080",
+		},
+		{
+			name:           "missing config file",
+			args:           []string{"cheeseburger", "--config", "missing.yaml", "config", "print"},
+			expectedExit:   1,
+			expectedOutput: "Error: failed to read config",
+		},
+		{
+			name:           "help with a missing config file",
+			args:           []string{"cheeseburger", "--config", "missing.yaml", "help"},
+			expectedExit:   0,
+			expectedOutput: "Usage: cheeseburger <command> [options]",
+		},
+		{
+			name:           "version with a missing config file",
+			args:           []string{"cheeseburger", "--config", "missing.yaml", "version"},
+			expectedExit:   0,
+			expectedOutput: "cheeseburger version " + CliVersion,
+		},
+		{
+			name:           "status without a server",
+			args:           []string{"cheeseburger", "status", "--socket", "missing.sock"},
+			expectedExit:   1,
+			expectedOutput: "is it serving?",
+		},
+		{
+			name:           "config without file",
+			args:           []string{"cheeseburger", "--config"},
+			expectedExit:   1,
+			expectedOutput: "Error: --config requires a file",
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"cheeseburger/config"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// listenAdmin opens the admin socket at path, readable only by us. A
+// leftover socket from a crashed run is replaced, but one still answering
+// belongs to another cheeseburger and is an error.
+func listenAdmin(path string) (net.Listener, error) {
+	if len(path) > maxSocketPath {
+		return nil, fmt.Errorf("admin socket path %s is too long", path)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another cheeseburger is already serving status on %s", path)
+		}
+		os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create admin socket directory: %v", err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to restrict %s: %v", path, err)
+	}
+	return ln, nil
+}
+
+// adminHandler serves the status as JSON at /status and in the Prometheus
+// text format at /metrics.
+func (s *serveStatus) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(s.report())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	return mux
+}
+
+// serveAdmin serves the status on the admin socket at path until the
+// returned stop is called. The socket is a convenience: if it cannot be
+// opened serving goes on without it.
+func (s *serveStatus) serveAdmin(path string) (stop func()) {
+	ln, err := listenAdmin(path)
+	if err != nil {
+		log.Printf("Status socket disabled: %v", err)
+		return func() {}
+	}
+	srv := &http.Server{Handler: s.adminHandler()}
+	go srv.Serve(ln)
+	log.Printf("Serving status on %s; see cheeseburger status", path)
+	return func() { srv.Close() }
+}
+
+// adminClient returns an HTTP client talking to the admin socket at path.
+func adminClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// RunStatus handles "cheeseburger status": it asks the running serve, mvc
+// serve or up over its admin socket and returns an exit code: 0 if every
+// service is published, 2 while tor is not live, and 1 on errors.
+func RunStatus(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	socket := fs.String("socket", cfg.Paths.AdminSocket, "admin socket of the running cheeseburger")
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	prometheus := fs.Bool("prometheus", false, "print metrics in the Prometheus text format")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() != 0 || (*asJSON && *prometheus) {
+		fmt.Println("Error: usage: cheeseburger status [--socket <path>] [--json | --prometheus]")
+		return 1
+	}
+	if *socket == "" {
+		fmt.Println("Error: no admin socket configured (paths.admin_socket)")
+		return 1
+	}
+
+	client := adminClient(*socket)
+	if *prometheus {
+		body, err := adminGet(client, "/metrics")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		os.Stdout.Write(body)
+		return 0
+	}
+	body, err := adminGet(client, "/status")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	var rep statusReport
+	if err := json.Unmarshal(body, &rep); err != nil {
+		fmt.Printf("Error: malformed status: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		os.Stdout.Write(body)
+	} else {
+		printStatus(os.Stdout, rep)
+	}
+	if rep.Tor.State != torLive {
+		return 2
+	}
+	return 0
+}
+
+// adminGet fetches path from the admin socket.
+func adminGet(client *http.Client, path string) ([]byte, error) {
+	resp, err := client.Get("http://cheeseburger" + path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach cheeseburger; is it serving? (%v)", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status request failed: %s", resp.Status)
+	}
+	return body, nil
+}
+
+// printStatus writes rep for people.
+func printStatus(w io.Writer, rep statusReport) {
+	fmt.Fprintf(w, "cheeseburger (pid %d) serving since %s (%s)\n",
+		rep.PID, rep.Started.Format(time.DateTime), rep.Generated.Sub(rep.Started).Round(time.Second))
+	tor := "Tor:      " + rep.Tor.State
+	if rep.Tor.Bootstrap >= 0 {
+		tor += fmt.Sprintf(", bootstrapped %d%%", rep.Tor.Bootstrap)
+		if rep.Tor.Summary != "" {
+			tor += " (" + rep.Tor.Summary + ")"
+		}
+	}
+	fmt.Fprintf(w, "%s, started %d time(s)\n", tor, rep.Tor.Starts)
+	if rep.Tor.LastError != "" {
+		fmt.Fprintf(w, "          last error: %s\n", rep.Tor.LastError)
+	}
+	for _, sr := range rep.Services {
+		hostname := sr.Hostname
+		if hostname == "" {
+			hostname = "(not yet published)"
+		}
+		fmt.Fprintf(w, "\n%s: %s\n", sr.Name, hostname)
+		fmt.Fprintf(w, "  backend:     %s (%s)\n", sr.Backend, sr.Mode)
+		if sr.Published != nil {
+			fmt.Fprintf(w, "  published:   %s, %d descriptor upload(s), last %s\n",
+				sr.Published.Format(time.DateTime), sr.DescriptorUploads, sr.LastUpload.Format(time.DateTime))
+		} else {
+			fmt.Fprintf(w, "  published:   no\n")
+		}
+		if sr.RetiresAt != nil {
+			fmt.Fprintf(w, "  retiring:    %s until %s\n", sr.Retiring, sr.RetiresAt.Format(time.DateTime))
+		}
+		if c := sr.Circuits; c != nil {
+			fmt.Fprintf(w, "  circuits:    %d introduction, %d clients, %d streams\n", c.IntroCircuits, c.RendCircuits, c.Streams)
+		}
+		var codes []string
+		for c := 1; c <= 5; c++ {
+			code := fmt.Sprintf("%dxx", c)
+			if n := sr.Requests.Codes[code]; n > 0 {
+				codes = append(codes, fmt.Sprintf("%s %d", code, n))
+			}
+		}
+		requests := fmt.Sprintf("%d", sr.Requests.Total)
+		if len(codes) > 0 {
+			requests += " (" + strings.Join(codes, ", ") + ")"
+		}
+		fmt.Fprintf(w, "  requests:    %s\n", requests)
+		if sr.Requests.Total > 0 {
+			fmt.Fprintf(w, "  latency:     p50 %s, p90 %s, p99 %s\n",
+				seconds(sr.Requests.P50), seconds(sr.Requests.P90), seconds(sr.Requests.P99))
+		}
+		if db := sr.DB; db != nil {
+			fmt.Fprintf(w, "  database:    %s, %s (LSM %s, value log %s)\n",
+				db.Path, bytesSize(db.LSMBytes+db.VLogBytes), bytesSize(db.LSMBytes), bytesSize(db.VLogBytes))
+		}
+	}
+}
+
+// seconds formats a latency given in seconds.
+func seconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(10 * time.Microsecond).String()
+}
+
+// bytesSize formats n bytes with a binary unit.
+func bytesSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -2,43 +2,38 @@ package service
 
 import (
 	"cheeseburger/app/routes"
+	"cheeseburger/config"
 	"log"
-	"net/http"
 
 	"github.com/dgraph-io/badger/v4"
 )
 
 // RunAppServer starts the MVC blog service
-func RunAppServer(args []string) {
-	// Extract vanity name if provided
-	var vanityName string
-	for i := 0; i < len(args); i++ {
-		if args[i] == "--vanity-name" && i+1 < len(args) {
-			vanityName = args[i+1]
-			// Remove the flag and value from args
-			args = append(args[:i], args[i+2:]...)
-			break
-		}
+func RunAppServer(cfg *config.Config, args []string) {
+	opts, err := parseServeFlags(cfg, "mvc serve", args)
+	if err != nil {
+		log.Fatalf("Invalid serve options: %v", err)
 	}
 
 	// Set up the database and router
-	opts := badger.DefaultOptions(dbPath)
-	db, err := badger.Open(opts)
+	dbOpts := badger.DefaultOptions(cfg.Paths.DB)
+	db, err := badger.Open(dbOpts)
 	if err != nil {
 		log.Fatalf("Failed to open Badger DB: %v", err)
 	}
 	defer db.Close()
 
-	router := routes.SetupMVCRoutes(db)
+	// The blog's outgoing requests go through the tor it is served with.
+	client, err := NewTorHTTPClient("")
+	if err != nil {
+		log.Fatalf("Failed to create the tor HTTP client: %v", err)
+	}
+	router := routes.SetupMVCRoutesWithClient(db, client)
 	if router == nil {
 		log.Fatal("Failed to setup MVC routes")
 	}
 
 	// Start the server with Tor
-	log.Println("Starting MVC blog service on port 8080")
-	runTorHiddenService(vanityName, func() {
-		if err := http.ListenAndServe(":8080", router); err != nil {
-			log.Fatalf("MVC server error: %v", err)
-		}
-	})
+	log.Println("Starting MVC blog service")
+	runTorHiddenService(site{opts: opts, handler: router, dbPath: cfg.Paths.DB, db: db})
 }
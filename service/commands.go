@@ -1,6 +1,7 @@
 package service
 
 import (
+	"cheeseburger/config"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,7 +13,7 @@ import (
 var osExit = os.Exit
 
 // HandleCommand handles MVC subcommands and returns an exit code.
-func HandleCommand(args []string) int {
+func HandleCommand(cfg *config.Config, args []string) int {
 	if len(args) < 1 {
 		printMvcHelp()
 		osExit(1)
@@ -22,16 +23,16 @@ func HandleCommand(args []string) int {
 	cmd := args[0]
 	switch cmd {
 	case "serve":
-		RunAppServer(args[1:])
+		RunAppServer(cfg, args[1:])
 		return 0
 	case "clean":
-		clean()
+		clean(cfg.Paths.DB)
 		return 0
 	case "init":
-		initDb()
+		initDb(cfg.Paths.DB)
 		return 0
 	case "backup":
-		backup()
+		backup(cfg.Paths.DB, cfg.Paths.Backups)
 		return 0
 	case "restore":
 		if len(args) < 2 {
@@ -39,7 +40,7 @@ func HandleCommand(args []string) int {
 			osExit(1)
 			return 1
 		}
-		return restore(args[1])
+		return restore(cfg.Paths.DB, args[1])
 	case "help":
 		printMvcHelp()
 		return 0
@@ -57,6 +58,29 @@ func printMvcHelp() {
 
 Commands:
   serve [--vanity-name <name>]    Run the blog service (always runs as Tor hidden service)
+        [--ephemeral]             Add the onion service with ADD_ONION; removed on exit
+        [--passphrase-fd N]       Read the passphrase of an encrypted key from fd N
+        [--tor-data-dir <path>]   Persistent tor DataDirectory (default data/tor/<name>)
+        [--socks-port N]          Tor SOCKS port (default 9050, 0 disables it)
+        [--control-port N]        Tor control port (default: picked by tor)
+        [--backend unix|tcp]      Private socket (default) or loopback TCP to the HTTP server
+        [--listen-socket <path>]  Unix socket of the HTTP server
+        [--listen-port N]         Loopback port of the HTTP server (implies --backend tcp)
+        [--hs-port VIRT:TARGET]   Expose another local service on the onion (repeatable)
+        [--clearnet-addr <addr>]  Also serve on clearnet with an Onion-Location header
+        [--clearnet-cert <pem>] [--clearnet-key <pem>]
+                                  Serve the clearnet listener over HTTPS
+        [--torrc-include <file>]  Append extra torrc directives via %include
+        [--tor-path <tor>]        Run a system tor instead of the embedded binary
+        [--tor-control <addr>]    Attach to a running tor's control port
+        [--dos-preset <preset>]   DoS defenses: off (default), moderate or aggressive
+        [--pow] [--intro-dos]     Enable proof-of-work / intro point rate limiting
+        [--intro-dos-rate N] [--intro-dos-burst N]
+        [--pow-queue-rate N] [--pow-queue-burst N]
+        [--max-streams N] [--max-streams-close-circuit]
+                                  Override single settings of the preset
+        [--stats-interval 1m]     Log the service's circuit and stream counts
+        [--admin-socket <path>]   Answer cheeseburger status here (default data/admin.sock)
   clean                           Clean the blog database
   init                            Initialize a new empty database
   backup                          Create a backup of the database
@@ -66,8 +90,8 @@ Commands:
 	fmt.Println(helpText)
 }
 
-// clean removes the database.
-func clean() {
+// clean removes the database at dbPath.
+func clean(dbPath string) {
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
 		fmt.Println("Database is already clean (does not exist)")
 		return
@@ -88,8 +112,8 @@ func clean() {
 	fmt.Println("Database cleaned successfully")
 }
 
-// initDb initializes a new empty database.
-func initDb() {
+// initDb initializes a new empty database at dbPath.
+func initDb(dbPath string) {
 	if _, err := os.Stat(dbPath); err == nil {
 		fmt.Println("Database already exists. Use 'clean' first if you want to reinitialize.")
 		return
@@ -111,14 +135,13 @@ func initDb() {
 	fmt.Println("Database initialized successfully")
 }
 
-// backup creates a backup of the database.
-func backup() {
+// backup creates a backup of the database at dbPath in backupDir.
+func backup(dbPath, backupDir string) {
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
 		fmt.Println("No database exists to backup")
 		return
 	}
 
-	backupDir := "data/backups"
 	if err := os.MkdirAll(backupDir, 0755); err != nil {
 		fmt.Printf("Failed to create backup directory: %v\n", err)
 		return
@@ -148,8 +171,8 @@ func backup() {
 	fmt.Printf("Database backed up successfully to %s\n", backupFile)
 }
 
-// restore restores the database from a backup.
-func restore(backupFile string) int {
+// restore restores the database at dbPath from a backup.
+func restore(dbPath, backupFile string) int {
 	if _, err := os.Stat(backupFile); os.IsNotExist(err) {
 		fmt.Printf("Backup file does not exist: %s\n", backupFile)
 		return 1
@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"cheeseburger/config"
 	"io"
 	"os"
 	"path/filepath"
@@ -10,14 +11,6 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-// testDbPath is used to override the default database path during tests
-var testDbPath string
-
-func init() {
-	// Save original database path
-	testDbPath = dbPath
-}
-
 func captureOutput(f func()) string {
 	oldStdout := os.Stdout
 	r, w, _ := os.Pipe()
@@ -53,16 +46,24 @@ func mockStdin(input string, f func()) {
 	os.Stdin = oldStdin
 }
 
+// dbPath and backupDir are the locations the command tests run against.
+var dbPath, backupDir string
+
 func setupTestDB(t *testing.T) string {
 	// Create temporary directory for test database
 	tmpDir := t.TempDir()
 	dbPath = filepath.Join(tmpDir, "test.db")
-	t.Cleanup(func() {
-		dbPath = testDbPath // Restore original path
-	})
+	backupDir = filepath.Join(tmpDir, "backups")
 	return tmpDir
 }
 
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.Paths.DB = dbPath
+	cfg.Paths.Backups = backupDir
+	return cfg
+}
+
 func TestHandleCommand(t *testing.T) {
 	setupTestDB(t)
 
@@ -116,7 +117,7 @@ func TestHandleCommand(t *testing.T) {
 						}
 					}
 				}()
-				HandleCommand(tt.args)
+				HandleCommand(testConfig(), tt.args)
 			})
 
 			assert.Contains(t, output, tt.expectedOutput)
@@ -132,7 +133,7 @@ func TestInitDb(t *testing.T) {
 
 	t.Run("initialize new database", func(t *testing.T) {
 		output := captureOutput(func() {
-			initDb()
+			initDb(dbPath)
 		})
 
 		assert.Contains(t, output, "Database initialized successfully")
@@ -141,7 +142,7 @@ func TestInitDb(t *testing.T) {
 
 	t.Run("initialize existing database", func(t *testing.T) {
 		output := captureOutput(func() {
-			initDb()
+			initDb(dbPath)
 		})
 
 		assert.Contains(t, output, "Database already exists")
@@ -153,7 +154,7 @@ func TestClean(t *testing.T) {
 
 	t.Run("clean non-existent database", func(t *testing.T) {
 		output := captureOutput(func() {
-			clean()
+			clean(dbPath)
 		})
 
 		assert.Contains(t, output, "Database is already clean")
@@ -161,14 +162,14 @@ func TestClean(t *testing.T) {
 
 	t.Run("clean existing database - confirmed", func(t *testing.T) {
 		// Create test database first
-		initDb()
+		initDb(dbPath)
 		assert.DirExists(t, dbPath)
 
 		var output string
 		// Mock user input "y" for confirmation
 		mockStdin("y\n", func() {
 			output = captureOutput(func() {
-				clean()
+				clean(dbPath)
 			})
 		})
 
@@ -178,14 +179,14 @@ func TestClean(t *testing.T) {
 
 	t.Run("clean existing database - cancelled", func(t *testing.T) {
 		// Create test database first
-		initDb()
+		initDb(dbPath)
 		assert.DirExists(t, dbPath)
 
 		var output string
 		// Mock user input "n" for confirmation
 		mockStdin("n\n", func() {
 			output = captureOutput(func() {
-				clean()
+				clean(dbPath)
 			})
 		})
 
@@ -199,7 +200,7 @@ func TestBackup(t *testing.T) {
 
 	t.Run("backup non-existent database", func(t *testing.T) {
 		output := captureOutput(func() {
-			backup()
+			backup(dbPath, backupDir)
 		})
 
 		assert.Contains(t, output, "No database exists to backup")
@@ -207,15 +208,15 @@ func TestBackup(t *testing.T) {
 
 	t.Run("backup existing database", func(t *testing.T) {
 		// Create and initialize test database
-		initDb()
+		initDb(dbPath)
 		assert.DirExists(t, dbPath)
 
 		output := captureOutput(func() {
-			backup()
+			backup(dbPath, backupDir)
 		})
 
 		assert.Contains(t, output, "Database backed up successfully")
-		assert.DirExists(t, "data/backups")
+		assert.DirExists(t, backupDir)
 	})
 }
 
@@ -224,7 +225,7 @@ func TestRestore(t *testing.T) {
 
 	t.Run("restore non-existent backup", func(t *testing.T) {
 		output := captureOutput(func() {
-			restore("nonexistent.db")
+			restore(dbPath, "nonexistent.db")
 		})
 
 		assert.Contains(t, output, "Backup file does not exist")
@@ -237,7 +238,7 @@ func TestRestore(t *testing.T) {
 		assert.NoError(t, err)
 
 		output := captureOutput(func() {
-			restore(backupFile)
+			restore(dbPath, backupFile)
 		})
 
 		assert.Contains(t, output, "Database restored successfully")
@@ -245,7 +246,7 @@ func TestRestore(t *testing.T) {
 
 	t.Run("restore with existing database - confirmed", func(t *testing.T) {
 		// Create test database and backup
-		initDb()
+		initDb(dbPath)
 		backupFile := filepath.Join(tmpDir, "test_backup.db")
 		err := os.WriteFile(backupFile, []byte("test backup data"), 0644)
 		assert.NoError(t, err)
@@ -254,7 +255,7 @@ func TestRestore(t *testing.T) {
 		// Mock user input "y" for confirmation
 		mockStdin("y\n", func() {
 			output = captureOutput(func() {
-				restore(backupFile)
+				restore(dbPath, backupFile)
 			})
 		})
 
@@ -263,7 +264,7 @@ func TestRestore(t *testing.T) {
 
 	t.Run("restore with existing database - cancelled", func(t *testing.T) {
 		// Create test database and backup
-		initDb()
+		initDb(dbPath)
 		backupFile := filepath.Join(tmpDir, "test_backup.db")
 		err := os.WriteFile(backupFile, []byte("test backup data"), 0644)
 		assert.NoError(t, err)
@@ -272,7 +273,7 @@ func TestRestore(t *testing.T) {
 		// Mock user input "n" for confirmation
 		mockStdin("n\n", func() {
 			output = captureOutput(func() {
-				restore(backupFile)
+				restore(dbPath, backupFile)
 			})
 		})
 
@@ -5,9 +5,6 @@ import (
 	"os"
 )
 
-// Database path - variable to allow testing with different paths
-var dbPath = "data/badger"
-
 func getCurrentDirectory() string {
 	dir, err := os.Getwd()
 	if err != nil {
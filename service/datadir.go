@@ -0,0 +1,53 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// dataDirLockFile is the lock file cheeseburger holds inside a persistent
+// DataDirectory while tor uses it.
+const dataDirLockFile = "cheeseburger.lock"
+
+// torDataDir picks tor's DataDirectory. An explicit --tor-data-dir always
+// wins; services with a persistent key get <TorDataBase>/<name>, by default
+// data/tor/<name>, so tor keeps its consensus and guards across restarts.
+// Throwaway services return "" and use a temporary directory.
+func torDataDir(opts serveOptions, persistentKey bool) (string, error) {
+	dir := opts.TorDataDir
+	if dir == "" && persistentKey {
+		name := opts.VanityName
+		if name == "" {
+			name = "default"
+		}
+		dir = filepath.Join(opts.TorDataBase, name)
+	}
+	if dir == "" {
+		return "", nil
+	}
+	return filepath.Abs(dir)
+}
+
+// prepareDataDir creates dir if needed and makes it private to the current
+// user, as tor requires.
+func prepareDataDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create tor data directory: %v", err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("tor data directory %s is not a directory", dir)
+	}
+	if info.Mode().Perm() != 0700 {
+		log.Printf("Restricting permissions of %s from %04o to 0700", dir, info.Mode().Perm())
+		if err := os.Chmod(dir, 0700); err != nil {
+			return fmt.Errorf("failed to set permissions on tor data directory: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTorDataDir(t *testing.T) {
+	dir, err := torDataDir(serveOptions{}, false)
+	assert.NoError(t, err)
+	assert.Empty(t, dir, "throwaway services use a temporary directory")
+
+	base := filepath.Join("data", "tor")
+	dir, err = torDataDir(serveOptions{VanityName: "myblog", TorDataBase: base}, true)
+	assert.NoError(t, err)
+	assert.True(t, filepath.IsAbs(dir))
+	assert.True(t, strings.HasSuffix(dir, filepath.Join("data", "tor", "myblog")), dir)
+
+	dir, err = torDataDir(serveOptions{TorDataBase: base}, true)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(dir, filepath.Join("data", "tor", "default")), dir)
+
+	dir, err = torDataDir(serveOptions{TorDataBase: "/srv/tor"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("/srv/tor", "default"), dir)
+
+	custom := t.TempDir()
+	dir, err = torDataDir(serveOptions{TorDataDir: custom}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, custom, dir)
+}
+
+func TestPrepareDataDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tor", "blog")
+	require.NoError(t, prepareDataDir(dir))
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	require.NoError(t, os.Chmod(dir, 0755))
+	require.NoError(t, prepareDataDir(dir))
+	info, err = os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	assert.Error(t, prepareDataDir(file))
+}
+
+func TestLockDataDir(t *testing.T) {
+	dir := t.TempDir()
+	unlock, err := lockDataDir(dir)
+	require.NoError(t, err)
+
+	pid, err := os.ReadFile(filepath.Join(dir, dataDirLockFile))
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), strings.TrimSpace(string(pid)))
+
+	_, err = lockDataDir(dir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "in use by another cheeseburger")
+
+	unlock()
+	unlock, err = lockDataDir(dir)
+	require.NoError(t, err)
+	unlock()
+}
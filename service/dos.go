@@ -0,0 +1,206 @@
+package service
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dosConfig holds tor's denial of service defenses for the onion service.
+// Zero values leave tor's defaults in place.
+type dosConfig struct {
+	// PoW enables the proof-of-work defense (HiddenServicePoWDefensesEnabled);
+	// PoWQueueRate and PoWQueueBurst bound how fast queued requests are
+	// served.
+	PoW           bool
+	PoWQueueRate  int
+	PoWQueueBurst int
+	// IntroDoS makes introduction points rate limit INTRODUCE2 cells
+	// (HiddenServiceEnableIntroDoSDefense) at IntroRate per second with
+	// bursts of IntroBurst.
+	IntroDoS   bool
+	IntroRate  int
+	IntroBurst int
+	// MaxStreams limits streams per rendezvous circuit; with
+	// MaxStreamsCloseCircuit a circuit exceeding it is closed instead of
+	// only having the stream refused.
+	MaxStreams             int
+	MaxStreamsCloseCircuit bool
+}
+
+// dosPresets are the named starting points of --dos-preset.
+var dosPresets = map[string]dosConfig{
+	"off": {},
+	// moderate turns on the defenses with tor's default rates, which cost
+	// ordinary visitors nothing until the service is under attack. Like
+	// tor, it leaves the streams per circuit unlimited.
+	"moderate": {
+		PoW:        true,
+		IntroDoS:   true,
+		IntroRate:  25,
+		IntroBurst: 200,
+	},
+	// aggressive trades some latency for visitors under load for much
+	// tighter limits, and drops circuits that open too many streams.
+	"aggressive": {
+		PoW:                    true,
+		PoWQueueRate:           100,
+		PoWQueueBurst:          500,
+		IntroDoS:               true,
+		IntroRate:              10,
+		IntroBurst:             50,
+		MaxStreams:             16,
+		MaxStreamsCloseCircuit: true,
+	},
+}
+
+// dosPresetNames returns the preset names for help and error messages.
+func dosPresetNames() string {
+	var names []string
+	for name := range dosPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// dosFlags holds the raw DoS flags. After parsing, apply combines the
+// chosen preset with the flags that were set explicitly.
+type dosFlags struct {
+	preset                 string
+	pow                    bool
+	powQueueRate           int
+	powQueueBurst          int
+	introDoS               bool
+	introRate              int
+	introBurst             int
+	maxStreams             int
+	maxStreamsCloseCircuit bool
+}
+
+// register adds the flags to fs. A preset already set in f becomes the
+// default of --dos-preset.
+func (f *dosFlags) register(fs *flag.FlagSet) {
+	preset := f.preset
+	if preset == "" {
+		preset = "off"
+	}
+	fs.StringVar(&f.preset, "dos-preset", preset, "DoS defense preset: "+dosPresetNames())
+	fs.BoolVar(&f.pow, "pow", false, "enable the proof-of-work defense")
+	fs.IntVar(&f.powQueueRate, "pow-queue-rate", 0, "rendezvous requests served per second from the PoW queue")
+	fs.IntVar(&f.powQueueBurst, "pow-queue-burst", 0, "burst of rendezvous requests served from the PoW queue")
+	fs.BoolVar(&f.introDoS, "intro-dos", false, "rate limit introductions at the introduction points")
+	fs.IntVar(&f.introRate, "intro-dos-rate", 0, "introductions per second allowed by each introduction point")
+	fs.IntVar(&f.introBurst, "intro-dos-burst", 0, "burst of introductions allowed by each introduction point")
+	fs.IntVar(&f.maxStreams, "max-streams", 0, "maximum streams per rendezvous circuit (0 = unlimited)")
+	fs.BoolVar(&f.maxStreamsCloseCircuit, "max-streams-close-circuit", false, "close circuits that exceed --max-streams")
+}
+
+// apply returns the preset with every explicitly set flag applied on top.
+func (f *dosFlags) apply(fs *flag.FlagSet) (dosConfig, error) {
+	c, ok := dosPresets[f.preset]
+	if !ok {
+		return dosConfig{}, fmt.Errorf("unknown --dos-preset %q (choose from %s)", f.preset, dosPresetNames())
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "pow":
+			c.PoW = f.pow
+		case "pow-queue-rate":
+			c.PoW, c.PoWQueueRate = true, f.powQueueRate
+		case "pow-queue-burst":
+			c.PoW, c.PoWQueueBurst = true, f.powQueueBurst
+		case "intro-dos":
+			c.IntroDoS = f.introDoS
+		case "intro-dos-rate":
+			c.IntroDoS, c.IntroRate = true, f.introRate
+		case "intro-dos-burst":
+			c.IntroDoS, c.IntroBurst = true, f.introBurst
+		case "max-streams":
+			c.MaxStreams = f.maxStreams
+		case "max-streams-close-circuit":
+			c.MaxStreamsCloseCircuit = f.maxStreamsCloseCircuit
+		}
+	})
+	return c, c.validate()
+}
+
+// validate checks the limits against the ranges tor accepts.
+func (c dosConfig) validate() error {
+	for name, v := range map[string]int{
+		"--pow-queue-rate": c.PoWQueueRate, "--pow-queue-burst": c.PoWQueueBurst,
+		"--intro-dos-rate": c.IntroRate, "--intro-dos-burst": c.IntroBurst,
+	} {
+		if v < 0 || v > 0x7fffffff {
+			return fmt.Errorf("%s must be between 0 and %d", name, 0x7fffffff)
+		}
+	}
+	if c.IntroRate > 0 && c.IntroBurst > 0 && c.IntroBurst < c.IntroRate {
+		return fmt.Errorf("--intro-dos-burst (%d) must not be lower than --intro-dos-rate (%d)", c.IntroBurst, c.IntroRate)
+	}
+	if c.PoWQueueRate > 0 && c.PoWQueueBurst > 0 && c.PoWQueueBurst < c.PoWQueueRate {
+		return fmt.Errorf("--pow-queue-burst (%d) must not be lower than --pow-queue-rate (%d)", c.PoWQueueBurst, c.PoWQueueRate)
+	}
+	if c.MaxStreams < 0 || c.MaxStreams > 65535 {
+		return fmt.Errorf("--max-streams must be between 0 and 65535")
+	}
+	return nil
+}
+
+// torrcLines returns the per-service torrc options, to follow the
+// HiddenServiceDir they apply to.
+func (c dosConfig) torrcLines() []string {
+	var lines []string
+	if c.PoW {
+		lines = append(lines, "HiddenServicePoWDefensesEnabled 1")
+		if c.PoWQueueRate > 0 {
+			lines = append(lines, "HiddenServicePoWQueueRate "+strconv.Itoa(c.PoWQueueRate))
+		}
+		if c.PoWQueueBurst > 0 {
+			lines = append(lines, "HiddenServicePoWQueueBurst "+strconv.Itoa(c.PoWQueueBurst))
+		}
+	}
+	if c.IntroDoS {
+		lines = append(lines, "HiddenServiceEnableIntroDoSDefense 1")
+		if c.IntroRate > 0 {
+			lines = append(lines, "HiddenServiceEnableIntroDoSRatePerSec "+strconv.Itoa(c.IntroRate))
+		}
+		if c.IntroBurst > 0 {
+			lines = append(lines, "HiddenServiceEnableIntroDoSBurstPerSec "+strconv.Itoa(c.IntroBurst))
+		}
+	}
+	if c.MaxStreams > 0 {
+		lines = append(lines, "HiddenServiceMaxStreams "+strconv.Itoa(c.MaxStreams))
+		if c.MaxStreamsCloseCircuit {
+			lines = append(lines, "HiddenServiceMaxStreamsCloseCircuit 1")
+		}
+	}
+	return lines
+}
+
+// onionOptions returns the ADD_ONION flags and parameters for the defenses
+// ADD_ONION supports. The introduction point defense can only be set in a
+// torrc, so for ephemeral services it is reported as unsupported.
+func (c dosConfig) onionOptions() (opts onionOptions, unsupported []string) {
+	if c.PoW {
+		opts.Flags = append(opts.Flags, "PoWDefensesEnabled")
+		if c.PoWQueueRate > 0 {
+			opts.Params = append(opts.Params, "PoWQueueRate="+strconv.Itoa(c.PoWQueueRate))
+		}
+		if c.PoWQueueBurst > 0 {
+			opts.Params = append(opts.Params, "PoWQueueBurst="+strconv.Itoa(c.PoWQueueBurst))
+		}
+	}
+	if c.IntroDoS {
+		unsupported = append(unsupported, "introduction point rate limits")
+	}
+	if c.MaxStreams > 0 {
+		opts.Params = append(opts.Params, "MaxStreams="+strconv.Itoa(c.MaxStreams))
+		if c.MaxStreamsCloseCircuit {
+			opts.Flags = append(opts.Flags, "MaxStreamsCloseCircuit")
+		}
+	}
+	return opts, unsupported
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"cheeseburger/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoSPresetsAndOverrides(t *testing.T) {
+	opts, err := parseServeFlags(config.Default(), "serve", []string{"--dos-preset", "moderate"})
+	require.NoError(t, err)
+	assert.Equal(t, dosPresets["moderate"], opts.DoS)
+
+	opts, err = parseServeFlags(config.Default(), "serve", []string{
+		"--dos-preset", "aggressive", "--pow=false", "--intro-dos-rate", "5", "--max-streams", "4",
+	})
+	require.NoError(t, err)
+	want := dosPresets["aggressive"]
+	want.PoW = false
+	want.IntroRate = 5
+	want.MaxStreams = 4
+	assert.Equal(t, want, opts.DoS)
+
+	// Setting a rate enables the defense it belongs to.
+	opts, err = parseServeFlags(config.Default(), "serve", []string{"--intro-dos-burst", "100", "--pow-queue-rate", "50"})
+	require.NoError(t, err)
+	assert.Equal(t, dosConfig{IntroDoS: true, IntroBurst: 100, PoW: true, PoWQueueRate: 50}, opts.DoS)
+
+	for _, args := range [][]string{
+		{"--dos-preset", "paranoid"},
+		{"--intro-dos-rate", "100", "--intro-dos-burst", "10"},
+		{"--pow-queue-rate", "-1"},
+		{"--max-streams", "70000"},
+		{"--stats-interval", "-1s"},
+	} {
+		_, err := parseServeFlags(config.Default(), "serve", args)
+		assert.Error(t, err, "%v", args)
+	}
+}
+
+func TestDoSTorrcLines(t *testing.T) {
+	assert.Empty(t, dosPresets["off"].torrcLines())
+	assert.Equal(t, []string{
+		"HiddenServicePoWDefensesEnabled 1",
+		"HiddenServicePoWQueueRate 100",
+		"HiddenServicePoWQueueBurst 500",
+		"HiddenServiceEnableIntroDoSDefense 1",
+		"HiddenServiceEnableIntroDoSRatePerSec 10",
+		"HiddenServiceEnableIntroDoSBurstPerSec 50",
+		"HiddenServiceMaxStreams 16",
+		"HiddenServiceMaxStreamsCloseCircuit 1",
+	}, dosPresets["aggressive"].torrcLines())
+
+	c := torrcConfig{
+		DataDirectory: "/tmp/data",
+		HiddenServices: []hiddenServiceConfig{{
+			Dir:   "/tmp/hs",
+			Ports: []portMapping{{VirtPort: 80, Target: "127.0.0.1:8080"}},
+			DoS:   dosConfig{MaxStreams: 8},
+		}},
+	}
+	assert.Contains(t, c.String(), "HiddenServicePort 80 127.0.0.1:8080\n# DoS defenses\nHiddenServiceMaxStreams 8\n")
+}
+
+func TestDoSOnionOptions(t *testing.T) {
+	opts, unsupported := dosPresets["aggressive"].onionOptions()
+	assert.Equal(t, []string{"PoWDefensesEnabled", "MaxStreamsCloseCircuit"}, opts.Flags)
+	assert.Equal(t, []string{"PoWQueueRate=100", "PoWQueueBurst=500", "MaxStreams=16"}, opts.Params)
+	assert.Equal(t, []string{"introduction point rate limits"}, unsupported)
+
+	opts, unsupported = dosPresets["off"].onionOptions()
+	assert.Equal(t, onionOptions{}, opts)
+	assert.Empty(t, unsupported)
+}
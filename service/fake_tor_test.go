@@ -0,0 +1,631 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"cheeseburger/vanity"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTor is an in-process stand-in for tor, launched instead of the real
+// binary through torLauncher. Like tor it reads the torrc, writes the
+// control port, cookie and hostname files, answers the control commands
+// cheeseburger sends, reports bootstrap progress and descriptor uploads,
+// and forwards connections to an onion address to the service's backend,
+// whether made through f.dial or its SOCKS port, so that whole serve flows
+// run without a network.
+type fakeTor struct {
+	// bootstrap is the progress reported by successive bootstrap polls of
+	// each run; the last value repeats.
+	bootstrap []int
+
+	mu       sync.Mutex
+	runs     []*fakeTorRun
+	services map[string][]portMapping
+	uploads  []string
+	commands []string
+	// socks records the connections made through the SOCKS port.
+	socks []fakeSocksConnect
+}
+
+// fakeSocksConnect is one SOCKS CONNECT a fakeTor received.
+type fakeSocksConnect struct {
+	user, password, dest string
+}
+
+// fakeTorRun is one launch of a fakeTor.
+type fakeTorRun struct {
+	tor         *fakeTor
+	cookie      []byte
+	cookieFile  string
+	control     net.Listener
+	socks       net.Listener
+	dirServices []string
+	proc        *torProcess
+	polls       int
+	conns       map[net.Conn]bool
+	closed      bool
+	wg          sync.WaitGroup
+	once        sync.Once
+}
+
+// fakeTorrc is what a fakeTor understands of a torrc.
+type fakeTorrc struct {
+	controlPortFile string
+	cookieFile      string
+	socks           bool
+	hiddenServices  []hiddenServiceConfig
+}
+
+func newFakeTor() *fakeTor {
+	return &fakeTor{bootstrap: []int{100}, services: make(map[string][]portMapping)}
+}
+
+// parseFakeTorrc reads the directives of the torrc at path that a fakeTor
+// acts on, ignoring the others.
+func parseFakeTorrc(path string) (*fakeTorrc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &fakeTorrc{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "ControlPortWriteToFile":
+			c.controlPortFile = fields[1]
+		case "CookieAuthFile":
+			c.cookieFile = fields[1]
+		case "SocksPort":
+			// The SOCKS port always goes to a free port, as tests run
+			// side by side.
+			c.socks = fields[1] != "0"
+		case "HiddenServiceDir":
+			c.hiddenServices = append(c.hiddenServices, hiddenServiceConfig{Dir: fields[1]})
+		case "HiddenServicePort":
+			if len(c.hiddenServices) == 0 || len(fields) != 3 {
+				return nil, fmt.Errorf("misplaced %q", line)
+			}
+			port, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad %q", line)
+			}
+			hs := &c.hiddenServices[len(c.hiddenServices)-1]
+			hs.Ports = append(hs.Ports, portMapping{VirtPort: port, Target: fields[2]})
+		}
+	}
+	if c.controlPortFile == "" || c.cookieFile == "" {
+		return nil, fmt.Errorf("torrc lacks ControlPortWriteToFile or CookieAuthFile")
+	}
+	return c, nil
+}
+
+func (f *fakeTor) verify(torrc string) error {
+	_, err := parseFakeTorrc(torrc)
+	return err
+}
+
+func (f *fakeTor) launch(torrc string) (*torProcess, error) {
+	c, err := parseFakeTorrc(torrc)
+	if err != nil {
+		return nil, err
+	}
+	r := &fakeTorRun{
+		tor:        f,
+		cookie:     make([]byte, 32),
+		cookieFile: c.cookieFile,
+		conns:      make(map[net.Conn]bool),
+		proc:       &torProcess{exited: make(chan struct{})},
+	}
+	r.proc.signal = func(sig os.Signal) error {
+		if sig == os.Kill {
+			r.exit(errors.New("signal: killed"))
+		} else {
+			r.exit(nil)
+		}
+		return nil
+	}
+	for _, hs := range c.hiddenServices {
+		id, err := fakeHiddenServiceDir(hs.Dir)
+		if err != nil {
+			return nil, err
+		}
+		r.dirServices = append(r.dirServices, id)
+		f.mu.Lock()
+		f.services[id] = hs.Ports
+		f.mu.Unlock()
+	}
+
+	rand.Read(r.cookie)
+	if err := os.WriteFile(c.cookieFile, r.cookie, 0600); err != nil {
+		return nil, err
+	}
+	if r.control, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(c.controlPortFile, []byte("PORT="+r.control.Addr().String()+"\n"), 0600); err != nil {
+		r.control.Close()
+		return nil, err
+	}
+	if c.socks {
+		if r.socks, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			r.control.Close()
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	f.runs = append(f.runs, r)
+	f.mu.Unlock()
+
+	r.accept(r.control, r.serve)
+	if r.socks != nil {
+		r.accept(r.socks, r.serveSocks)
+	}
+	return r.proc, nil
+}
+
+// accept hands the connections to ln to serve until the run exits.
+func (r *fakeTorRun) accept(ln net.Listener, serve func(net.Conn)) {
+	f := r.tor
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			if r.closed {
+				f.mu.Unlock()
+				conn.Close()
+				return
+			}
+			r.conns[conn] = true
+			f.mu.Unlock()
+			r.wg.Add(1)
+			go serve(conn)
+		}
+	}()
+}
+
+// fakeHiddenServiceDir does what tor does with a HiddenServiceDir: it uses
+// the key found there, or generates one, and writes the hostname file. It
+// returns the service ID.
+func fakeHiddenServiceDir(dir string) (string, error) {
+	var expanded []byte
+	if data, err := os.ReadFile(filepath.Join(dir, "hs_ed25519_secret_key")); err == nil {
+		if expanded, err = vanity.ParseSecretKeyFile(data); err != nil {
+			return "", err
+		}
+	} else {
+		var seed [32]byte
+		rand.Read(seed[:])
+		key := vanity.ExpandSeed(seed[:])
+		expanded = key[:]
+		pub, err := vanity.PublicKeyFromExpanded(expanded)
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "hs_ed25519_secret_key"), append([]byte(vanity.SecretKeyHeader), expanded...), 0600); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "hs_ed25519_public_key"), append([]byte(vanity.PublicKeyHeader), pub...), 0600); err != nil {
+			return "", err
+		}
+	}
+	id, err := fakeServiceID(expanded)
+	if err != nil {
+		return "", err
+	}
+	return id, os.WriteFile(filepath.Join(dir, "hostname"), []byte(id+".onion\n"), 0600)
+}
+
+// fakeServiceID returns the service ID of an expanded secret key.
+func fakeServiceID(expanded []byte) (string, error) {
+	pub, err := vanity.PublicKeyFromExpanded(expanded)
+	if err != nil {
+		return "", err
+	}
+	return vanity.OnionAddress(pub), nil
+}
+
+// serve answers the control commands on conn. Ephemeral services added on
+// the connection are removed when it closes, as tor does without the
+// Detach flag.
+func (r *fakeTorRun) serve(conn net.Conn) {
+	f := r.tor
+	var owned []string
+	defer r.wg.Done()
+	defer func() {
+		conn.Close()
+		f.mu.Lock()
+		delete(r.conns, conn)
+		for _, id := range owned {
+			delete(f.services, id)
+		}
+		f.mu.Unlock()
+	}()
+
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			conn.Write([]byte(l + "\r\n"))
+		}
+	}
+	// Descriptors are uploaded once tor has bootstrapped, and reported to
+	// connections subscribed to HS_DESC.
+	var pending []string
+	authenticated, events, bootstrapped := false, false, false
+	upload := func() {
+		if !bootstrapped {
+			return
+		}
+		for _, id := range pending {
+			f.mu.Lock()
+			f.uploads = append(f.uploads, id)
+			f.mu.Unlock()
+			if events {
+				reply("650 HS_DESC UPLOADED " + id + " UNKNOWN $0000000000000000000000000000000000000000~fake")
+			}
+		}
+		pending = nil
+	}
+
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		f.mu.Lock()
+		f.commands = append(f.commands, cmd)
+		f.mu.Unlock()
+		verb, args, _ := strings.Cut(cmd, " ")
+		switch {
+		case verb == "PROTOCOLINFO":
+			reply("250-PROTOCOLINFO 1",
+				fmt.Sprintf(`250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE=%s`, quoteControlString(r.cookieFile)),
+				`250-VERSION Tor="0.4.8.13"`, "250 OK")
+		case verb == "AUTHENTICATE":
+			if args != hex.EncodeToString(r.cookie) {
+				reply("515 Authentication failed: Wrong length on authentication cookie.")
+				return
+			}
+			authenticated = true
+			reply("250 OK")
+		case !authenticated:
+			reply("514 Authentication required.")
+			return
+		case verb == "SETEVENTS":
+			events = strings.Contains(args, "HS_DESC")
+			reply("250 OK")
+			pending = append(pending, r.dirServices...)
+		case cmd == "GETINFO status/bootstrap-phase":
+			f.mu.Lock()
+			progress := f.bootstrap[min(r.polls, len(f.bootstrap)-1)]
+			r.polls++
+			f.mu.Unlock()
+			tag, summary := "loading_descriptors", "Loading relay descriptors"
+			if progress >= 100 {
+				tag, summary = "done", "Done"
+			}
+			reply(fmt.Sprintf(`250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=%d TAG=%s SUMMARY="%s"`, progress, tag, summary), "250 OK")
+			bootstrapped = progress >= 100
+			upload()
+		case cmd == "GETINFO net/listeners/socks":
+			var addr string
+			if r.socks != nil {
+				addr = quoteControlString(r.socks.Addr().String())
+			}
+			reply("250-net/listeners/socks="+addr, "250 OK")
+		case cmd == "GETINFO circuit-status stream-status":
+			// Every published service has three introduction points.
+			lines := []string{"250+circuit-status="}
+			seen := make(map[string]bool)
+			f.mu.Lock()
+			for _, id := range f.uploads {
+				if f.services[id] == nil || seen[id] {
+					continue
+				}
+				seen[id] = true
+				for i := 0; i < 3; i++ {
+					lines = append(lines, fmt.Sprintf("%d BUILT $A~a,$B~b,$C~c PURPOSE=HS_SERVICE_INTRO HS_STATE=HSSI_ESTABLISHED REND_QUERY=%s", len(lines), id))
+				}
+			}
+			f.mu.Unlock()
+			reply(append(lines, ".", "250+stream-status=", ".", "250 OK")...)
+		case verb == "ADD_ONION":
+			id, ports, err := parseFakeAddOnion(args)
+			if err != nil {
+				reply("512 " + err.Error())
+				continue
+			}
+			f.mu.Lock()
+			f.services[id] = ports
+			f.mu.Unlock()
+			owned = append(owned, id)
+			reply("250-ServiceID="+id, "250 OK")
+			pending = append(pending, id)
+			upload()
+		case verb == "DEL_ONION":
+			found := false
+			for i, id := range owned {
+				if id == args {
+					owned = append(owned[:i], owned[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				reply("552 Unknown Onion Service id")
+				continue
+			}
+			f.mu.Lock()
+			delete(f.services, args)
+			f.mu.Unlock()
+			reply("250 OK")
+		default:
+			reply(fmt.Sprintf(`510 Unrecognized command "%s"`, verb))
+		}
+	}
+}
+
+// serveSocks answers a SOCKS5 CONNECT with username and password
+// authentication on conn, as tor's SOCKS port does, and relays the
+// connection to the onion service.
+func (r *fakeTorRun) serveSocks(conn net.Conn) {
+	f := r.tor
+	defer r.wg.Done()
+	defer func() {
+		conn.Close()
+		f.mu.Lock()
+		delete(r.conns, conn)
+		f.mu.Unlock()
+	}()
+
+	rd := bufio.NewReader(conn)
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil
+		}
+		return buf
+	}
+	greeting := read(2)
+	if greeting == nil || greeting[0] != 5 {
+		return
+	}
+	if methods := read(int(greeting[1])); methods == nil || !bytes.Contains(methods, []byte{2}) {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, 2})
+	var connect fakeSocksConnect
+	head := read(2)
+	if head == nil || head[0] != 1 {
+		return
+	}
+	connect.user = string(read(int(head[1])))
+	plen := read(1)
+	if plen == nil {
+		return
+	}
+	connect.password = string(read(int(plen[0])))
+	conn.Write([]byte{1, 0})
+
+	req := read(4)
+	if req == nil || req[1] != 1 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 3:
+		if n := read(1); n != nil {
+			host = string(read(int(n[0])))
+		}
+	case 4:
+		host = net.IP(read(16)).String()
+	}
+	port := read(2)
+	if port == nil {
+		return
+	}
+	connect.dest = net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	f.mu.Lock()
+	f.socks = append(f.socks, connect)
+	f.mu.Unlock()
+
+	backend, err := f.dial(context.Background(), "tcp", connect.dest)
+	if err != nil {
+		// Host unreachable
+		conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer backend.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go func() {
+		io.Copy(backend, rd)
+		backend.Close()
+	}()
+	io.Copy(conn, backend)
+}
+
+// parseFakeAddOnion returns the service ID and ports of an ADD_ONION
+// command.
+func parseFakeAddOnion(args string) (string, []portMapping, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return "", nil, errors.New("missing key")
+	}
+	var expanded []byte
+	if fields[0] == "NEW:ED25519-V3" || fields[0] == "NEW:BEST" {
+		var seed [32]byte
+		rand.Read(seed[:])
+		key := vanity.ExpandSeed(seed[:])
+		expanded = key[:]
+	} else if blob, ok := strings.CutPrefix(fields[0], "ED25519-V3:"); ok {
+		var err error
+		if expanded, err = base64.StdEncoding.DecodeString(blob); err != nil || len(expanded) != 64 {
+			return "", nil, errors.New("failed to decode ED25519-V3 key")
+		}
+	} else {
+		return "", nil, errors.New("unrecognized key type")
+	}
+	id, err := fakeServiceID(expanded)
+	if err != nil {
+		return "", nil, err
+	}
+	var ports []portMapping
+	for _, field := range fields[1:] {
+		spec, ok := strings.CutPrefix(field, "Port=")
+		if !ok {
+			continue
+		}
+		virt, target, _ := strings.Cut(spec, ",")
+		port, err := strconv.Atoi(virt)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid port %q", spec)
+		}
+		if target == "" {
+			target = "127.0.0.1:" + virt
+		}
+		ports = append(ports, portMapping{VirtPort: port, Target: target})
+	}
+	if len(ports) == 0 {
+		return "", nil, errors.New("missing port")
+	}
+	return id, ports, nil
+}
+
+// exit stops the run as tor exiting with err would: the control port goes
+// away, together with every service it published.
+func (r *fakeTorRun) exit(err error) {
+	r.once.Do(func() {
+		f := r.tor
+		r.control.Close()
+		if r.socks != nil {
+			r.socks.Close()
+		}
+		f.mu.Lock()
+		r.closed = true
+		for conn := range r.conns {
+			conn.Close()
+		}
+		f.mu.Unlock()
+		r.wg.Wait()
+		f.mu.Lock()
+		for _, id := range r.dirServices {
+			delete(f.services, id)
+		}
+		f.mu.Unlock()
+		r.proc.err = err
+		close(r.proc.exited)
+	})
+}
+
+// crash makes the current run of tor exit unexpectedly.
+func (f *fakeTor) crash() {
+	f.mu.Lock()
+	r := f.runs[len(f.runs)-1]
+	f.mu.Unlock()
+	r.exit(errors.New("exit status 1"))
+}
+
+// launches returns how often tor was launched.
+func (f *fakeTor) launches() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.runs)
+}
+
+// received returns every control command received so far.
+func (f *fakeTor) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// socksConnects returns every connection made through the SOCKS port so
+// far.
+func (f *fakeTor) socksConnects() []fakeSocksConnect {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeSocksConnect(nil), f.socks...)
+}
+
+// target returns where connections to port of the onion service id go, or
+// "" if tor does not publish it.
+func (f *fakeTor) target(id string, port int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.services[id] {
+		if p.VirtPort == port {
+			return p.Target
+		}
+	}
+	return ""
+}
+
+// waitForUploads waits until n descriptor uploads were reported and returns
+// the service IDs of the first n.
+func (f *fakeTor) waitForUploads(t *testing.T, n int) []string {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return len(f.uploads) >= n
+	}, 5*time.Second, 10*time.Millisecond, "waiting for %d descriptor uploads", n)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.uploads[:n]...)
+}
+
+// dial connects to an onion address as a client of tor's SOCKS port would,
+// reaching the backend the service's port mapping points at.
+func (f *fakeTor) dial(ctx context.Context, _, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	target := f.target(strings.TrimSuffix(host, ".onion"), port)
+	if target == "" {
+		return nil, fmt.Errorf("fake tor: %s is not reachable", addr)
+	}
+	network := "tcp"
+	if path, ok := strings.CutPrefix(target, "unix:"); ok {
+		network, target = "unix", path
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, target)
+}
+
+// client returns an HTTP client that reaches onion services through f.
+func (f *fakeTor) client() *http.Client {
+	return &http.Client{Transport: &http.Transport{DialContext: f.dial, DisableKeepAlives: true}}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package service
+
+// lockDataDir is a no-op on platforms without flock; tor's own lock file
+// still refuses a second tor on the same DataDirectory.
+func lockDataDir(dir string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// onionHostname is the onion address of a service as learned from tor. It
+// is empty until the service is first published.
+type onionHostname struct {
+	v atomic.Pointer[string]
+}
+
+func (h *onionHostname) set(hostname string) { h.v.Store(&hostname) }
+
+func (h *onionHostname) get() string {
+	if p := h.v.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// onionSecurityHeaders are sent with every response on the onion side.
+// They suit Tor Browser: no referrers leak the onion address to other
+// sites, nothing may frame the site, and no powerful features are granted.
+// HSTS is deliberately absent, as onion services are served over HTTP.
+var onionSecurityHeaders = [][2]string{
+	{"Referrer-Policy", "no-referrer"},
+	{"X-Content-Type-Options", "nosniff"},
+	{"X-Frame-Options", "DENY"},
+	{"Content-Security-Policy", "frame-ancestors 'none'; base-uri 'self'; form-action 'self'"},
+	{"Cross-Origin-Opener-Policy", "same-origin"},
+	{"Cross-Origin-Resource-Policy", "same-origin"},
+	{"Permissions-Policy", "camera=(), microphone=(), geolocation=()"},
+}
+
+// withOnionSecurityHeaders sets onionSecurityHeaders before calling next,
+// which may still override them.
+func withOnionSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		for _, kv := range onionSecurityHeaders {
+			h.Set(kv[0], kv[1])
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withOnionLocation advertises the onion service on the clearnet side: every
+// response gets an Onion-Location header, and HTML pages a matching
+// <meta http-equiv="onion-location"> tag, pointing at the same path on the
+// onion. Until tor has published the service responses pass unchanged.
+func withOnionLocation(next http.Handler, hostname *onionHostname) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := hostname.get()
+		if host == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		location := "http://" + host + r.URL.RequestURI()
+		w.Header().Set("Onion-Location", location)
+		if r.Method == http.MethodHead {
+			// Injecting the tag would change the advertised length.
+			next.ServeHTTP(w, r)
+			return
+		}
+		mw := &metaWriter{
+			ResponseWriter: w,
+			meta:           fmt.Sprintf(`<meta http-equiv="onion-location" content="%s">`, html.EscapeString(location)),
+		}
+		next.ServeHTTP(mw, r)
+		mw.finish()
+	})
+}
+
+// headTag finds the opening <head> tag the meta tag is inserted after.
+var headTag = regexp.MustCompile(`(?i)<head(\s[^>]*)?>`)
+
+// metaWriter buffers complete, uncompressed HTML pages so the onion-location
+// meta tag can be inserted into their <head>. Everything else, including
+// partial content, is passed through as it is written.
+type metaWriter struct {
+	http.ResponseWriter
+	meta        string
+	status      int
+	wroteHeader bool
+	buffering   bool
+	buf         bytes.Buffer
+}
+
+func (w *metaWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	h := w.Header()
+	w.buffering = status == http.StatusOK &&
+		strings.HasPrefix(h.Get("Content-Type"), "text/html") &&
+		h.Get("Content-Encoding") == ""
+	if !w.buffering {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *metaWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		return w.buf.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// finish writes a buffered page with the meta tag inserted.
+func (w *metaWriter) finish() {
+	if !w.buffering {
+		return
+	}
+	body := w.buf.Bytes()
+	if loc := headTag.FindIndex(body); loc != nil {
+		injected := make([]byte, 0, len(body)+len(w.meta))
+		injected = append(injected, body[:loc[1]]...)
+		injected = append(injected, w.meta...)
+		body = append(injected, body[loc[1]:]...)
+		if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// The page is no longer byte for byte the one tagged.
+			w.Header().Set("ETag", "W/"+etag)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// validateClearnet checks the clearnet listener options.
+func (o serveOptions) validateClearnet() error {
+	if (o.ClearnetCert == "") != (o.ClearnetKey == "") {
+		return fmt.Errorf("--clearnet-cert and --clearnet-key must be given together")
+	}
+	if o.ClearnetAddr == "" {
+		if o.ClearnetCert != "" {
+			return fmt.Errorf("--clearnet-cert requires --clearnet-addr")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(o.ClearnetAddr)
+	if err != nil {
+		return fmt.Errorf("invalid --clearnet-addr %q: %v", o.ClearnetAddr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || !validPort(n) {
+		return fmt.Errorf("invalid port in --clearnet-addr %q", o.ClearnetAddr)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"cheeseburger/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOnion = "blog2ptjqpa5xhg6xqkrbsqiv3ucmjyvbirhvqctbzeoinpbbmevcqd.onion"
+
+func testSite(t *testing.T) http.Handler {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("<!DOCTYPE html>\n<html><HEAD lang=\"en\"><title>Blog</title></HEAD><body>hi</body></html>"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "style.css"), []byte("body{}"), 0644))
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir(dir)))
+	mux.HandleFunc("/bare", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<p>no head</p>")
+	})
+	return mux
+}
+
+func get(h http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOnionSecurityHeaders(t *testing.T) {
+	rec := get(withOnionSecurityHeaders(testSite(t)), "GET", "/", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "no-referrer", rec.Header().Get("Referrer-Policy"))
+	assert.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"))
+	assert.Contains(t, rec.Header().Get("Content-Security-Policy"), "frame-ancestors 'none'")
+	assert.Empty(t, rec.Header().Get("Strict-Transport-Security"))
+	assert.Empty(t, rec.Header().Get("Onion-Location"))
+}
+
+func TestOnionLocation(t *testing.T) {
+	var hostname onionHostname
+	h := withOnionLocation(testSite(t), &hostname)
+
+	rec := get(h, "GET", "/", nil)
+	assert.Empty(t, rec.Header().Get("Onion-Location"), "nothing is advertised before tor published the service")
+	assert.NotContains(t, rec.Body.String(), "onion-location")
+
+	hostname.set(testOnion)
+	rec = get(h, "GET", "/?page=2&q=a", nil)
+	location := "http://" + testOnion + "/?page=2&q=a"
+	assert.Equal(t, location, rec.Header().Get("Onion-Location"))
+	body := rec.Body.String()
+	assert.Contains(t, body, `<HEAD lang="en"><meta http-equiv="onion-location" content="http://`+testOnion+`/?page=2&amp;q=a"><title>`)
+	assert.Equal(t, strconv.Itoa(len(body)), rec.Header().Get("Content-Length"))
+
+	rec = get(h, "GET", "/style.css", nil)
+	assert.Equal(t, "http://"+testOnion+"/style.css", rec.Header().Get("Onion-Location"))
+	assert.Equal(t, "body{}", rec.Body.String(), "only HTML pages get the meta tag")
+
+	rec = get(h, "GET", "/bare", nil)
+	assert.Equal(t, "<p>no head</p>", rec.Body.String(), "pages without <head> only get the header")
+	assert.NotEmpty(t, rec.Header().Get("Onion-Location"))
+
+	rec = get(h, "GET", "/", http.Header{"Range": {"bytes=0-4"}})
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "<!DOC", rec.Body.String(), "partial content is passed through")
+
+	rec = get(h, "HEAD", "/", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Onion-Location"))
+}
+
+func TestClearnetFlags(t *testing.T) {
+	opts, err := parseServeFlags(config.Default(), "serve", []string{"--clearnet-addr", ":8443", "--clearnet-cert", "c.pem", "--clearnet-key", "k.pem"})
+	assert.NoError(t, err)
+	assert.Equal(t, ":8443", opts.ClearnetAddr)
+
+	for _, args := range [][]string{
+		{"--clearnet-addr", "8443"},
+		{"--clearnet-addr", ":0"},
+		{"--clearnet-addr", ":8443", "--clearnet-cert", "c.pem"},
+		{"--clearnet-cert", "c.pem", "--clearnet-key", "k.pem"},
+	} {
+		_, err := parseServeFlags(config.Default(), "serve", args)
+		assert.Error(t, err, "%v", args)
+	}
+}
+
+func TestListenClearnet(t *testing.T) {
+	ln, err := listenClearnet(serveOptions{ClearnetAddr: "127.0.0.1:0"})
+	require.NoError(t, err)
+	ln.Close()
+
+	_, err = listenClearnet(serveOptions{ClearnetAddr: "127.0.0.1:0", ClearnetCert: "missing.pem", ClearnetKey: "missing.pem"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"cheeseburger/config"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveOptions holds the flags shared by "serve" and "mvc serve".
+type serveOptions struct {
+	VanityName string
+	Ephemeral  bool
+	// PassphraseFD is the file descriptor to read the passphrase of an
+	// encrypted key from, or -1.
+	PassphraseFD int
+	// TorDataDir overrides tor's DataDirectory.
+	TorDataDir string
+	// VanityDir holds the key bundles VanityName refers to (paths.vanity).
+	VanityDir string
+	// TorDataBase holds the persistent DataDirectory of each saved key
+	// (paths.tor_data).
+	TorDataBase string
+	// SocksPort is tor's SOCKS port; 0 disables it.
+	SocksPort int
+	// ControlPort is tor's control port; 0 lets tor pick one.
+	ControlPort int
+	// Backend is how tor reaches the HTTP server: "unix" for a private Unix
+	// domain socket, or "tcp" for a loopback port.
+	Backend string
+	// ListenSocket is the socket of a "unix" backend; empty picks one in a
+	// private temporary directory.
+	ListenSocket string
+	// ListenPort is the loopback port of a "tcp" backend.
+	ListenPort int
+	// HSPorts are additional onion service port mappings.
+	HSPorts []portMapping
+	// ClearnetAddr optionally also serves the site on this public address,
+	// advertising the onion with Onion-Location. ClearnetCert and
+	// ClearnetKey serve it over HTTPS.
+	ClearnetAddr string
+	ClearnetCert string
+	ClearnetKey  string
+	// TorrcInclude is a file of extra torrc directives.
+	TorrcInclude string
+	// TorPath runs this tor executable instead of the embedded one.
+	TorPath string
+	// TorControl attaches to an already running tor at this control
+	// address instead of launching one.
+	TorControl string
+	// DoS holds the onion service's DoS defenses.
+	DoS dosConfig
+	// StatsInterval is how often circuit and stream statistics are
+	// logged; 0 disables them.
+	StatsInterval time.Duration
+	// AdminSocket serves cheeseburger status; empty disables it.
+	AdminSocket string
+	// CacheRules set the Cache-Control of static files; they are only
+	// accepted by "serve".
+	CacheRules []config.CacheRule
+}
+
+// parseServeFlags parses the flags accepted by the serving commands. Flags
+// that are not given take their value from cfg.
+func parseServeFlags(cfg *config.Config, name string, args []string) (serveOptions, error) {
+	opts := serveOptions{VanityDir: cfg.Paths.Vanity, TorDataBase: cfg.Paths.TorData}
+	def := cfg.Serve
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&opts.VanityName, "vanity-name", def.VanityName, "name of the vanity key under data/vanity to serve")
+	fs.BoolVar(&opts.Ephemeral, "ephemeral", false, "add the onion service over the control port (ADD_ONION) instead of a HiddenServiceDir")
+	fs.StringVar(&opts.TorDataDir, "tor-data-dir", "", "persistent tor DataDirectory (default data/tor/<vanity-name> for saved keys)")
+	fs.IntVar(&opts.PassphraseFD, "passphrase-fd", -1, "read the passphrase of an encrypted vanity key from this file descriptor")
+	fs.IntVar(&opts.SocksPort, "socks-port", def.SocksPort, "tor SOCKS port (0 disables it)")
+	fs.IntVar(&opts.ControlPort, "control-port", def.ControlPort, "tor control port (0 picks a free port)")
+	fs.StringVar(&opts.Backend, "backend", def.Backend, "how tor reaches the HTTP server: unix (private socket) or tcp (loopback port)")
+	fs.StringVar(&opts.ListenSocket, "listen-socket", "", "Unix socket of the HTTP server (default: in a private temporary directory)")
+	fs.IntVar(&opts.ListenPort, "listen-port", def.ListenPort, "loopback port of the HTTP server with --backend tcp")
+	fs.Var(portMappingsFlag{&opts.HSPorts}, "hs-port", "extra onion service port mapping VIRTPORT:TARGET (repeatable)")
+	fs.StringVar(&opts.ClearnetAddr, "clearnet-addr", def.ClearnetAddr, "also serve the site on this clearnet address, advertising the onion with Onion-Location")
+	fs.StringVar(&opts.ClearnetCert, "clearnet-cert", def.ClearnetCert, "TLS certificate of the clearnet listener")
+	fs.StringVar(&opts.ClearnetKey, "clearnet-key", def.ClearnetKey, "TLS key of the clearnet listener")
+	fs.StringVar(&opts.TorrcInclude, "torrc-include", def.TorrcInclude, "file of extra torrc directives to %include")
+	fs.StringVar(&opts.TorPath, "tor-path", def.TorPath, "tor executable to run instead of the embedded binary")
+	fs.StringVar(&opts.TorControl, "tor-control", def.TorControl, "attach to a running tor at this control address (host:port or unix:/path)")
+	fs.DurationVar(&opts.StatsInterval, "stats-interval", def.StatsInterval, "log circuit and stream statistics of the service at this interval")
+	fs.StringVar(&opts.AdminSocket, "admin-socket", cfg.Paths.AdminSocket, "serve cheeseburger status on this Unix socket (empty disables it)")
+	var cacheRules []config.CacheRule
+	if name == "serve" {
+		fs.Var(cacheRulesFlag{&cacheRules}, "cache-control", "Cache-Control of static files matching a glob, GLOB=VALUE (repeatable, replaces serve.cache)")
+	}
+	dos := dosFlags{preset: def.DoSPreset}
+	dos.register(fs)
+	if err := fs.Parse(args); err != nil {
+		// The flag package's own report is discarded with its usage text,
+		// so it has to travel in the returned error.
+		return opts, fmt.Errorf("%s: %w", name, err)
+	}
+	opts.CacheRules = def.Cache
+	if cacheRules != nil {
+		opts.CacheRules = cacheRules
+	}
+	var err error
+	if opts.DoS, err = dos.apply(fs); err != nil {
+		return opts, err
+	}
+	if opts.StatsInterval < 0 {
+		return opts, fmt.Errorf("invalid --stats-interval %s", opts.StatsInterval)
+	}
+	if opts.TorControl != "" {
+		// These configure a tor that cheeseburger launches itself.
+		var conflicts []string
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "tor-path", "tor-data-dir", "torrc-include", "socks-port", "control-port":
+				conflicts = append(conflicts, "--"+f.Name)
+			}
+		})
+		if len(conflicts) > 0 {
+			return opts, fmt.Errorf("--tor-control cannot be combined with %s", strings.Join(conflicts, ", "))
+		}
+	}
+	if err := opts.resolveBackend(fs); err != nil {
+		return opts, err
+	}
+	if err := opts.validateClearnet(); err != nil {
+		return opts, err
+	}
+	for _, m := range opts.HSPorts {
+		if m.VirtPort == 80 {
+			return opts, fmt.Errorf("--hs-port cannot remap port 80, which serves the site; use --listen-port")
+		}
+	}
+	return opts, nil
+}
+
+// resolveBackend settles the backend after parsing. An explicit
+// --listen-port asks for the TCP fallback, and so does attaching to an
+// external tor, which usually runs as another user and cannot open our
+// private socket; --backend always has the last word.
+func (o *serveOptions) resolveBackend(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if !explicit["backend"] && o.Backend == "unix" && (explicit["listen-port"] || o.TorControl != "") {
+		o.Backend = "tcp"
+	}
+	switch o.Backend {
+	case "unix":
+		if explicit["listen-port"] {
+			return fmt.Errorf("--listen-port cannot be used with --backend unix")
+		}
+		if o.ListenSocket != "" {
+			abs, err := filepath.Abs(o.ListenSocket)
+			if err != nil {
+				return err
+			}
+			o.ListenSocket = abs
+		}
+	case "tcp":
+		if o.ListenSocket != "" {
+			return fmt.Errorf("--listen-socket cannot be used with --backend tcp")
+		}
+		if !validPort(o.ListenPort) {
+			return fmt.Errorf("invalid --listen-port %d", o.ListenPort)
+		}
+	default:
+		return fmt.Errorf("--backend must be unix or tcp, not %q", o.Backend)
+	}
+	return nil
+}
+
+// backendListenAddr returns the network and address the local HTTP server
+// listens on.
+func (o serveOptions) backendListenAddr() (network, addr string) {
+	if o.Backend == "unix" {
+		return "unix", o.ListenSocket
+	}
+	return "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(o.ListenPort))
+}
+
+// backendTarget is where tor forwards the onion service's port 80, in the
+// syntax of HiddenServicePort.
+func (o serveOptions) backendTarget() string {
+	network, addr := o.backendListenAddr()
+	if network == "unix" {
+		return "unix:" + addr
+	}
+	return addr
+}
+
+// onionPorts returns every port the onion service exposes, starting with
+// port 80 for the site itself.
+func (o serveOptions) onionPorts() []portMapping {
+	return append([]portMapping{{VirtPort: 80, Target: o.backendTarget()}}, o.HSPorts...)
+}
+
+// cacheRulesFlag collects repeated --cache-control flags.
+type cacheRulesFlag struct {
+	rules *[]config.CacheRule
+}
+
+func (f cacheRulesFlag) String() string {
+	if f.rules == nil {
+		return ""
+	}
+	var parts []string
+	for _, r := range *f.rules {
+		parts = append(parts, r.Pattern+"="+r.Control)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f cacheRulesFlag) Set(v string) error {
+	pattern, control, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("want GLOB=VALUE, not %q", v)
+	}
+	r := config.CacheRule{Pattern: pattern, Control: control}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	*f.rules = append(*f.rules, r)
+	return nil
+}
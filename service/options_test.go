@@ -0,0 +1,173 @@
+package service
+
+import (
+	"cheeseburger/config"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServeFlags(t *testing.T) {
+	opts, err := parseServeFlags(config.Default(), "serve", []string{"--vanity-name", "myblog", "--ephemeral"})
+	assert.NoError(t, err)
+	assert.Equal(t, "myblog", opts.VanityName)
+	assert.True(t, opts.Ephemeral)
+
+	opts, err = parseServeFlags(config.Default(), "serve", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, serveOptions{PassphraseFD: -1, VanityDir: "data/vanity", TorDataBase: "data/tor", SocksPort: 9050, Backend: "unix", ListenPort: 8080, AdminSocket: filepath.Join("data", "admin.sock")}, opts)
+
+	cfg := config.Default()
+	cfg.Serve.VanityName = "myblog"
+	cfg.Serve.ListenPort = 8181
+	cfg.Serve.DoSPreset = "moderate"
+	opts, err = parseServeFlags(cfg, "serve", []string{"--listen-port", "8282"})
+	assert.NoError(t, err)
+	assert.Equal(t, "myblog", opts.VanityName, "defaults come from the config")
+	assert.Equal(t, 8282, opts.ListenPort, "flags override the config")
+	assert.Equal(t, dosPresets["moderate"], opts.DoS)
+
+	opts, err = parseServeFlags(config.Default(), "serve", []string{"--passphrase-fd", "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, opts.PassphraseFD)
+
+	opts, err = parseServeFlags(config.Default(), "serve", []string{"--tor-data-dir", "/var/lib/cheeseburger/tor"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/lib/cheeseburger/tor", opts.TorDataDir)
+
+	opts, err = parseServeFlags(config.Default(), "serve", []string{
+		"--socks-port", "0", "--control-port", "9151", "--listen-port", "8181",
+		"--hs-port", "22:2222", "--hs-port", "443:127.0.0.1:8443", "--torrc-include", "/etc/extra.torrc",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, opts.SocksPort)
+	assert.Equal(t, 9151, opts.ControlPort)
+	assert.Equal(t, "/etc/extra.torrc", opts.TorrcInclude)
+	assert.Equal(t, []portMapping{
+		{VirtPort: 80, Target: "127.0.0.1:8181"},
+		{VirtPort: 22, Target: "127.0.0.1:2222"},
+		{VirtPort: 443, Target: "127.0.0.1:8443"},
+	}, opts.onionPorts())
+
+	_, err = parseServeFlags(config.Default(), "serve", []string{"--bogus"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "flag provided but not defined: -bogus")
+	}
+	_, err = parseServeFlags(config.Default(), "serve", []string{"--socks-port", "many"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `invalid value "many" for flag -socks-port`)
+	}
+	_, err = parseServeFlags(config.Default(), "serve", []string{"--hs-port", "80:9090"})
+	assert.Error(t, err)
+	_, err = parseServeFlags(config.Default(), "serve", []string{"--hs-port", "nonsense"})
+	assert.Error(t, err)
+	_, err = parseServeFlags(config.Default(), "serve", []string{"--listen-port", "0"})
+	assert.Error(t, err)
+
+	opts, err = parseServeFlags(config.Default(), "serve", []string{"--tor-path", "/usr/bin/tor"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/usr/bin/tor", opts.TorPath)
+
+	opts, err = parseServeFlags(config.Default(), "serve", []string{"--tor-control", "unix:/run/tor/control", "--listen-port", "8181"})
+	assert.NoError(t, err)
+	assert.Equal(t, "unix:/run/tor/control", opts.TorControl)
+	opts, err = parseServeFlags(config.Default(), "serve", []string{"--tor-control", "127.0.0.1:9051"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", opts.Backend, "an external tor cannot open our private socket")
+	_, err = parseServeFlags(config.Default(), "serve", []string{"--tor-control", "127.0.0.1:9051", "--socks-port", "0", "--tor-path", "tor"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "--socks-port, --tor-path")
+	}
+}
+
+func TestParseServeFlagsBackend(t *testing.T) {
+	opts, err := parseServeFlags(config.Default(), "serve", []string{"--listen-socket", "/run/cheeseburger/blog.sock"})
+	assert.NoError(t, err)
+	assert.Equal(t, "unix", opts.Backend)
+	assert.Equal(t, "unix:/run/cheeseburger/blog.sock", opts.backendTarget())
+	assert.Equal(t, portMapping{VirtPort: 80, Target: "unix:/run/cheeseburger/blog.sock"}, opts.onionPorts()[0])
+
+	opts, err = parseServeFlags(config.Default(), "serve", []string{"--listen-socket", "blog.sock"})
+	assert.NoError(t, err)
+	assert.True(t, filepath.IsAbs(opts.ListenSocket), "tor needs an absolute socket path")
+
+	opts, err = parseServeFlags(config.Default(), "serve", []string{"--backend", "tcp"})
+	assert.NoError(t, err)
+	network, addr := opts.backendListenAddr()
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "127.0.0.1:8080", addr)
+
+	opts, err = parseServeFlags(config.Default(), "serve", []string{"--listen-port", "8181"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", opts.Backend, "--listen-port selects the TCP fallback")
+	assert.Equal(t, "127.0.0.1:8181", opts.backendTarget())
+
+	for _, args := range [][]string{
+		{"--backend", "udp"},
+		{"--backend", "unix", "--listen-port", "8181"},
+		{"--backend", "tcp", "--listen-socket", "/tmp/blog.sock"},
+	} {
+		_, err := parseServeFlags(config.Default(), "serve", args)
+		assert.Error(t, err, "%v", args)
+	}
+}
+
+func TestListenBackendUnix(t *testing.T) {
+	sites := []site{{opts: serveOptions{Backend: "unix", VanityName: "blog"}}, {opts: serveOptions{Backend: "tcp", ListenPort: 8080}}}
+	cleanup, err := prepareBackendSockets(sites)
+	require.NoError(t, err)
+	sock := sites[0].opts.ListenSocket
+	assert.True(t, strings.HasSuffix(sock, "blog.sock"), sock)
+	assert.Empty(t, sites[1].opts.ListenSocket)
+
+	ln, err := listenBackend(sites[0].opts)
+	require.NoError(t, err)
+	info, err := os.Stat(sock)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	dirInfo, err := os.Stat(filepath.Dir(sock))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), dirInfo.Mode().Perm(), "only we and tor can reach the socket")
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") }))
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://blog/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hello", string(body))
+
+	ln.Close()
+	cleanup()
+	assert.NoDirExists(t, filepath.Dir(sock))
+}
+
+func TestListenBackendReplacesStaleSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "blog.sock")
+	stale, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	// Leave the socket file behind, as a crashed process would.
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenBackend(serveOptions{Backend: "unix", ListenSocket: sock})
+	require.NoError(t, err)
+	ln.Close()
+
+	regular := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(regular, nil, 0600))
+	_, err = listenBackend(serveOptions{Backend: "unix", ListenSocket: regular})
+	assert.Error(t, err, "only stale sockets are replaced")
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"cheeseburger/keys"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// rotationPath is where a rotated service serves the announcement of its
+// new address, on the old onion as well as the new one.
+const rotationPath = "/.well-known/onion-rotation.txt"
+
+// retiringOnion is the old key of a service whose key was rotated. It is
+// published ephemerally next to the new one until retireAt, and removed
+// from tor then.
+type retiringOnion struct {
+	expandedKey []byte
+	hostname    string
+	// clientAuth holds the x25519 keys of the old onion's authorized
+	// clients.
+	clientAuth []string
+	retireAt   time.Time
+}
+
+// active reports whether the old onion is still to be published.
+func (r *retiringOnion) active() bool {
+	return r != nil && time.Now().Before(r.retireAt)
+}
+
+// loadRotation reads the rotation announcement of the bundle in hsDir,
+// nil if its key was never rotated in. While the overlap lasts it also
+// unlocks the old key, which was sealed with the same passphrase.
+func loadRotation(hsDir string, passphrase []byte) ([]byte, *retiringOnion, error) {
+	r, err := keys.ReadRotation(hsDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid rotation announcement: %v", err)
+	}
+	if r == nil {
+		return nil, nil, nil
+	}
+	name := filepath.Base(hsDir)
+	retiringDir := keys.RetiringDir(hsDir)
+	if _, err := os.Stat(retiringDir); err != nil {
+		return r.Marshal(), nil, nil
+	}
+	if !time.Now().Before(r.Retires) {
+		log.Printf("The overlap of %s's move from %s ended on %s; delete the old key with cheeseburger keys rotate --vanity-name %s --finish",
+			name, r.Old, r.Retires.Format(time.RFC3339), name)
+		return r.Marshal(), nil, nil
+	}
+
+	if err := keys.FixPermissions(retiringDir); err != nil {
+		return nil, nil, fmt.Errorf("failed to set permissions on %s: %v", retiringDir, err)
+	}
+	old, err := keys.Verify(retiringDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid retiring key: %v", err)
+	}
+	if old.OnionAddress != r.Old {
+		return nil, nil, fmt.Errorf("%s holds %s, not the rotated out %s", retiringDir, old.OnionAddress, r.Old)
+	}
+	if !old.Encrypted {
+		passphrase = nil
+	}
+	expanded, err := keys.Unlock(retiringDir, passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unlock the retiring key: %v", err)
+	}
+	clients, err := keys.Clients(retiringDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load authorized clients of the retiring key: %v", err)
+	}
+	retiring := &retiringOnion{expandedKey: expanded, hostname: r.Old, retireAt: r.Retires}
+	for _, c := range clients {
+		retiring.clientAuth = append(retiring.clientAuth, c.EncodedKey())
+	}
+	log.Printf("%s moved from %s; both are published until %s", name, r.Old, r.Retires.Format(time.RFC3339))
+	return r.Marshal(), retiring, nil
+}
+
+// withRotationAnnouncement serves the signed rotation announcement at
+// rotationPath, in front of the site. It returns next unchanged for a
+// service that was never rotated.
+func withRotationAnnouncement(next http.Handler, announcement []byte) http.Handler {
+	if announcement == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != rotationPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(announcement)
+	})
+}
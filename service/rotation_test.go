@@ -0,0 +1,59 @@
+package service
+
+import (
+	"cheeseburger/config"
+	"cheeseburger/keys"
+	"cheeseburger/vanity"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeRotatedKeyOverFakeTor(t *testing.T) {
+	f := useFakeTor(t)
+	var seed [32]byte
+	copy(seed[:], "blog")
+	expanded := vanity.ExpandSeed(seed[:])
+	dir := vanity.BundleDir(config.Default().Paths.Vanity, "blog")
+	_, err := vanity.SaveBundle(dir, expanded[:], 1)
+	require.NoError(t, err)
+	r, err := keys.Rotate(dir, keys.RotateOptions{Overlap: 4 * time.Second})
+	require.NoError(t, err)
+	newID, oldID := strings.TrimSuffix(r.New, ".onion"), strings.TrimSuffix(r.Old, ".onion")
+	site := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(site, "index.html"), []byte("still here"), 0644))
+
+	done := startServing(func() { RunStaticTorServer(config.Default(), site, []string{"--vanity-name", "blog"}) })
+	assert.ElementsMatch(t, []string{newID, oldID}, f.waitForUploads(t, 2), "both onions are published")
+	for _, host := range []string{r.New, r.Old} {
+		resp, body := getOnion(t, f, "http://"+host+rotationPath)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		announced, err := keys.ParseRotation([]byte(body))
+		if assert.NoError(t, err, host) {
+			assert.Equal(t, r.New, announced.New)
+		}
+		_, body = getOnion(t, f, "http://"+host+"/")
+		assert.Equal(t, "still here", body)
+	}
+
+	require.Eventually(t, func() bool {
+		for _, cmd := range f.received() {
+			if cmd == "DEL_ONION "+oldID {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 50*time.Millisecond, "the old onion is retired after the overlap")
+	assert.Empty(t, f.target(oldID, 80))
+	resp, _ := getOnion(t, f, "http://"+r.New+rotationPath)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the new onion keeps the announcement")
+
+	stopServing(t, done)
+	assert.DirExists(t, keys.RetiringDir(dir), "the old key is only deleted by keys rotate --finish")
+}
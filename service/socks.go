@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// torSocks is the SOCKS listener of the tor cheeseburger is serving with,
+// as tor reported it on the last control connection. addr is "" while
+// cheeseburger is not serving or tor's SOCKS port is disabled.
+var torSocks struct {
+	sync.Mutex
+	addr string
+}
+
+// setTorSocks records the SOCKS listener of the tor being served with.
+func setTorSocks(addr string) {
+	torSocks.Lock()
+	defer torSocks.Unlock()
+	torSocks.addr = addr
+}
+
+// managedTorSocks returns the SOCKS listener of the tor being served with.
+func managedTorSocks() string {
+	torSocks.Lock()
+	defer torSocks.Unlock()
+	return torSocks.addr
+}
+
+// TorDialer makes outgoing connections through a tor SOCKS port. Host names
+// are passed to tor unresolved, so nothing reaches the network outside of
+// tor, not even DNS. Connections to different destination hosts never
+// share a circuit: tor keeps streams with different SOCKS credentials
+// apart (IsolateSOCKSAuth, on by default), and the dialer authenticates
+// with the destination as user name.
+type TorDialer struct {
+	// addr is tor's SOCKS listener, "host:port" or "unix:/path"; "" for the
+	// one of the tor cheeseburger is serving with.
+	addr string
+	// nonce is the SOCKS password of every connection, which keeps them
+	// apart from those of other dialers and programs using the same tor.
+	nonce   string
+	forward *net.Dialer
+}
+
+// NewTorDialer returns a dialer through the SOCKS port at addr,
+// "host:port" or "unix:/path". With addr "" it uses the SOCKS port of the
+// tor cheeseburger is serving with, looked up on every dial so that it
+// follows tor across restarts; dialing fails while cheeseburger is not
+// serving or serve.socks_port is 0.
+func NewTorDialer(addr string) (*TorDialer, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate SOCKS credentials: %v", err)
+	}
+	return &TorDialer{
+		addr:    addr,
+		nonce:   hex.EncodeToString(nonce),
+		forward: &net.Dialer{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Dial connects to addr through tor.
+func (d *TorDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr, a "host:port" on the clearnet or an onion
+// service, through tor. Tor only carries TCP.
+func (d *TorDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("tor cannot dial %s connections", network)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	socksAddr := d.addr
+	if socksAddr == "" {
+		if socksAddr = managedTorSocks(); socksAddr == "" {
+			return nil, errors.New("no tor SOCKS port; is cheeseburger serving with serve.socks_port set?")
+		}
+	}
+	socksNetwork := "tcp"
+	if path, ok := strings.CutPrefix(socksAddr, "unix:"); ok {
+		socksNetwork, socksAddr = "unix", path
+	}
+	auth := &proxy.Auth{User: isolationKey(host), Password: d.nonce}
+	socks, err := proxy.SOCKS5(socksNetwork, socksAddr, auth, d.forward)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("tor: %v", err)
+	}
+	return conn, nil
+}
+
+// isolationKey returns the destination host streams are isolated by.
+// Subdomains of an onion address are the same service, so they share its
+// key.
+func isolationKey(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasSuffix(host, ".onion") {
+		labels := strings.Split(host, ".")
+		host = strings.Join(labels[max(len(labels)-2, 0):], ".")
+	}
+	return host
+}
+
+// NewTorHTTPClient returns an HTTP client whose requests all go through
+// NewTorDialer(addr). It never falls back to a direct connection and
+// ignores HTTP_PROXY and the like. Its timeout allows for the slow circuit
+// building of onion services.
+func NewTorHTTPClient(addr string) (*http.Client, error) {
+	d, err := NewTorDialer(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout: 2 * time.Minute,
+		Transport: &http.Transport{
+			DialContext:         d.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 30 * time.Second,
+		},
+	}, nil
+}
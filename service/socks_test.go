@@ -0,0 +1,91 @@
+package service
+
+import (
+	"cheeseburger/config"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsolationKey(t *testing.T) {
+	for host, want := range map[string]string{
+		"example.com":         "example.com",
+		"Example.COM.":        "example.com",
+		testOnion:             testOnion,
+		"www." + testOnion:    testOnion,
+		"a.b." + testOnion:    testOnion,
+		"203.0.113.7":         "203.0.113.7",
+		"feeds.example.onion": "example.onion",
+	} {
+		assert.Equal(t, want, isolationKey(host), host)
+	}
+}
+
+func TestTorDialerNeedsSocksPort(t *testing.T) {
+	d, err := NewTorDialer("")
+	require.NoError(t, err)
+	_, err = d.Dial("tcp", testOnion+":80")
+	assert.ErrorContains(t, err, "no tor SOCKS port", "cheeseburger is not serving")
+	_, err = d.Dial("udp", "example.com:53")
+	assert.ErrorContains(t, err, "cannot dial udp")
+}
+
+func TestTorHTTPClientOverFakeTor(t *testing.T) {
+	f := useFakeTor(t)
+	site := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(site, "index.html"), []byte("fetched through tor"), 0644))
+	client, err := NewTorHTTPClient("")
+	require.NoError(t, err)
+
+	done := startServing(func() { RunStaticTorServer(config.Default(), site, []string{"--ephemeral"}) })
+	id := f.waitForUploads(t, 1)[0]
+	resp, err := client.Get("http://" + id + ".onion/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "fetched through tor", string(body))
+
+	_, err = client.Get("http://" + testOnion + "/")
+	assert.Error(t, err, "the fake tor reaches only its own services")
+
+	connects := f.socksConnects()
+	require.Len(t, connects, 2)
+	assert.Equal(t, id+".onion:80", connects[0].dest, "the host name is resolved by tor")
+	assert.Equal(t, id+".onion", connects[0].user)
+	assert.Equal(t, testOnion, connects[1].user, "each destination gets its own circuits")
+	assert.NotEmpty(t, connects[0].password)
+	assert.Equal(t, connects[0].password, connects[1].password)
+
+	other, err := NewTorDialer("")
+	require.NoError(t, err)
+	conn, err := other.Dial("tcp", id+".onion:80")
+	require.NoError(t, err)
+	conn.Close()
+	assert.NotEqual(t, connects[0].password, f.socksConnects()[2].password, "dialers do not share circuits")
+
+	stopServing(t, done)
+	_, err = other.Dial("tcp", id+".onion:80")
+	assert.ErrorContains(t, err, "no tor SOCKS port")
+}
+
+func TestTorDialerWithSocksPortDisabled(t *testing.T) {
+	f := useFakeTor(t)
+
+	done := startServing(func() {
+		RunStaticTorServer(config.Default(), t.TempDir(), []string{"--ephemeral", "--socks-port", "0"})
+	})
+	id := f.waitForUploads(t, 1)[0]
+	d, err := NewTorDialer("")
+	require.NoError(t, err)
+	_, err = d.Dial("tcp", id+".onion:80")
+	assert.ErrorContains(t, err, "serve.socks_port")
+
+	stopServing(t, done)
+}
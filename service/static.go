@@ -1,18 +1,317 @@
 package service
 
 import (
+	"bytes"
+	"cheeseburger/config"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // RunStaticTorServer runs a static file server over Tor
-func RunStaticTorServer(staticDir, vanityName string) {
-	log.Printf("Starting static file server on port 8080 serving directory: %s", staticDir)
-	runTorHiddenService(vanityName, func() {
-		handler := http.FileServer(http.Dir(staticDir))
-		http.Handle("/", handler)
-		if err := http.ListenAndServe(":8080", nil); err != nil {
-			log.Printf("Static server error: %v", err)
-		}
-	})
+func RunStaticTorServer(cfg *config.Config, staticDir string, args []string) {
+	opts, err := parseServeFlags(cfg, "serve", args)
+	if err != nil {
+		log.Fatalf("Invalid serve options: %v", err)
+	}
+	log.Printf("Starting static file server serving directory: %s", staticDir)
+	runTorHiddenService(site{opts: opts, handler: newStaticHandler(staticDir, opts.CacheRules)})
+}
+
+const (
+	// gzipMinSize is the smallest file compressed on the fly. Smaller
+	// files fit in a few tor cells anyway.
+	gzipMinSize = 1024
+	// gzipMaxSize is the largest file compressed on the fly, in memory.
+	// Larger files are only served compressed if precompressed.
+	gzipMaxSize = 8 << 20
+	// staticCacheSize bounds the memory holding files compressed on the
+	// fly.
+	staticCacheSize = 32 << 20
+)
+
+// precompressed are the encodings, in order of preference, of the files
+// that may sit next to a static file, such as index.html.br for
+// index.html.
+var precompressed = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// staticHandler serves a directory like http.FileServer, which it falls
+// back to for directory listings, redirects and errors. Regular files are
+// served with a strong ETag derived from the bytes sent, the Cache-Control
+// of the first matching rule, and the best encoding the client accepts: a
+// precompressed .br or .gz file next to the file if it is not older, or
+// else gzip on the fly for compressible files between gzipMinSize and
+// gzipMaxSize.
+type staticHandler struct {
+	root  http.FileSystem
+	files http.Handler
+	rules []config.CacheRule
+
+	mu sync.Mutex
+	// entries caches the ETags, and gzipped content, of the files served,
+	// keyed by their name and encoding. An entry is used as long as the
+	// file's size and modification time are unchanged.
+	entries map[string]*staticEntry
+	cached  int
+}
+
+type staticEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+	gzipped []byte
+}
+
+func newStaticHandler(dir string, rules []config.CacheRule) *staticHandler {
+	root := http.Dir(dir)
+	return &staticHandler{
+		root:    root,
+		files:   http.FileServer(root),
+		rules:   rules,
+		entries: make(map[string]*staticEntry),
+	}
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || strings.HasSuffix(r.URL.Path, "/index.html") {
+		h.files.ServeHTTP(w, r)
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+	f, info, ok := h.open(name)
+	if !ok {
+		// Directories, missing files and errors.
+		h.files.ServeHTTP(w, r)
+		return
+	}
+	defer f.Close()
+
+	header := w.Header()
+	if control := h.cacheControl(name); control != "" {
+		header.Set("Cache-Control", control)
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		var buf [512]byte
+		n, _ := io.ReadFull(f, buf[:])
+		ctype = http.DetectContentType(buf[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	header.Set("Content-Type", ctype)
+
+	accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+	negotiated := compressible(ctype)
+	for _, p := range precompressed {
+		vf, vinfo, ok := h.open(name + p.ext)
+		if !ok {
+			continue
+		}
+		if vinfo.ModTime().Before(info.ModTime()) {
+			// Left over from an older version of the file.
+			vf.Close()
+			continue
+		}
+		negotiated = true
+		if !accepted(p.encoding) {
+			vf.Close()
+			continue
+		}
+		defer vf.Close()
+		etag, err := h.etag(name+p.ext, vf, vinfo)
+		if err != nil {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		header.Add("Vary", "Accept-Encoding")
+		header.Set("Content-Encoding", p.encoding)
+		header.Set("ETag", etag)
+		http.ServeContent(w, r, name, info.ModTime(), vf)
+		return
+	}
+	if negotiated {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if compressible(ctype) && info.Size() >= gzipMinSize && info.Size() <= gzipMaxSize && accepted("gzip") {
+		e, err := h.gzipped(name, f, info)
+		if err != nil {
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		header.Set("Content-Encoding", "gzip")
+		header.Set("ETag", e.etag)
+		http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(e.gzipped))
+		return
+	}
+	etag, err := h.etag(name, f, info)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	header.Set("ETag", etag)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// open opens name if it is a regular file.
+func (h *staticHandler) open(name string) (http.File, fs.FileInfo, bool) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		return nil, nil, false
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, false
+	}
+	return f, info, true
+}
+
+// cacheControl returns the Cache-Control of the first rule matching name.
+func (h *staticHandler) cacheControl(name string) string {
+	for _, rule := range h.rules {
+		subject := path.Base(name)
+		if strings.Contains(rule.Pattern, "/") {
+			subject = name
+		}
+		if ok, _ := path.Match(rule.Pattern, subject); ok {
+			return rule.Control
+		}
+	}
+	return ""
+}
+
+// cachedEntry returns the entry of key if it still describes info.
+func (h *staticHandler) cachedEntry(key string, info fs.FileInfo) *staticEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.entries[key]
+	if e == nil || e.size != info.Size() || !e.modTime.Equal(info.ModTime()) {
+		return nil
+	}
+	return e
+}
+
+func (h *staticHandler) store(key string, e *staticEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if old := h.entries[key]; old != nil {
+		h.cached -= len(old.gzipped)
+	}
+	if h.cached+len(e.gzipped) > staticCacheSize {
+		// Start over rather than track what is used least.
+		h.entries = make(map[string]*staticEntry)
+		h.cached = 0
+	}
+	h.entries[key] = e
+	h.cached += len(e.gzipped)
+}
+
+// etag returns the strong ETag of the file f, hashing it unless it is
+// unchanged since it was last hashed. f is left at its start.
+func (h *staticHandler) etag(name string, f http.File, info fs.FileInfo) (string, error) {
+	if e := h.cachedEntry(name, info); e != nil {
+		return e.etag, nil
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	e := &staticEntry{size: info.Size(), modTime: info.ModTime(), etag: contentETag(hash.Sum(nil))}
+	h.store(name, e)
+	return e.etag, nil
+}
+
+// gzipped returns f compressed with gzip, and its ETag.
+func (h *staticHandler) gzipped(name string, f http.File, info fs.FileInfo) (*staticEntry, error) {
+	key := name + "\x00gzip"
+	if e := h.cachedEntry(key, info); e != nil {
+		return e, nil
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := io.Copy(zw, f); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	e := &staticEntry{size: info.Size(), modTime: info.ModTime(), etag: contentETag(sum[:]), gzipped: buf.Bytes()}
+	h.store(key, e)
+	return e, nil
+}
+
+// contentETag formats a content hash as a strong ETag.
+func contentETag(sum []byte) string {
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
+}
+
+// acceptedEncodings parses an Accept-Encoding header into a function
+// reporting whether a content coding is acceptable, i.e. listed, or
+// covered by "*", with a non-zero quality.
+func acceptedEncodings(header string) func(string) bool {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					quality = f
+				}
+			}
+		}
+		q[coding] = quality
+	}
+	return func(coding string) bool {
+		if v, ok := q[coding]; ok {
+			return v > 0
+		}
+		return q["*"] > 0
+	}
+}
+
+// compressible reports whether content of the media type ctype is worth
+// compressing. Images, archives, fonts in WOFF and media are compressed
+// already.
+func compressible(ctype string) bool {
+	mediaType, _, _ := strings.Cut(ctype, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "application/wasm",
+		"application/x-javascript", "image/x-icon", "image/vnd.microsoft.icon",
+		"image/bmp", "font/ttf", "font/otf", "application/vnd.ms-fontobject":
+		return true
+	}
+	return false
 }
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"bytes"
+	"cheeseburger/config"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeStaticFile(t *testing.T, dir, name, content string, modTime time.Time) {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	out, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	return string(out)
+}
+
+var gzipOnly = http.Header{"Accept-Encoding": {"gzip"}}
+
+func TestStaticHandlerCompression(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Hour)
+	css := strings.Repeat("body { color: #333; }\n", 100)
+	writeStaticFile(t, dir, "style.css", css, modTime)
+	writeStaticFile(t, dir, "small.css", "a{}", modTime)
+	writeStaticFile(t, dir, "logo.png", "\x89PNG\r\n\x1a\n"+strings.Repeat("x", 2000), modTime)
+	h := newStaticHandler(dir, nil)
+
+	rec := get(h, "GET", "/style.css", gzipOnly)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, "text/css; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Less(t, rec.Body.Len(), len(css))
+	assert.Equal(t, css, gunzip(t, rec.Body.Bytes()))
+
+	for name, header := range map[string]http.Header{
+		"no Accept-Encoding": nil,
+		"refused gzip":       {"Accept-Encoding": {"br, gzip;q=0"}},
+	} {
+		rec = get(h, "GET", "/style.css", header)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"), name)
+		assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), name)
+		assert.Equal(t, css, rec.Body.String(), name)
+	}
+
+	rec = get(h, "GET", "/small.css", gzipOnly)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "too small to be worth it")
+	assert.Equal(t, "a{}", rec.Body.String())
+	rec = get(h, "GET", "/logo.png", gzipOnly)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "images are compressed already")
+	assert.Empty(t, rec.Header().Get("Vary"))
+
+	rec = get(h, "GET", "/style.css", http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-9"}})
+	assert.Equal(t, http.StatusPartialContent, rec.Code, "ranges apply to the gzipped bytes")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, 10, rec.Body.Len())
+}
+
+func TestStaticHandlerPrecompressed(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Hour)
+	writeStaticFile(t, dir, "index.html", "<p>hello</p>", modTime)
+	writeStaticFile(t, dir, "index.html.br", "brotli bytes", modTime)
+	writeStaticFile(t, dir, "index.html.gz", "gzip bytes", modTime)
+	writeStaticFile(t, dir, "app.js", "let fresh = true", modTime)
+	writeStaticFile(t, dir, "app.js.br", "stale brotli bytes", modTime.Add(-time.Minute))
+	h := newStaticHandler(dir, nil)
+
+	rec := get(h, "GET", "/", http.Header{"Accept-Encoding": {"gzip, deflate, br"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "br", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, "brotli bytes", rec.Body.String())
+
+	rec = get(h, "GET", "/", http.Header{"Accept-Encoding": {"gzip, br;q=0"}})
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "gzip bytes", rec.Body.String())
+	rec = get(h, "GET", "/", nil)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "<p>hello</p>", rec.Body.String())
+
+	rec = get(h, "GET", "/app.js", http.Header{"Accept-Encoding": {"br"}})
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "a precompressed file older than the original is ignored")
+	assert.Equal(t, "let fresh = true", rec.Body.String())
+
+	rec = get(h, "GET", "/index.html", nil)
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code, "index.html redirects to its directory as with http.FileServer")
+}
+
+func TestStaticHandlerETags(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Hour)
+	content := strings.Repeat("<p>cached</p>\n", 100)
+	writeStaticFile(t, dir, "page.html", content, modTime)
+	h := newStaticHandler(dir, nil)
+
+	plain := get(h, "GET", "/page.html", nil).Header().Get("ETag")
+	gzipped := get(h, "GET", "/page.html", gzipOnly).Header().Get("ETag")
+	assert.Regexp(t, `^"[A-Za-z0-9_-]{24}"$`, plain, "a strong ETag")
+	assert.Regexp(t, `^"[A-Za-z0-9_-]{24}"$`, gzipped)
+	assert.NotEqual(t, plain, gzipped, "each encoding has its own ETag")
+
+	rec := get(h, "GET", "/page.html", http.Header{"If-None-Match": {plain}})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	rec = get(h, "GET", "/page.html", http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {gzipped}})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	rec = get(h, "GET", "/page.html", http.Header{"If-None-Match": {gzipped}})
+	assert.Equal(t, http.StatusOK, rec.Code, "the gzipped ETag does not validate the identity encoding")
+
+	// Another file with the same content has the same ETag, unlike one
+	// derived from the modification time.
+	writeStaticFile(t, dir, "copy.html", content, time.Now())
+	assert.Equal(t, plain, get(h, "GET", "/copy.html", nil).Header().Get("ETag"))
+
+	writeStaticFile(t, dir, "page.html", strings.ToUpper(content), modTime.Add(time.Second))
+	rec = get(h, "GET", "/page.html", http.Header{"If-None-Match": {plain}})
+	assert.Equal(t, http.StatusOK, rec.Code, "a changed file is hashed again")
+	assert.NotEqual(t, plain, rec.Header().Get("ETag"))
+}
+
+func TestStaticHandlerOnClearnet(t *testing.T) {
+	dir := t.TempDir()
+	writeStaticFile(t, dir, "index.html", "<html><head><title>Blog</title></head></html>", time.Now().Add(-time.Hour))
+	var hostname onionHostname
+	hostname.set(testOnion)
+	h := withOnionLocation(newStaticHandler(dir, nil), &hostname)
+
+	rec := get(h, "GET", "/", nil)
+	assert.Contains(t, rec.Body.String(), `<meta http-equiv="onion-location"`)
+	assert.True(t, strings.HasPrefix(rec.Header().Get("ETag"), `W/"`), "the page with the meta tag is only weakly the same")
+}
+
+func TestStaticHandlerCacheControl(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Hour)
+	for _, name := range []string{"index.html", "assets/app.css", "assets/logo.png", "docs/guide.html", "robots.txt"} {
+		writeStaticFile(t, dir, name, "x", modTime)
+	}
+	h := newStaticHandler(dir, []config.CacheRule{
+		{Pattern: "/assets/*", Control: "public, max-age=31536000, immutable"},
+		{Pattern: "*.html", Control: "no-cache"},
+	})
+
+	for target, want := range map[string]string{
+		"/":                "no-cache",
+		"/docs/guide.html": "no-cache",
+		"/assets/app.css":  "public, max-age=31536000, immutable",
+		"/assets/logo.png": "public, max-age=31536000, immutable",
+		"/robots.txt":      "",
+	} {
+		rec := get(h, "GET", target, nil)
+		assert.Equal(t, http.StatusOK, rec.Code, target)
+		assert.Equal(t, want, rec.Header().Get("Cache-Control"), target)
+	}
+
+	rec := get(h, "GET", "/missing.html", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, rec.Header().Get("Cache-Control"), "errors are not cached")
+	rec = get(h, "GET", "/assets", nil)
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code, "directories are left to http.FileServer")
+	rec = get(h, "GET", "/assets/", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "app.css")
+}
+
+func TestParseCacheControlFlags(t *testing.T) {
+	cfg := config.Default()
+	cfg.Serve.Cache = []config.CacheRule{{Pattern: "*", Control: "no-cache"}}
+	opts, err := parseServeFlags(cfg, "serve", nil)
+	require.NoError(t, err)
+	assert.Equal(t, cfg.Serve.Cache, opts.CacheRules)
+
+	opts, err = parseServeFlags(cfg, "serve", []string{
+		"--cache-control", "/assets/*=public, max-age=31536000, immutable",
+		"--cache-control", "*.html=no-cache",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []config.CacheRule{
+		{Pattern: "/assets/*", Control: "public, max-age=31536000, immutable"},
+		{Pattern: "*.html", Control: "no-cache"},
+	}, opts.CacheRules, "flags replace serve.cache")
+
+	for _, arg := range []string{"no-cache", "[a-=no-cache", "*.css="} {
+		_, err = parseServeFlags(cfg, "serve", []string{"--cache-control", arg})
+		assert.Error(t, err, arg)
+	}
+	_, err = parseServeFlags(cfg, "mvc serve", []string{"--cache-control", "*=no-cache"})
+	assert.Error(t, err, "the blog sets its own caching")
+}
+
+func TestAcceptedEncodings(t *testing.T) {
+	accepted := acceptedEncodings("gzip;q=0.5, BR, identity;q=0")
+	assert.True(t, accepted("gzip"))
+	assert.True(t, accepted("br"))
+	assert.False(t, accepted("zstd"))
+
+	accepted = acceptedEncodings("*;q=0.1, gzip;q=0")
+	assert.False(t, accepted("gzip"))
+	assert.True(t, accepted("br"), "covered by *")
+
+	assert.False(t, acceptedEncodings("")("gzip"))
+}
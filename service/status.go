@@ -0,0 +1,450 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tor states reported by cheeseburger status.
+const (
+	torStarting   = "starting"
+	torPublishing = "publishing"
+	torLive       = "live"
+	torRestarting = "restarting"
+	torStopping   = "stopping"
+)
+
+// dbSizer reports the on-disk size of a site's database; *badger.DB
+// implements it.
+type dbSizer interface {
+	Size() (lsm, vlog int64)
+}
+
+// serveStatus collects what cheeseburger status reports about a running
+// serve, mvc serve or up: the state of tor and, per service, its
+// publication, HTTP traffic and database. A nil *serveStatus records
+// nothing.
+type serveStatus struct {
+	started  time.Time
+	services []*onionService
+	http     []*httpStats
+	dbs      []siteDB
+
+	mu        sync.Mutex
+	state     string
+	starts    int
+	lastError string
+	// ctrl is the control connection of the tor being published to, nil
+	// while there is none.
+	ctrl    *torController
+	uploads []descriptorUploads
+}
+
+// siteDB is the database of an MVC site.
+type siteDB struct {
+	path string
+	db   dbSizer
+}
+
+// descriptorUploads tracks the descriptor uploads of one service.
+type descriptorUploads struct {
+	published time.Time
+	count     int
+	last      time.Time
+}
+
+// newServeStatus returns the status of services, which are served from
+// sites.
+func newServeStatus(services []*onionService, sites []site) *serveStatus {
+	s := &serveStatus{
+		started:  time.Now(),
+		services: services,
+		state:    torStarting,
+		uploads:  make([]descriptorUploads, len(services)),
+	}
+	for _, st := range sites {
+		s.http = append(s.http, &httpStats{})
+		s.dbs = append(s.dbs, siteDB{path: st.dbPath, db: st.db})
+	}
+	return s
+}
+
+// torStarting records that tor is being launched or attached to.
+func (s *serveStatus) torStarting() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = torStarting
+	s.starts++
+}
+
+// torConnected records the control connection tor is published over.
+func (s *serveStatus) torConnected(ctrl *torController) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = torPublishing
+	s.ctrl = ctrl
+}
+
+// torLive records that every descriptor has been uploaded.
+func (s *serveStatus) torLive() {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = torLive
+	for i := range s.uploads {
+		s.uploads[i].published = now
+		s.uploads[i].count++
+		s.uploads[i].last = now
+	}
+}
+
+// descriptorUploaded records a further upload of the descriptor of the i-th
+// service.
+func (s *serveStatus) descriptorUploaded(i int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[i].count++
+	s.uploads[i].last = time.Now()
+}
+
+// torDown records that tor stopped serving, because of err if not nil.
+func (s *serveStatus) torDown(state string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	s.ctrl = nil
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	for i := range s.uploads {
+		s.uploads[i].published = time.Time{}
+	}
+}
+
+// instrument counts the requests handled by next for the i-th service.
+func (s *serveStatus) instrument(i int, next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	stats := s.http[i]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		stats.observe(rec.code, time.Since(start))
+	})
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram.
+var latencyBuckets = [...]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// httpStats counts requests by status class and their latency in a
+// histogram of latencyBuckets.
+type httpStats struct {
+	mu sync.Mutex
+	// classes counts 1xx to 5xx responses.
+	classes [5]uint64
+	// buckets[i] counts requests no slower than latencyBuckets[i] but
+	// slower than the previous bound; the last counts the rest.
+	buckets [len(latencyBuckets) + 1]uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *httpStats) observe(code int, d time.Duration) {
+	if code == 0 {
+		// The handler wrote nothing at all.
+		code = http.StatusOK
+	}
+	seconds := d.Seconds()
+	b := sort.SearchFloat64s(latencyBuckets[:], seconds)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c := code/100 - 1; c >= 0 && c < len(h.classes) {
+		h.classes[c]++
+	}
+	h.buckets[b]++
+	h.count++
+	h.sum += seconds
+}
+
+// httpSnapshot is a consistent copy of httpStats.
+type httpSnapshot struct {
+	classes [5]uint64
+	buckets [len(latencyBuckets) + 1]uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *httpStats) snapshot() httpSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return httpSnapshot{classes: h.classes, buckets: h.buckets, count: h.count, sum: h.sum}
+}
+
+// quantile estimates the q-quantile of the latency in seconds, by linear
+// interpolation within the bucket it falls in as Prometheus'
+// histogram_quantile does. Latencies beyond the last bound are reported as
+// that bound.
+func (h httpSnapshot) quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var cum uint64
+	for i, n := range h.buckets {
+		if n == 0 || float64(cum+n) < rank {
+			cum += n
+			continue
+		}
+		if i == len(latencyBuckets) {
+			return latencyBuckets[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		return lower + (latencyBuckets[i]-lower)*(rank-float64(cum))/float64(n)
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// statusReport is the JSON document served at /status.
+type statusReport struct {
+	PID       int             `json:"pid"`
+	Started   time.Time       `json:"started"`
+	Tor       torReport       `json:"tor"`
+	Services  []serviceReport `json:"services"`
+	Generated time.Time       `json:"generated"`
+}
+
+type torReport struct {
+	State string `json:"state"`
+	// Bootstrap is tor's bootstrap progress in percent, -1 if unknown.
+	Bootstrap int    `json:"bootstrap"`
+	Summary   string `json:"summary,omitempty"`
+	Starts    int    `json:"starts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type serviceReport struct {
+	Name              string     `json:"name"`
+	Hostname          string     `json:"hostname,omitempty"`
+	Backend           string     `json:"backend"`
+	Mode              string     `json:"mode"`
+	Published         *time.Time `json:"published,omitempty"`
+	DescriptorUploads int        `json:"descriptor_uploads"`
+	LastUpload        *time.Time `json:"last_upload,omitempty"`
+	// Retiring is the old address of a rotated key, published until
+	// RetiresAt.
+	Retiring  string        `json:"retiring,omitempty"`
+	RetiresAt *time.Time    `json:"retires_at,omitempty"`
+	Circuits  *serviceStats `json:"circuits,omitempty"`
+	Requests  requestReport `json:"requests"`
+	DB        *dbReport     `json:"db,omitempty"`
+
+	// latency is the histogram Requests was computed from.
+	latency httpSnapshot
+}
+
+type requestReport struct {
+	Total uint64            `json:"total"`
+	Codes map[string]uint64 `json:"codes"`
+	// Latency quantiles in seconds.
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+type dbReport struct {
+	Path      string `json:"path"`
+	LSMBytes  int64  `json:"lsm_bytes"`
+	VLogBytes int64  `json:"vlog_bytes"`
+}
+
+// report gathers the current status. Bootstrap progress and circuit counts
+// are asked from tor while it is connected.
+func (s *serveStatus) report() statusReport {
+	s.mu.Lock()
+	rep := statusReport{
+		PID:       os.Getpid(),
+		Started:   s.started,
+		Generated: time.Now(),
+		Tor:       torReport{State: s.state, Bootstrap: -1, Starts: s.starts, LastError: s.lastError},
+	}
+	ctrl := s.ctrl
+	uploads := append([]descriptorUploads(nil), s.uploads...)
+	s.mu.Unlock()
+
+	if ctrl != nil {
+		if progress, summary, err := ctrl.bootstrapProgress(); err == nil {
+			rep.Tor.Bootstrap, rep.Tor.Summary = progress, summary
+		}
+	}
+	for i, svc := range s.services {
+		sr := serviceReport{
+			Name:              svc.name,
+			Hostname:          svc.hostname.get(),
+			Backend:           svc.listener.Addr().String(),
+			Mode:              svc.mode(),
+			DescriptorUploads: uploads[i].count,
+		}
+		if !uploads[i].published.IsZero() {
+			sr.Published = &uploads[i].published
+		}
+		if !uploads[i].last.IsZero() {
+			sr.LastUpload = &uploads[i].last
+		}
+		if svc.retiring.active() {
+			sr.Retiring, sr.RetiresAt = svc.retiring.hostname, &svc.retiring.retireAt
+		}
+		if ctrl != nil && sr.Published != nil {
+			if stats, err := ctrl.serviceStats(strings.TrimSuffix(sr.Hostname, ".onion")); err == nil {
+				sr.Circuits = &stats
+			}
+		}
+		h := s.http[i].snapshot()
+		sr.latency = h
+		sr.Requests = requestReport{Total: h.count, Codes: make(map[string]uint64),
+			P50: h.quantile(0.5), P90: h.quantile(0.9), P99: h.quantile(0.99)}
+		for c, n := range h.classes {
+			sr.Requests.Codes[fmt.Sprintf("%dxx", c+1)] = n
+		}
+		if db := s.dbs[i]; db.db != nil {
+			lsm, vlog := db.db.Size()
+			sr.DB = &dbReport{Path: db.path, LSMBytes: lsm, VLogBytes: vlog}
+		}
+		rep.Services = append(rep.Services, sr)
+	}
+	return rep
+}
+
+// writeMetrics writes the status in the Prometheus text exposition format.
+func (s *serveStatus) writeMetrics(w io.Writer) {
+	rep := s.report()
+	metric := func(name, help, typ string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	states := []string{torStarting, torPublishing, torLive, torRestarting, torStopping}
+
+	metric("cheeseburger_start_time_seconds", "Time cheeseburger started serving.", "gauge")
+	fmt.Fprintf(w, "cheeseburger_start_time_seconds %d\n", rep.Started.Unix())
+	metric("cheeseburger_tor_state", "Current state of tor.", "gauge")
+	for _, state := range states {
+		fmt.Fprintf(w, "cheeseburger_tor_state{state=%q} %d\n", state, boolMetric(rep.Tor.State == state))
+	}
+	metric("cheeseburger_tor_starts_total", "Times tor was launched or attached to.", "counter")
+	fmt.Fprintf(w, "cheeseburger_tor_starts_total %d\n", rep.Tor.Starts)
+	if rep.Tor.Bootstrap >= 0 {
+		metric("cheeseburger_tor_bootstrap_percent", "Bootstrap progress of tor.", "gauge")
+		fmt.Fprintf(w, "cheeseburger_tor_bootstrap_percent %d\n", rep.Tor.Bootstrap)
+	}
+
+	metric("cheeseburger_onion_published", "Whether the descriptor of the onion service is published.", "gauge")
+	for _, sr := range rep.Services {
+		fmt.Fprintf(w, "cheeseburger_onion_published{service=%q} %d\n", sr.Name, boolMetric(sr.Published != nil))
+	}
+	metric("cheeseburger_onion_descriptor_uploads_total", "Descriptor uploads to HSDirs.", "counter")
+	for _, sr := range rep.Services {
+		fmt.Fprintf(w, "cheeseburger_onion_descriptor_uploads_total{service=%q} %d\n", sr.Name, sr.DescriptorUploads)
+	}
+	metric("cheeseburger_onion_last_descriptor_upload_seconds", "Time of the last descriptor upload.", "gauge")
+	for _, sr := range rep.Services {
+		if sr.LastUpload != nil {
+			fmt.Fprintf(w, "cheeseburger_onion_last_descriptor_upload_seconds{service=%q} %d\n", sr.Name, sr.LastUpload.Unix())
+		}
+	}
+	metric("cheeseburger_onion_circuits", "Open circuits of the onion service by purpose.", "gauge")
+	for _, sr := range rep.Services {
+		if c := sr.Circuits; c != nil {
+			fmt.Fprintf(w, "cheeseburger_onion_circuits{service=%q,purpose=\"intro\"} %d\n", sr.Name, c.IntroCircuits)
+			fmt.Fprintf(w, "cheeseburger_onion_circuits{service=%q,purpose=\"rend\"} %d\n", sr.Name, c.RendCircuits)
+		}
+	}
+	metric("cheeseburger_onion_streams", "Open streams of the onion service.", "gauge")
+	for _, sr := range rep.Services {
+		if c := sr.Circuits; c != nil {
+			fmt.Fprintf(w, "cheeseburger_onion_streams{service=%q} %d\n", sr.Name, c.Streams)
+		}
+	}
+
+	metric("cheeseburger_http_requests_total", "HTTP requests by status class.", "counter")
+	for _, sr := range rep.Services {
+		for c := 1; c <= 5; c++ {
+			code := fmt.Sprintf("%dxx", c)
+			fmt.Fprintf(w, "cheeseburger_http_requests_total{service=%q,code=%q} %d\n", sr.Name, code, sr.Requests.Codes[code])
+		}
+	}
+	metric("cheeseburger_http_request_duration_seconds", "Latency of HTTP requests.", "histogram")
+	for _, sr := range rep.Services {
+		h := sr.latency
+		var cum uint64
+		for b, bound := range latencyBuckets {
+			cum += h.buckets[b]
+			fmt.Fprintf(w, "cheeseburger_http_request_duration_seconds_bucket{service=%q,le=\"%g\"} %d\n", sr.Name, bound, cum)
+		}
+		fmt.Fprintf(w, "cheeseburger_http_request_duration_seconds_bucket{service=%q,le=\"+Inf\"} %d\n", sr.Name, h.count)
+		fmt.Fprintf(w, "cheeseburger_http_request_duration_seconds_sum{service=%q} %g\n", sr.Name, h.sum)
+		fmt.Fprintf(w, "cheeseburger_http_request_duration_seconds_count{service=%q} %d\n", sr.Name, h.count)
+	}
+
+	metric("cheeseburger_db_size_bytes", "On-disk size of the database by part.", "gauge")
+	for _, sr := range rep.Services {
+		if sr.DB != nil {
+			fmt.Fprintf(w, "cheeseburger_db_size_bytes{service=%q,part=\"lsm\"} %d\n", sr.Name, sr.DB.LSMBytes)
+			fmt.Fprintf(w, "cheeseburger_db_size_bytes{service=%q,part=\"vlog\"} %d\n", sr.Name, sr.DB.VLogBytes)
+		}
+	}
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bytes"
+	"cheeseburger/config"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPStatsQuantile(t *testing.T) {
+	var h httpStats
+	assert.Zero(t, h.snapshot().quantile(0.5))
+	for i := 0; i < 90; i++ {
+		h.observe(http.StatusOK, 3*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(http.StatusInternalServerError, 30*time.Second)
+	}
+	snap := h.snapshot()
+	assert.Equal(t, uint64(100), snap.count)
+	assert.Equal(t, [5]uint64{0, 90, 0, 0, 10}, snap.classes)
+	p50 := snap.quantile(0.5)
+	assert.True(t, p50 > 0.0025 && p50 <= 0.005, "p50 %g falls in the 5ms bucket", p50)
+	assert.Equal(t, 10.0, snap.quantile(0.99), "latencies beyond the last bucket report its bound")
+}
+
+type fakeDB struct{}
+
+func (fakeDB) Size() (int64, int64) { return 1 << 20, 3 << 20 }
+
+func TestServeStatusReport(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	svc := &onionService{name: "blog", ephemeral: true, listener: ln}
+	status := newServeStatus([]*onionService{svc}, []site{{dbPath: "data/badger", db: fakeDB{}}})
+
+	h := status.instrument(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+		}
+	}))
+	for _, path := range []string{"/", "/", "/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	rep := status.report()
+	assert.Equal(t, torStarting, rep.Tor.State)
+	assert.Equal(t, -1, rep.Tor.Bootstrap, "unknown without a control connection")
+	require.Len(t, rep.Services, 1)
+	sr := rep.Services[0]
+	assert.Nil(t, sr.Published)
+	assert.Equal(t, "ephemeral", sr.Mode)
+	assert.Equal(t, uint64(3), sr.Requests.Total)
+	assert.Equal(t, uint64(2), sr.Requests.Codes["2xx"])
+	assert.Equal(t, uint64(1), sr.Requests.Codes["4xx"])
+	assert.Equal(t, &dbReport{Path: "data/badger", LSMBytes: 1 << 20, VLogBytes: 3 << 20}, sr.DB)
+
+	svc.hostname.set(testOnion)
+	status.torLive()
+	status.descriptorUploaded(0)
+	rep = status.report()
+	assert.Equal(t, torLive, rep.Tor.State)
+	assert.NotNil(t, rep.Services[0].Published)
+	assert.Equal(t, 2, rep.Services[0].DescriptorUploads)
+
+	var metrics bytes.Buffer
+	status.writeMetrics(&metrics)
+	for _, line := range []string{
+		`cheeseburger_tor_state{state="live"} 1`,
+		`cheeseburger_onion_published{service="blog"} 1`,
+		`cheeseburger_onion_descriptor_uploads_total{service="blog"} 2`,
+		`cheeseburger_http_requests_total{service="blog",code="4xx"} 1`,
+		`cheeseburger_http_request_duration_seconds_bucket{service="blog",le="+Inf"} 3`,
+		`cheeseburger_http_request_duration_seconds_count{service="blog"} 3`,
+		`cheeseburger_db_size_bytes{service="blog",part="vlog"} 3145728`,
+	} {
+		assert.Contains(t, metrics.String(), line+"\n")
+	}
+
+	status.torDown(torRestarting, os.ErrClosed)
+	rep = status.report()
+	assert.Equal(t, torRestarting, rep.Tor.State)
+	assert.Nil(t, rep.Services[0].Published)
+	assert.Equal(t, os.ErrClosed.Error(), rep.Tor.LastError)
+}
+
+func TestListenAdmin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := listenAdmin(path)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, err = listenAdmin(path)
+	assert.ErrorContains(t, err, "already serving status", "a live socket is never taken over")
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, err = listenAdmin(path)
+	require.NoError(t, err, "a stale socket is replaced")
+	ln.Close()
+}
+
+func TestRunStatusOverFakeTor(t *testing.T) {
+	f := useFakeTor(t)
+	cfg := config.Default()
+
+	var code int
+	out := captureOutput(func() { code = RunStatus(cfg, nil) })
+	assert.Equal(t, 1, code)
+	assert.Contains(t, out, "is it serving?")
+
+	done := startServing(func() { RunAppServer(cfg, []string{"--ephemeral"}) })
+	id := f.waitForUploads(t, 1)[0]
+	resp, _ := getOnion(t, f, "http://"+id+".onion/no-such-page")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// The supervisor marks the service live just after the upload.
+	require.Eventually(t, func() bool {
+		captureOutput(func() { code = RunStatus(cfg, nil) })
+		return code == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	out = captureOutput(func() { code = RunStatus(cfg, []string{"--json"}) })
+	assert.Equal(t, 0, code)
+	var rep statusReport
+	require.NoError(t, json.Unmarshal([]byte(out), &rep))
+	assert.Equal(t, os.Getpid(), rep.PID)
+	assert.Equal(t, 100, rep.Tor.Bootstrap)
+	require.Len(t, rep.Services, 1)
+	sr := rep.Services[0]
+	assert.Equal(t, id+".onion", sr.Hostname)
+	assert.NotNil(t, sr.Published)
+	assert.Equal(t, &serviceStats{IntroCircuits: 3}, sr.Circuits)
+	assert.Equal(t, uint64(1), sr.Requests.Codes["4xx"])
+	if assert.NotNil(t, sr.DB) {
+		assert.Equal(t, cfg.Paths.DB, sr.DB.Path)
+	}
+
+	out = captureOutput(func() { code = RunStatus(cfg, nil) })
+	assert.Contains(t, out, "Tor:      live, bootstrapped 100% (Done)")
+	assert.Contains(t, out, "circuits:    3 introduction, 0 clients, 0 streams")
+	assert.Contains(t, out, "requests:    1 (4xx 1)")
+
+	out = captureOutput(func() { code = RunStatus(cfg, []string{"--prometheus"}) })
+	assert.Equal(t, 0, code)
+	assert.True(t, strings.HasPrefix(out, "# HELP "), out)
+	assert.Contains(t, out, `cheeseburger_onion_circuits{service="default",purpose="intro"} 3`)
+
+	stopServing(t, done)
+	assert.NoFileExists(t, cfg.Paths.AdminSocket)
+}
@@ -0,0 +1,12 @@
+package service
+
+import "syscall"
+
+// torSysProcAttr runs tor in its own process group, so a Ctrl+C in the
+// terminal reaches only cheeseburger, which then stops tor in order. The
+// parent death signal makes sure tor does not outlive a crashed
+// cheeseburger. It is sent when the thread that started tor exits, so that
+// thread must stay locked until tor has exited.
+func torSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGTERM}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package service
+
+import "syscall"
+
+// torSysProcAttr returns the default process attributes on platforms
+// without parent death signals.
+func torSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
@@ -1,8 +1,174 @@
 package service
 
 import (
+	"bytes"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
 )
 
 //go:embed tor-bins/tor-linux-x86_64
 var torBinary []byte
+
+// controlPasswordEnv holds the control port password of an external tor
+// attached to with --tor-control, for daemons using HashedControlPassword.
+const controlPasswordEnv = "CHEESEBURGER_TOR_CONTROL_PASSWORD"
+
+// torEnv is the environment tor runs with: ours without the CHEESEBURGER_*
+// variables, which carry secrets such as the key passphrase and the control
+// password.
+func torEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "CHEESEBURGER_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// torCacheDir overrides where the embedded tor binary is extracted to. It
+// is a variable so tests can point it at a temporary directory.
+var torCacheDir = ""
+
+// torLauncher starts tor for a torSupervisor. execTorLauncher runs a real
+// tor binary; tests substitute an in-process fake.
+type torLauncher interface {
+	// verify checks the torrc at path without starting tor.
+	verify(torrc string) error
+	// launch starts tor with the torrc at path. The exited channel of the
+	// returned process is closed once tor has exited.
+	launch(torrc string) (*torProcess, error)
+}
+
+// newTorLauncher returns the launcher for the tor binary chosen with
+// --tor-path, or the embedded one. It is a variable so tests can replace
+// tor with a fake.
+var newTorLauncher = func(torPath string) (torLauncher, error) {
+	binary, err := resolveTorBinary(torPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using tor binary: %s", binary)
+	return execTorLauncher{binary: binary}, nil
+}
+
+// execTorLauncher runs the tor executable at binary, with its output going
+// to ours.
+type execTorLauncher struct {
+	binary string
+}
+
+func (l execTorLauncher) verify(torrc string) error {
+	return verifyTorrc(l.binary, torrc)
+}
+
+func (l execTorLauncher) launch(torrc string) (*torProcess, error) {
+	cmd := exec.Command(l.binary, "-f", torrc)
+	cmd.Env = torEnv()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = torSysProcAttr()
+	t := &torProcess{exited: make(chan struct{})}
+	started := make(chan error)
+	go func() {
+		// The parent death signal fires when the thread that started tor
+		// exits, not the process, so that thread is kept until tor exits.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if err := cmd.Start(); err != nil {
+			started <- err
+			return
+		}
+		t.signal = cmd.Process.Signal
+		started <- nil
+		t.err = cmd.Wait()
+		close(t.exited)
+	}()
+	if err := <-started; err != nil {
+		return nil, fmt.Errorf("failed to start tor process: %v", err)
+	}
+	return t, nil
+}
+
+// resolveTorBinary returns the tor executable to run: torPath looked up in
+// $PATH if given, otherwise the cached copy of the embedded binary.
+func resolveTorBinary(torPath string) (string, error) {
+	if torPath == "" {
+		return extractTorBinary()
+	}
+	path, err := exec.LookPath(torPath)
+	if err != nil {
+		return "", fmt.Errorf("tor binary %s not found: %v", torPath, err)
+	}
+	return filepath.Abs(path)
+}
+
+// extractTorBinary writes the embedded tor binary to the user's cache
+// directory, named after its SHA-256, and returns its path. An existing copy
+// is reused only if its contents still hash to the embedded binary's sum,
+// so a truncated or tampered file is replaced rather than executed.
+func extractTorBinary() (string, error) {
+	dir := torCacheDir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("no cache directory for the tor binary: %v", err)
+		}
+		dir = filepath.Join(cache, "cheeseburger")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create tor cache directory: %v", err)
+	}
+
+	sum := sha256.Sum256(torBinary)
+	path := filepath.Join(dir, "tor-"+hex.EncodeToString(sum[:8]))
+	if ok, err := fileHasSHA256(path, sum[:]); err == nil && ok {
+		return path, nil
+	}
+
+	// Write to a temporary name and rename, so a concurrent cheeseburger
+	// never executes a partially written binary.
+	f, err := os.CreateTemp(dir, ".tor-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to extract tor binary: %v", err)
+	}
+	tmp := f.Name()
+	_, err = f.Write(torBinary)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0700)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to extract tor binary: %v", err)
+	}
+	return path, nil
+}
+
+// fileHasSHA256 reports whether the file at path hashes to sum.
+func fileHasSHA256(path string, sum []byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return bytes.Equal(h.Sum(nil), sum), nil
+}
@@ -0,0 +1,580 @@
+package service
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// controlReply is a single reply (or asynchronous event) read from the Tor
+// control port. Lines holds the text of every reply line with the status
+// code and separator stripped; data blocks ("250+key=") are folded into the
+// line that introduced them, separated by newlines.
+type controlReply struct {
+	Code  int
+	Lines []string
+}
+
+// torController is a minimal client for the Tor control protocol
+// (https://spec.torproject.org/control-spec). Commands are serialised;
+// asynchronous 650 events are delivered on the events channel.
+type torController struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	replies chan *controlReply
+	events  chan *controlReply
+	done    chan struct{}
+	closing chan struct{}
+	once    sync.Once
+	err     error
+}
+
+// dialController connects to a Tor control port at addr, either host:port
+// or unix:/path for a ControlSocket.
+func dialController(addr string) (*torController, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to control port %s: %v", addr, err)
+	}
+	return newController(conn), nil
+}
+
+// newController wraps an established control connection and starts the
+// reader goroutine.
+func newController(conn net.Conn) *torController {
+	c := &torController{
+		conn:    conn,
+		replies: make(chan *controlReply),
+		events:  make(chan *controlReply, 256),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop splits the incoming stream into synchronous replies and
+// asynchronous events. Events are dropped if nobody is consuming them so
+// that a slow consumer can never stall command replies.
+func (c *torController) readLoop() {
+	defer close(c.done)
+	r := bufio.NewReader(c.conn)
+	for {
+		reply, err := readControlReply(r)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if reply.Code == 650 {
+			select {
+			case c.events <- reply:
+			default:
+			}
+			continue
+		}
+		select {
+		case c.replies <- reply:
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+// readControlReply reads one complete (possibly multi-line) reply.
+func readControlReply(r *bufio.Reader) (*controlReply, error) {
+	reply := &controlReply{}
+	for {
+		line, err := readControlLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed control reply line: %q", line)
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed control reply code: %q", line)
+		}
+		reply.Code = code
+		sep, text := line[3], line[4:]
+		switch sep {
+		case ' ':
+			reply.Lines = append(reply.Lines, text)
+			return reply, nil
+		case '-':
+			reply.Lines = append(reply.Lines, text)
+		case '+':
+			var data []string
+			for {
+				dl, err := readControlLine(r)
+				if err != nil {
+					return nil, err
+				}
+				if dl == "." {
+					break
+				}
+				data = append(data, strings.TrimPrefix(dl, "."))
+			}
+			reply.Lines = append(reply.Lines, text+strings.Join(data, "\n"))
+		default:
+			return nil, fmt.Errorf("malformed control reply separator: %q", line)
+		}
+	}
+}
+
+func readControlLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// command sends a single command line and waits for its reply. Any status
+// other than 250 is returned as an error.
+func (c *torController) command(line string) (*controlReply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", line); err != nil {
+		return nil, fmt.Errorf("failed to send control command: %v", err)
+	}
+	select {
+	case reply := <-c.replies:
+		if reply.Code != 250 {
+			return reply, fmt.Errorf("control command %q failed: %d %s",
+				strings.Fields(line)[0], reply.Code, strings.Join(reply.Lines, " "))
+		}
+		return reply, nil
+	case <-c.done:
+		return nil, fmt.Errorf("control connection closed: %v", c.err)
+	}
+}
+
+// authenticate performs PROTOCOLINFO and then AUTHENTICATE with the cookie
+// advertised by tor, through the SAFECOOKIE challenge if tor does not take
+// the plain COOKIE. cookiePath is used when tor does not report one. If
+// the cookie cannot be used and tor accepts a password, password is tried.
+func (c *torController) authenticate(cookiePath, password string) error {
+	reply, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	var methods []string
+	for _, line := range reply.Lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		fields := parseControlKeywords(strings.TrimPrefix(line, "AUTH "))
+		methods = strings.Split(fields["METHODS"], ",")
+		if f := fields["COOKIEFILE"]; f != "" {
+			cookiePath = f
+		}
+	}
+
+	supports := func(names ...string) bool {
+		for _, m := range methods {
+			for _, n := range names {
+				if m == n {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if supports("NULL") {
+		_, err := c.command("AUTHENTICATE")
+		return err
+	}
+	var cookieErr error
+	if supports("COOKIE", "SAFECOOKIE") {
+		cookie, err := os.ReadFile(cookiePath)
+		switch {
+		case err != nil:
+			cookieErr = fmt.Errorf("failed to read control auth cookie: %v", err)
+		case supports("COOKIE"):
+			_, err = c.command("AUTHENTICATE " + hex.EncodeToString(cookie))
+			return err
+		default:
+			return c.authenticateSafeCookie(cookie)
+		}
+	}
+	if supports("HASHEDPASSWORD") && password != "" {
+		_, err := c.command("AUTHENTICATE " + quoteControlString(password))
+		return err
+	}
+	if cookieErr != nil {
+		return cookieErr
+	}
+	if supports("HASHEDPASSWORD") {
+		return fmt.Errorf("tor requires a control port password; set %s", controlPasswordEnv)
+	}
+	return fmt.Errorf("no supported control port authentication method in %v", methods)
+}
+
+// Keys of the SAFECOOKIE HMACs, from the control spec.
+const (
+	safeCookieServerKey     = "Tor safe cookie authentication server-to-controller hash"
+	safeCookieControllerKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// authenticateSafeCookie proves knowledge of the cookie with the
+// AUTHCHALLENGE exchange, after checking that tor knows it too.
+func (c *torController) authenticateSafeCookie(cookie []byte) error {
+	clientNonce := make([]byte, 32)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+	reply, err := c.command("AUTHCHALLENGE SAFECOOKIE " + hex.EncodeToString(clientNonce))
+	if err != nil {
+		return err
+	}
+	if len(reply.Lines) == 0 {
+		return fmt.Errorf("malformed AUTHCHALLENGE reply")
+	}
+	fields := parseControlKeywords(strings.TrimPrefix(reply.Lines[0], "AUTHCHALLENGE "))
+	serverHash, err := hex.DecodeString(fields["SERVERHASH"])
+	if err != nil {
+		return fmt.Errorf("malformed AUTHCHALLENGE reply: %q", reply.Lines[0])
+	}
+	serverNonce, err := hex.DecodeString(fields["SERVERNONCE"])
+	if err != nil || len(serverNonce) == 0 {
+		return fmt.Errorf("malformed AUTHCHALLENGE reply: %q", reply.Lines[0])
+	}
+	message := append(append(append([]byte(nil), cookie...), clientNonce...), serverNonce...)
+	if !hmac.Equal(serverHash, safeCookieHMAC(safeCookieServerKey, message)) {
+		return fmt.Errorf("tor does not know the control auth cookie; is this the right control port?")
+	}
+	_, err = c.command("AUTHENTICATE " + hex.EncodeToString(safeCookieHMAC(safeCookieControllerKey, message)))
+	return err
+}
+
+func safeCookieHMAC(key string, message []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// quoteControlString quotes s as a control protocol QuotedString.
+func quoteControlString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", `\r`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// getInfo issues GETINFO for the given keys and returns their values.
+func (c *torController) getInfo(keys ...string) (map[string]string, error) {
+	reply, err := c.command("GETINFO " + strings.Join(keys, " "))
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, line := range reply.Lines {
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		values[k] = strings.TrimPrefix(v, "\n")
+	}
+	return values, nil
+}
+
+// setEvents subscribes to the given asynchronous events, replacing any
+// previous subscription. Calling it with no events unsubscribes.
+func (c *torController) setEvents(events ...string) error {
+	_, err := c.command(strings.TrimSpace("SETEVENTS " + strings.Join(events, " ")))
+	return err
+}
+
+// onionOptions are the optional arguments of ADD_ONION: flags such as
+// DiscardPK, KEY=VALUE parameters such as MaxStreams=N, and the base32
+// x25519 public keys of authorized clients.
+type onionOptions struct {
+	Flags      []string
+	Params     []string
+	ClientAuth []string
+}
+
+// addOnion creates an ephemeral onion service with ADD_ONION and returns its
+// service ID (the onion address without ".onion"). keySpec is either
+// "NEW:ED25519-V3" or "ED25519-V3:<base64 expanded secret key>"; ports are
+// "virtport,target" mappings. If opts.ClientAuth is not empty only those
+// clients can reach the service.
+func (c *torController) addOnion(keySpec string, ports []string, opts onionOptions) (string, error) {
+	flags := opts.Flags
+	if len(opts.ClientAuth) > 0 {
+		flags = append(flags[:len(flags):len(flags)], "V3Auth")
+	}
+	cmd := "ADD_ONION " + keySpec
+	if len(flags) > 0 {
+		cmd += " Flags=" + strings.Join(flags, ",")
+	}
+	for _, p := range opts.Params {
+		cmd += " " + p
+	}
+	for _, p := range ports {
+		cmd += " Port=" + p
+	}
+	for _, k := range opts.ClientAuth {
+		cmd += " ClientAuthV3=" + k
+	}
+	reply, err := c.command(cmd)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range reply.Lines {
+		if id, ok := strings.CutPrefix(line, "ServiceID="); ok {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("ADD_ONION reply did not include a ServiceID")
+}
+
+// delOnion removes an ephemeral onion service created by addOnion.
+func (c *torController) delOnion(serviceID string) error {
+	_, err := c.command("DEL_ONION " + serviceID)
+	return err
+}
+
+// serviceStats is a snapshot of the circuits and streams of one onion
+// service.
+type serviceStats struct {
+	// IntroCircuits are established introduction point circuits.
+	IntroCircuits int `json:"intro"`
+	// RendCircuits are joined rendezvous circuits, one per connected
+	// client.
+	RendCircuits int `json:"rend"`
+	// Streams are the open streams on those rendezvous circuits.
+	Streams int `json:"streams"`
+}
+
+// serviceStats counts the circuits and streams of the onion service
+// serviceID (without ".onion") from tor's circuit-status and stream-status.
+func (c *torController) serviceStats(serviceID string) (serviceStats, error) {
+	var stats serviceStats
+	info, err := c.getInfo("circuit-status", "stream-status")
+	if err != nil {
+		return stats, err
+	}
+	rend := make(map[string]bool)
+	for _, line := range strings.Split(info["circuit-status"], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != "BUILT" {
+			continue
+		}
+		kw := parseControlKeywords(line)
+		if kw["REND_QUERY"] != serviceID {
+			continue
+		}
+		switch kw["PURPOSE"] {
+		case "HS_SERVICE_INTRO":
+			stats.IntroCircuits++
+		case "HS_SERVICE_REND":
+			stats.RendCircuits++
+			rend[fields[0]] = true
+		}
+	}
+	for _, line := range strings.Split(info["stream-status"], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && rend[fields[2]] {
+			stats.Streams++
+		}
+	}
+	return stats, nil
+}
+
+// close closes the control connection.
+func (c *torController) close() error {
+	c.once.Do(func() { close(c.closing) })
+	return c.conn.Close()
+}
+
+// parseControlKeywords parses space separated KEY=VALUE pairs, honouring
+// double-quoted values. Bare words are returned with an empty value.
+func parseControlKeywords(s string) map[string]string {
+	out := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			break
+		}
+		end := strings.IndexAny(s, " =")
+		if end < 0 {
+			out[s] = ""
+			break
+		}
+		key := s[:end]
+		if s[end] == ' ' {
+			out[key] = ""
+			s = s[end:]
+			continue
+		}
+		s = s[end+1:]
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			out[key] = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+			continue
+		}
+		if sp := strings.IndexByte(s, ' '); sp >= 0 {
+			out[key] = s[:sp]
+			s = s[sp:]
+		} else {
+			out[key] = s
+			s = ""
+		}
+	}
+	return out
+}
+
+// bootstrapProgress returns tor's current bootstrap percentage and summary.
+func (c *torController) bootstrapProgress() (int, string, error) {
+	info, err := c.getInfo("status/bootstrap-phase")
+	if err != nil {
+		return 0, "", err
+	}
+	fields := parseControlKeywords(info["status/bootstrap-phase"])
+	progress, err := strconv.Atoi(fields["PROGRESS"])
+	if err != nil {
+		return 0, "", fmt.Errorf("unexpected bootstrap phase: %q", info["status/bootstrap-phase"])
+	}
+	return progress, fields["SUMMARY"], nil
+}
+
+// socksListeners returns the addresses tor accepts SOCKS connections on,
+// "host:port" or "unix:/path"; none if its SOCKS port is disabled.
+func (c *torController) socksListeners() ([]string, error) {
+	info, err := c.getInfo("net/listeners/socks")
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, field := range strings.Fields(info["net/listeners/socks"]) {
+		if addr, err := strconv.Unquote(field); err == nil {
+			field = addr
+		}
+		addrs = append(addrs, field)
+	}
+	return addrs, nil
+}
+
+// waitForBootstrap polls tor until it reports 100% bootstrap, logging each
+// change in progress. It fails if the timeout expires or exited is closed.
+func (c *torController) waitForBootstrap(timeout time.Duration, exited <-chan struct{}, logf func(string, ...interface{})) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	last := -1
+	for {
+		progress, summary, err := c.bootstrapProgress()
+		if err != nil {
+			return err
+		}
+		if progress != last {
+			logf("Tor bootstrap %d%%: %s", progress, summary)
+			last = progress
+		}
+		if progress >= 100 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return fmt.Errorf("tor did not finish bootstrapping within %s (stuck at %d%%)", timeout, last)
+		case <-exited:
+			return fmt.Errorf("tor exited while bootstrapping")
+		}
+	}
+}
+
+// waitForDescriptorUploads waits for an HS_DESC UPLOADED event for each of
+// the given onion addresses. The caller must have subscribed to HS_DESC
+// events before the descriptors could have been published.
+func (c *torController) waitForDescriptorUploads(onionAddrs []string, timeout time.Duration, exited <-chan struct{}, logf func(string, ...interface{})) error {
+	pending := make(map[string]bool)
+	for _, a := range onionAddrs {
+		pending[strings.TrimSuffix(strings.TrimSpace(a), ".onion")] = true
+	}
+	deadline := time.After(timeout)
+	for len(pending) > 0 {
+		select {
+		case ev := <-c.events:
+			fields := strings.Fields(strings.Join(ev.Lines, " "))
+			if len(fields) < 3 || fields[0] != "HS_DESC" || !pending[fields[2]] {
+				continue
+			}
+			switch fields[1] {
+			case "UPLOADED":
+				delete(pending, fields[2])
+			case "FAILED":
+				logf("Descriptor upload to an HSDir failed: %s", strings.Join(fields[3:], " "))
+			}
+		case <-deadline:
+			return fmt.Errorf("onion service descriptor was not published within %s", timeout)
+		case <-exited:
+			return fmt.Errorf("tor exited before the descriptor was published")
+		case <-c.done:
+			return fmt.Errorf("control connection closed: %v", c.err)
+		}
+	}
+	return nil
+}
+
+// waitForFile polls until path exists and is non-empty, returning its
+// contents. It gives up when the timeout expires or exited is closed.
+func waitForFile(path string, timeout time.Duration, exited <-chan struct{}) ([]byte, error) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if data, err := os.ReadFile(path); err == nil && len(data) > 0 {
+			return data, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return nil, fmt.Errorf("%s was not written within %s", filepath.Base(path), timeout)
+		case <-exited:
+			return nil, fmt.Errorf("tor exited before writing %s", filepath.Base(path))
+		}
+	}
+}
+
+// readControlPortFile waits for tor to write its ControlPortWriteToFile
+// file and returns the address it contains.
+func readControlPortFile(path string, timeout time.Duration, exited <-chan struct{}) (string, error) {
+	data, err := waitForFile(path, timeout, exited)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if addr, ok := strings.CutPrefix(strings.TrimSpace(line), "PORT="); ok {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("no control port address in %s", path)
+}
@@ -0,0 +1,360 @@
+package service
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedControlPort answers control commands from a fixed table. Each
+// command received is recorded so tests can assert on what was sent.
+type scriptedControlPort struct {
+	conn     net.Conn
+	respond  func(cmd string) []string
+	received chan string
+}
+
+func newScriptedController(t *testing.T, answers map[string][]string) (*torController, *scriptedControlPort) {
+	return newRespondingController(t, func(cmd string) []string { return answers[cmd] })
+}
+
+func newRespondingController(t *testing.T, respond func(cmd string) []string) (*torController, *scriptedControlPort) {
+	client, server := net.Pipe()
+	s := &scriptedControlPort{conn: server, respond: respond, received: make(chan string, 32)}
+	go s.serve()
+	ctrl := newController(client)
+	t.Cleanup(func() {
+		ctrl.close()
+		server.Close()
+	})
+	return ctrl, s
+}
+
+func (s *scriptedControlPort) serve() {
+	r := bufio.NewReader(s.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		s.received <- line
+		answer := s.respond(line)
+		if answer == nil {
+			answer = []string{"510 Unrecognized command"}
+		}
+		for _, a := range answer {
+			if _, err := s.conn.Write([]byte(a + "\r\n")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *scriptedControlPort) send(lines ...string) {
+	for _, l := range lines {
+		s.conn.Write([]byte(l + "\r\n"))
+	}
+}
+
+func TestReadControlReply(t *testing.T) {
+	raw := "250-version=0.4.8.13\r\n" +
+		"250+config-text=\r\nSocksPort 0\r\n..leading dot\r\n.\r\n" +
+		"250 OK\r\n"
+	reply, err := readControlReply(bufio.NewReader(strings.NewReader(raw)))
+	require.NoError(t, err)
+	assert.Equal(t, 250, reply.Code)
+	assert.Equal(t, []string{"version=0.4.8.13", "config-text=SocksPort 0\n.leading dot", "OK"}, reply.Lines)
+
+	_, err = readControlReply(bufio.NewReader(strings.NewReader("25\r\n")))
+	assert.Error(t, err)
+}
+
+func TestParseControlKeywords(t *testing.T) {
+	fields := parseControlKeywords(`NOTICE BOOTSTRAP PROGRESS=85 TAG=ap_conn SUMMARY="Connecting to a relay \"x\""`)
+	assert.Equal(t, "85", fields["PROGRESS"])
+	assert.Equal(t, "ap_conn", fields["TAG"])
+	assert.Equal(t, `Connecting to a relay "x"`, fields["SUMMARY"])
+	assert.Contains(t, fields, "BOOTSTRAP")
+}
+
+func TestControllerAuthenticateWithCookie(t *testing.T) {
+	cookie := filepath.Join(t.TempDir(), "control_auth_cookie")
+	require.NoError(t, os.WriteFile(cookie, []byte{0xde, 0xad, 0xbe, 0xef}, 0600))
+
+	ctrl, port := newScriptedController(t, map[string][]string{
+		"PROTOCOLINFO 1": {
+			"250-PROTOCOLINFO 1",
+			`250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE="` + cookie + `"`,
+			`250-VERSION Tor="0.4.8.13"`,
+			"250 OK",
+		},
+		"AUTHENTICATE deadbeef": {"250 OK"},
+	})
+
+	require.NoError(t, ctrl.authenticate("/nonexistent", ""))
+	assert.Equal(t, "PROTOCOLINFO 1", <-port.received)
+	assert.Equal(t, "AUTHENTICATE deadbeef", <-port.received)
+}
+
+func TestControllerAuthenticateWithSafeCookie(t *testing.T) {
+	cookie := []byte{0xde, 0xad, 0xbe, 0xef}
+	cookieFile := filepath.Join(t.TempDir(), "control_auth_cookie")
+	require.NoError(t, os.WriteFile(cookieFile, cookie, 0600))
+	serverNonce := []byte("server nonce")
+
+	for name, tc := range map[string]struct {
+		serverCookie []byte
+		err          string
+	}{
+		"tor knows the cookie": {serverCookie: cookie},
+		"tor does not":         {serverCookie: []byte("other"), err: "does not know the control auth cookie"},
+	} {
+		var controllerHash string
+		ctrl, port := newRespondingController(t, func(cmd string) []string {
+			switch {
+			case cmd == "PROTOCOLINFO 1":
+				return []string{"250-PROTOCOLINFO 1", `250-AUTH METHODS=SAFECOOKIE COOKIEFILE="` + cookieFile + `"`, "250 OK"}
+			case strings.HasPrefix(cmd, "AUTHCHALLENGE SAFECOOKIE "):
+				clientNonce, err := hex.DecodeString(strings.TrimPrefix(cmd, "AUTHCHALLENGE SAFECOOKIE "))
+				if err != nil || len(clientNonce) != 32 {
+					return []string{"513 Invalid base16 client nonce"}
+				}
+				message := append(append(append([]byte(nil), tc.serverCookie...), clientNonce...), serverNonce...)
+				controllerHash = hex.EncodeToString(safeCookieHMAC(safeCookieControllerKey, message))
+				return []string{fmt.Sprintf("250 AUTHCHALLENGE SERVERHASH=%X SERVERNONCE=%X",
+					safeCookieHMAC(safeCookieServerKey, message), serverNonce)}
+			case cmd == "AUTHENTICATE "+controllerHash:
+				return []string{"250 OK"}
+			}
+			return []string{"515 Authentication failed"}
+		})
+
+		err := ctrl.authenticate("", "")
+		assert.Equal(t, "PROTOCOLINFO 1", <-port.received, name)
+		assert.Contains(t, <-port.received, "AUTHCHALLENGE SAFECOOKIE ", name)
+		if tc.err != "" {
+			assert.ErrorContains(t, err, tc.err, name)
+			continue
+		}
+		require.NoError(t, err, name)
+		assert.Equal(t, "AUTHENTICATE "+controllerHash, <-port.received, name)
+	}
+}
+
+func TestControllerCommandError(t *testing.T) {
+	ctrl, _ := newScriptedController(t, map[string][]string{})
+	_, err := ctrl.command("GETINFO nope")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "510")
+}
+
+func TestControllerWaitForBootstrap(t *testing.T) {
+	polls := 0
+	ctrl, _ := newRespondingController(t, func(cmd string) []string {
+		if cmd != "GETINFO status/bootstrap-phase" {
+			return nil
+		}
+		polls++
+		if polls == 1 {
+			return []string{
+				`250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=50 TAG=loading_descriptors SUMMARY="Loading relay descriptors"`,
+				"250 OK",
+			}
+		}
+		return []string{
+			`250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`,
+			"250 OK",
+		}
+	})
+
+	var logs []string
+	logf := func(format string, args ...interface{}) { logs = append(logs, format) }
+	require.NoError(t, ctrl.waitForBootstrap(5*time.Second, nil, logf))
+	assert.Len(t, logs, 2)
+}
+
+func TestControllerWaitForBootstrapTorExit(t *testing.T) {
+	ctrl, _ := newScriptedController(t, map[string][]string{
+		"GETINFO status/bootstrap-phase": {
+			`250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=5 TAG=conn SUMMARY="Connecting"`,
+			"250 OK",
+		},
+	})
+	exited := make(chan struct{})
+	close(exited)
+	err := ctrl.waitForBootstrap(time.Minute, exited, func(string, ...interface{}) {})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exited")
+}
+
+func TestControllerWaitForDescriptorUpload(t *testing.T) {
+	ctrl, port := newScriptedController(t, map[string][]string{
+		"SETEVENTS HS_DESC": {"250 OK"},
+	})
+	require.NoError(t, ctrl.setEvents("HS_DESC"))
+
+	addr := "testabcdefghijklmnopqrstuvwxyz234567abcdefghijklmnopqrstu"
+	go port.send(
+		"650 HS_DESC UPLOAD "+addr+" UNKNOWN $AAAA",
+		"650 HS_DESC UPLOADED otheraddress UNKNOWN $BBBB",
+		"650 HS_DESC FAILED "+addr+" UNKNOWN $CCCC REASON=UPLOAD_REJECTED",
+		"650 HS_DESC UPLOADED "+addr+" UNKNOWN $DDDD",
+	)
+
+	var failures int
+	logf := func(string, ...interface{}) { failures++ }
+	require.NoError(t, ctrl.waitForDescriptorUploads([]string{addr + ".onion"}, 5*time.Second, nil, logf))
+	assert.Equal(t, 1, failures)
+}
+
+func TestControllerWaitForSeveralDescriptorUploads(t *testing.T) {
+	ctrl, port := newScriptedController(t, map[string][]string{})
+	go port.send(
+		"650 HS_DESC UPLOADED second UNKNOWN $AAAA",
+		"650 HS_DESC UPLOADED second UNKNOWN $BBBB",
+	)
+	err := ctrl.waitForDescriptorUploads([]string{"first.onion", "second.onion"}, 200*time.Millisecond, nil, func(string, ...interface{}) {})
+	assert.Error(t, err, "first was never uploaded")
+
+	go port.send("650 HS_DESC UPLOADED first UNKNOWN $CCCC", "650 HS_DESC UPLOADED second UNKNOWN $DDDD")
+	assert.NoError(t, ctrl.waitForDescriptorUploads([]string{"first.onion", "second.onion"}, 5*time.Second, nil, func(string, ...interface{}) {}))
+}
+
+func TestControllerWaitForDescriptorUploadTimeout(t *testing.T) {
+	ctrl, _ := newScriptedController(t, map[string][]string{})
+	err := ctrl.waitForDescriptorUploads([]string{"x.onion"}, 50*time.Millisecond, nil, func(string, ...interface{}) {})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not published")
+}
+
+func TestReadControlPortFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control_port")
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		os.WriteFile(path, []byte("PORT=127.0.0.1:39051\n"), 0600)
+	}()
+	addr, err := readControlPortFile(path, 5*time.Second, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:39051", addr)
+
+	exited := make(chan struct{})
+	close(exited)
+	_, err = readControlPortFile(filepath.Join(t.TempDir(), "missing"), time.Minute, exited)
+	assert.Error(t, err)
+}
+
+func TestControllerAddAndDelOnion(t *testing.T) {
+	key := "ED25519-V3:c2VjcmV0"
+	ctrl, port := newScriptedController(t, map[string][]string{
+		"ADD_ONION " + key + " Flags=DiscardPK Port=80,127.0.0.1:8080": {
+			"250-ServiceID=testxyzabc",
+			"250 OK",
+		},
+		"DEL_ONION testxyzabc": {"250 OK"},
+	})
+
+	id, err := ctrl.addOnion(key, []string{"80,127.0.0.1:8080"}, onionOptions{Flags: []string{"DiscardPK"}})
+	require.NoError(t, err)
+	assert.Equal(t, "testxyzabc", id)
+	assert.NoError(t, ctrl.delOnion(id))
+	<-port.received
+	assert.Equal(t, "DEL_ONION testxyzabc", <-port.received)
+
+	_, err = ctrl.addOnion("NEW:ED25519-V3", []string{"80,127.0.0.1:8080"}, onionOptions{})
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "ED25519-V3", "key material must not leak into errors")
+}
+
+func TestControllerAddOnionWithOptions(t *testing.T) {
+	key := "ED25519-V3:c2VjcmV0"
+	ctrl, port := newScriptedController(t, map[string][]string{
+		"ADD_ONION " + key + " Flags=DiscardPK,V3Auth MaxStreams=16 Port=80,127.0.0.1:8080 ClientAuthV3=AAAA ClientAuthV3=BBBB": {
+			"250-ServiceID=testxyzabc",
+			"250 OK",
+		},
+	})
+
+	id, err := ctrl.addOnion(key, []string{"80,127.0.0.1:8080"}, onionOptions{
+		Flags:      []string{"DiscardPK"},
+		Params:     []string{"MaxStreams=16"},
+		ClientAuth: []string{"AAAA", "BBBB"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "testxyzabc", id)
+	<-port.received
+}
+
+func TestControllerAuthenticateWithPassword(t *testing.T) {
+	ctrl, port := newScriptedController(t, map[string][]string{
+		"PROTOCOLINFO 1": {
+			"250-PROTOCOLINFO 1",
+			`250-AUTH METHODS=COOKIE,HASHEDPASSWORD COOKIEFILE="/nonexistent/control_auth_cookie"`,
+			"250 OK",
+		},
+		`AUTHENTICATE "s3cret \"quoted\""`: {"250 OK"},
+	})
+
+	require.NoError(t, ctrl.authenticate("", `s3cret "quoted"`))
+	assert.Equal(t, "PROTOCOLINFO 1", <-port.received)
+	assert.Equal(t, `AUTHENTICATE "s3cret \"quoted\""`, <-port.received)
+}
+
+func TestControllerAuthenticateNeedsPassword(t *testing.T) {
+	ctrl, _ := newScriptedController(t, map[string][]string{
+		"PROTOCOLINFO 1": {"250-PROTOCOLINFO 1", "250-AUTH METHODS=HASHEDPASSWORD", "250 OK"},
+	})
+	err := ctrl.authenticate("", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), controlPasswordEnv)
+}
+
+func TestControllerServiceStats(t *testing.T) {
+	ctrl, _ := newScriptedController(t, map[string][]string{
+		"GETINFO circuit-status stream-status": {
+			"250+circuit-status=",
+			"1 BUILT $A~a,$B~b,$C~c BUILD_FLAGS=IS_INTERNAL,NEED_CAPACITY PURPOSE=HS_SERVICE_INTRO HS_STATE=HSSI_ESTABLISHED REND_QUERY=ourservice",
+			"2 BUILT $A~a,$B~b,$C~c BUILD_FLAGS=IS_INTERNAL,NEED_CAPACITY PURPOSE=HS_SERVICE_INTRO HS_STATE=HSSI_ESTABLISHED REND_QUERY=ourservice",
+			"3 BUILT $A~a,$B~b,$D~d PURPOSE=HS_SERVICE_REND HS_STATE=HSSR_JOINED REND_QUERY=ourservice",
+			"4 BUILT $A~a,$B~b,$D~d PURPOSE=HS_SERVICE_REND HS_STATE=HSSR_JOINED REND_QUERY=otherservice",
+			"5 EXTENDED $A~a PURPOSE=HS_SERVICE_REND HS_STATE=HSSR_CONNECTING REND_QUERY=ourservice",
+			"6 BUILT $A~a,$B~b,$C~c PURPOSE=GENERAL",
+			".",
+			"250+stream-status=",
+			"10 SUCCEEDED 3 127.0.0.1:8080",
+			"11 SUCCEEDED 3 127.0.0.1:8080",
+			"12 SUCCEEDED 4 127.0.0.1:8080",
+			".",
+			"250 OK",
+		},
+	})
+
+	stats, err := ctrl.serviceStats("ourservice")
+	require.NoError(t, err)
+	assert.Equal(t, serviceStats{IntroCircuits: 2, RendCircuits: 1, Streams: 2}, stats)
+}
+
+func TestControllerSocksListeners(t *testing.T) {
+	ctrl, _ := newScriptedController(t, map[string][]string{
+		"GETINFO net/listeners/socks": {`250-net/listeners/socks="127.0.0.1:9050" "unix:/run/tor/socks"`, "250 OK"},
+	})
+	addrs, err := ctrl.socksListeners()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:9050", "unix:/run/tor/socks"}, addrs)
+
+	ctrl, _ = newScriptedController(t, map[string][]string{
+		"GETINFO net/listeners/socks": {"250-net/listeners/socks=", "250 OK"},
+	})
+	addrs, err = ctrl.socksListeners()
+	require.NoError(t, err)
+	assert.Empty(t, addrs, "SOCKS port disabled")
+}
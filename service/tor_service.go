@@ -1,221 +1,438 @@
 package service
 
 import (
-	"bytes"
-	"crypto/ed25519"
-	"encoding/json"
+	"cheeseburger/keys"
+	"cheeseburger/vanity"
+	"crypto/rand"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 )
 
-type VanityKey struct {
-	OnionAddress string `json:"onion_address"`
-	PublicKey    string `json:"public_key"`
-	PrivateKey   string `json:"private_key"`
-	Attempts     uint64 `json:"attempts"`
-	Timestamp    string `json:"timestamp"`
+// runTorHiddenService serves st as an onion service until cheeseburger
+// receives SIGINT or SIGTERM, supervising both tor and the HTTP server.
+func runTorHiddenService(st site) {
+	if err := superviseOnionServices(st.opts, []site{st}); err != nil {
+		log.Fatalf("Onion service failed: %v", err)
+	}
 }
 
-// runTorHiddenService performs the Tor integration steps for the service.
-func runTorHiddenService(vanityName string, serveFunc func()) {
-	persistentKeyPath := ""
-	if vanityName != "" {
-		persistentKeyPath = filepath.Join("data", "vanity", vanityName, "vanity.json")
-	} else {
-		persistentKeyPath = filepath.Join("data", "vanity", "default", "vanity.json")
+// site is one onion service to publish: its service level options (key,
+// ports, DoS defenses), the handler serving it and, for MVC sites, the
+// database reported by cheeseburger status.
+type site struct {
+	opts    serveOptions
+	handler http.Handler
+	dbPath  string
+	db      dbSizer
+}
+
+// superviseOnionServices prepares the keys of every site, and unless it
+// attaches to an external tor also the torrc and tor binary, then runs the
+// HTTP servers and a single tor under a torSupervisor. Tor level options
+// come from torOpts. Once the temporary directory exists every failure is
+// returned rather than fatal, so that it is always removed again.
+func superviseOnionServices(torOpts serveOptions, sites []site) error {
+	sup := &torSupervisor{
+		controlAddr:   torOpts.TorControl,
+		statsInterval: torOpts.StatsInterval,
 	}
-	persistent := false
-	if _, err := os.Stat(persistentKeyPath); err == nil {
-		persistent = true
+	cleanupSockets, err := prepareBackendSockets(sites)
+	if err != nil {
+		return err
 	}
+	defer cleanupSockets()
 
-	var dataDir, hsDir, torrcPath string
-	var tempParentDir string
-	var err error
+	persistent := false
+	for _, st := range sites {
+		svc, persistentKey, err := newOnionService(st.opts, torOpts.TorControl)
+		if err != nil {
+			return err
+		}
+		persistent = persistent || persistentKey
+		sup.services = append(sup.services, svc)
+	}
 
-	if persistent {
-		// Use the vanity key directory directly as the hidden service directory
-		hsDir = filepath.Join(getCurrentDirectory(), filepath.Dir(persistentKeyPath))
-		log.Printf("Using hidden service directory: %s", hsDir)
-		log.Printf("Using vanity key from: %s", persistentKeyPath)
+	sup.status = newServeStatus(sup.services, sites)
 
-		// Verify vanity key file
-		keyData, err := os.ReadFile(persistentKeyPath)
+	if torOpts.TorControl == "" {
+		cleanup, err := prepareTorLaunch(torOpts, persistent, sup)
 		if err != nil {
-			log.Fatalf("Failed to read vanity key file: %v", err)
+			return err
 		}
-		var vk VanityKey
-		if err := json.Unmarshal(keyData, &vk); err != nil {
-			log.Fatalf("Failed to unmarshal vanity key JSON: %v", err)
-		}
-		log.Printf("Using vanity key with onion address: %s", vk.OnionAddress)
+		defer cleanup()
+	}
 
-		// Validate secret key file
-		secretKeyPath := filepath.Join(hsDir, "hs_ed25519_secret_key")
-		secretKeyData, err := os.ReadFile(secretKeyPath)
+	// Only listen on a private socket or loopback; tor is the only client.
+	for i, svc := range sup.services {
+		ln, err := listenBackend(sites[i].opts)
 		if err != nil {
-			log.Fatalf("Failed to read secret key file: %v", err)
-		}
-		log.Printf("Secret key file size: %d bytes", len(secretKeyData))
-		secretHeader := make([]byte, 32)
-		copy(secretHeader, []byte("== ed25519v1-secret: type0 =="))
-		if len(secretKeyData) != 96 || !bytes.Equal(secretKeyData[:32], secretHeader) {
-			log.Fatalf("Secret key file has invalid format")
-		}
-		log.Printf("Secret key header verified: %x", secretKeyData[:32])
-		privateScalar := secretKeyData[32:64]
-		derivedPriv := ed25519.NewKeyFromSeed(privateScalar)
-		derivedPub := derivedPriv.Public().(ed25519.PublicKey)
-		log.Printf("Derived public key (hex): %x", derivedPub)
-
-		// Validate public key file
-		publicKeyPath := filepath.Join(hsDir, "hs_ed25519_public_key")
-		publicKeyData, err := os.ReadFile(publicKeyPath)
-		if err != nil {
-			log.Fatalf("Failed to read public key file: %v", err)
+			return err
 		}
-		log.Printf("Public key file size: %d bytes", len(publicKeyData))
-		publicHeader := make([]byte, 32)
-		copy(publicHeader, []byte("== ed25519v1-public: type0 =="))
-		if len(publicKeyData) != 64 || !bytes.Equal(publicKeyData[:32], publicHeader) {
-			log.Fatalf("Public key file has invalid format")
+		log.Printf("HTTP server of %s listening on %s", svc.name, sites[i].opts.backendTarget())
+		svc.listener = ln
+		handler := sup.status.instrument(i, withRotationAnnouncement(sites[i].handler, svc.rotation))
+		svc.server = &http.Server{Handler: withOnionSecurityHeaders(handler)}
+		defer svc.server.Close()
+		defer ln.Close()
+
+		if sites[i].opts.ClearnetAddr == "" {
+			continue
 		}
-		log.Printf("Public key header verified: %x", publicKeyData[:32])
-		storedPub := publicKeyData[32:64]
-		if !bytes.Equal(storedPub, derivedPub) {
-			log.Fatalf("Public key mismatch. Stored key does not match key derived from secret key")
+		if svc.clients > 0 {
+			return fmt.Errorf("%s restricts discovery to authorized clients and cannot be advertised on clearnet", svc.name)
 		}
-		log.Printf("Public key verified: matches key derived from secret key")
+		if svc.clearnetListener, err = listenClearnet(sites[i].opts); err != nil {
+			return err
+		}
+		svc.clearnetServer = &http.Server{Handler: withOnionLocation(handler, &svc.hostname)}
+		defer svc.clearnetServer.Close()
+		defer svc.clearnetListener.Close()
+	}
 
-		hostnamePath := filepath.Join(hsDir, "hostname")
-		hostnameData, err := os.ReadFile(hostnamePath)
-		if err != nil {
-			log.Fatalf("Failed to read hostname file: %v", err)
+	if torOpts.AdminSocket != "" {
+		defer sup.status.serveAdmin(torOpts.AdminSocket)()
+	}
+
+	defer setTorSocks("")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	return sup.run(sigs)
+}
+
+// prepareBackendSockets picks a socket for every site with a unix backend
+// that has none yet, in a private temporary directory. The returned cleanup
+// removes that directory again.
+func prepareBackendSockets(sites []site) (cleanup func(), err error) {
+	var dir string
+	cleanup = func() {
+		if dir != "" {
+			os.RemoveAll(dir)
 		}
-		hostname := strings.TrimSpace(string(hostnameData))
-		if hostname != vk.OnionAddress {
-			log.Fatalf("Hostname mismatch. Expected %s but found %s", vk.OnionAddress, hostname)
+	}
+	for i := range sites {
+		opts := &sites[i].opts
+		if opts.Backend != "unix" || opts.ListenSocket != "" {
+			continue
 		}
-		log.Printf("Hostname verified: %s", hostname)
+		if dir == "" {
+			if dir, err = os.MkdirTemp("", "cheeseburger-"); err != nil {
+				return nil, fmt.Errorf("failed to create socket directory: %v", err)
+			}
+		}
+		name := opts.VanityName
+		if name == "" {
+			name = "default"
+		}
+		opts.ListenSocket = filepath.Join(dir, fmt.Sprintf("%d-%s.sock", i, name))
+	}
+	return cleanup, nil
+}
 
-		// Set permissions
-		os.Chmod(hsDir, 0700)
-		os.Chmod(secretKeyPath, 0600)
-		os.Chmod(publicKeyPath, 0600)
-		os.Chmod(hostnamePath, 0600)
+// maxSocketPath is the longest Unix socket path that fits in sun_path on
+// every platform we run on.
+const maxSocketPath = 103
 
-		// For persistent mode, use a temporary directory for Tor's DataDirectory
-		tempParentDir, err = os.MkdirTemp("", "tor-example-")
-		if err != nil {
-			log.Fatalf("Failed to create temp directory: %v", err)
+// listenBackend opens the listener of the site's HTTP server. A leftover
+// socket from a crashed run is replaced; any other file is left alone.
+func listenBackend(opts serveOptions) (net.Listener, error) {
+	network, addr := opts.backendListenAddr()
+	if network == "unix" {
+		if len(addr) > maxSocketPath {
+			return nil, fmt.Errorf("socket path %s is too long; choose a shorter one with --listen-socket", addr)
 		}
-		dataDir = filepath.Join(tempParentDir, "data")
-		if err := os.MkdirAll(dataDir, 0700); err != nil {
-			log.Fatalf("Failed to create data directory: %v", err)
+		if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
 		}
-		torrcPath = filepath.Join(tempParentDir, "torrc")
-	} else {
-		// Temporary mode: create temporary directories
-		tempParentDir, err = os.MkdirTemp("", "tor-example-")
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	if network == "unix" {
+		// Readable by our group as well, for a tor running under a shared
+		// group; the directory still decides who can reach it.
+		if err := os.Chmod(addr, 0660); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to restrict %s: %v", addr, err)
+		}
+	}
+	return ln, nil
+}
+
+// listenClearnet opens the public listener of a site that is also served on
+// clearnet, with TLS if a certificate is configured.
+func listenClearnet(opts serveOptions) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if opts.ClearnetCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClearnetCert, opts.ClearnetKey)
 		if err != nil {
-			log.Fatalf("Failed to create temp directory: %v", err)
+			return nil, fmt.Errorf("failed to load clearnet certificate: %v", err)
 		}
-		dataDir = filepath.Join(tempParentDir, "data")
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	ln, err := net.Listen("tcp", opts.ClearnetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", opts.ClearnetAddr, err)
+	}
+	if tlsConfig == nil {
+		// Tor Browser ignores Onion-Location on plain HTTP pages.
+		log.Printf("Serving clearnet on %s without TLS; Tor Browser only honors Onion-Location over HTTPS, so terminate TLS in front of it", opts.ClearnetAddr)
+		return ln, nil
+	}
+	log.Printf("Serving clearnet over HTTPS on %s", opts.ClearnetAddr)
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// newOnionService loads or generates the key of the service described by
+// opts and reports whether it is a saved (persistent) key. When attaching
+// to an external tor at controlAddr the service is always ephemeral.
+func newOnionService(opts serveOptions, controlAddr string) (*onionService, bool, error) {
+	persistentKeyPath := filepath.Join(vanity.BundleDir(opts.VanityDir, opts.VanityName), "vanity.json")
+	persistent := false
+	if _, err := os.Stat(persistentKeyPath); err == nil {
+		persistent = true
+	}
+
+	var hsDir string
+	var expandedKey, rotation []byte
+	var retiring *retiringOnion
+	if persistent {
+		// Use the vanity key directory directly as the hidden service directory
 		hsDir = filepath.Join(getCurrentDirectory(), filepath.Dir(persistentKeyPath))
-		if err := os.MkdirAll(dataDir, 0700); err != nil {
-			log.Fatalf("Failed to create data directory: %v", err)
+		var passphrase []byte
+		var err error
+		expandedKey, passphrase, err = verifyVanityKey(hsDir, opts.PassphraseFD)
+		if err != nil {
+			return nil, false, err
+		}
+		if rotation, retiring, err = loadRotation(hsDir, passphrase); err != nil {
+			return nil, false, err
 		}
+		if passphrase != nil && !opts.Ephemeral {
+			// tor can only read plaintext keys from a HiddenServiceDir, so
+			// an unlocked key is only ever handed over in memory.
+			log.Printf("Vanity key is encrypted; adding the onion service ephemerally so the key never touches disk")
+			opts.Ephemeral = true
+		}
+	}
+	if controlAddr != "" && !opts.Ephemeral {
+		// An external tor cannot be pointed at a HiddenServiceDir of ours.
+		log.Printf("Attaching to the tor at %s; adding the onion service ephemerally", controlAddr)
+		opts.Ephemeral = true
+	}
+	if opts.Ephemeral && expandedKey == nil {
+		// Generate the throwaway key here instead of asking tor for a NEW
+		// one, so that a restarted tor keeps serving the same address.
+		var seed [32]byte
+		if _, err := rand.Read(seed[:]); err != nil {
+			return nil, false, fmt.Errorf("failed to generate ephemeral key: %v", err)
+		}
+		key := vanity.ExpandSeed(seed[:])
+		expandedKey = key[:]
+	}
+	if !persistent && !opts.Ephemeral {
+		// Temporary mode: let tor generate a key in the default vanity directory
+		hsDir = filepath.Join(getCurrentDirectory(), filepath.Dir(persistentKeyPath))
 		if err := os.MkdirAll(hsDir, 0700); err != nil {
-			log.Fatalf("Failed to create hidden service directory: %v", err)
+			return nil, false, fmt.Errorf("failed to create hidden service directory: %v", err)
 		}
-		torrcPath = filepath.Join(tempParentDir, "torrc")
 	}
 
-	// Create torrc config file
-	torrcContent := fmt.Sprintf(`
-# Write Tor's runtime data here
-DataDirectory %s
+	name := opts.VanityName
+	if name == "" {
+		name = "default"
+	}
+	svc := &onionService{
+		name:        name,
+		hsDir:       hsDir,
+		ephemeral:   opts.Ephemeral,
+		expandedKey: expandedKey,
+		ports:       opts.onionPorts(),
+		dos:         opts.DoS,
+		rotation:    rotation,
+		retiring:    retiring,
+	}
+	if opts.Ephemeral {
+		if _, unsupported := opts.DoS.onionOptions(); len(unsupported) > 0 {
+			log.Printf("Warning: ephemeral services cannot use %s; tor's defaults apply", strings.Join(unsupported, ", "))
+		}
+	}
+	if hsDir != "" {
+		// tor reads authorized_clients from a HiddenServiceDir itself;
+		// ephemeral services get the keys with ADD_ONION.
+		clients, err := keys.Clients(hsDir)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to load authorized clients: %v", err)
+		}
+		if len(clients) > 0 {
+			log.Printf("Client authorization enabled: %d authorized client(s)", len(clients))
+		}
+		svc.clients = len(clients)
+		if opts.Ephemeral {
+			for _, c := range clients {
+				svc.clientAuth = append(svc.clientAuth, c.EncodedKey())
+			}
+		}
+	}
+	return svc, persistent, nil
+}
 
-# Open a SOCKS port for local connections (optional)
-SocksPort 9050
+// prepareTorLaunch sets up everything needed to launch tor for sup: the
+// temporary directory, the locked DataDirectory, the verified torrc and the
+// launcher of the tor binary. The returned cleanup releases them again.
+func prepareTorLaunch(opts serveOptions, persistent bool, sup *torSupervisor) (cleanup func(), err error) {
+	tempParentDir, err := os.MkdirTemp("", "tor-example-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	unlock := func() {}
+	cleanup = func() {
+		unlock()
+		os.RemoveAll(tempParentDir)
+		log.Println("Cleaned up temporary directories.")
+	}
+	defer func() {
+		if err != nil {
+			cleanup()
+		}
+	}()
 
-# Our hidden service
-HiddenServiceDir %s
-HiddenServicePort 80 127.0.0.1:8080
+	dataDir, err := torDataDir(opts, persistent)
+	if err != nil {
+		return nil, err
+	}
+	if dataDir == "" {
+		dataDir = filepath.Join(tempParentDir, "data")
+	} else {
+		log.Printf("Using persistent tor data directory: %s", dataDir)
+	}
+	if err := prepareDataDir(dataDir); err != nil {
+		return nil, err
+	}
+	if unlock, err = lockDataDir(dataDir); err != nil {
+		unlock = func() {}
+		return nil, err
+	}
 
-# Log notice to stdout
-Log notice stdout
-`, dataDir, hsDir)
-	log.Printf("Writing torrc to: %s", torrcPath)
-	log.Printf("Using hidden service directory: %s", hsDir)
+	// Ephemeral services are added over the control port instead, so no
+	// HiddenServiceDir (and no key material) is handed to tor.
+	sup.torrc = filepath.Join(tempParentDir, "torrc")
+	sup.controlPortFile = filepath.Join(tempParentDir, "control_port")
+	sup.cookieFile = filepath.Join(tempParentDir, "control_auth_cookie")
+	torrc := torrcConfig{
+		DataDirectory:   dataDir,
+		SocksPort:       opts.SocksPort,
+		ControlPort:     opts.ControlPort,
+		ControlPortFile: sup.controlPortFile,
+		CookieAuthFile:  sup.cookieFile,
+		Include:         opts.TorrcInclude,
+	}
+	for _, svc := range sup.services {
+		if !svc.ephemeral {
+			torrc.HiddenServices = append(torrc.HiddenServices, hiddenServiceConfig{Dir: svc.hsDir, Ports: svc.ports, DoS: svc.dos})
+			log.Printf("Using hidden service directory: %s", svc.hsDir)
+		}
+	}
+	if err := torrc.validate(); err != nil {
+		return nil, err
+	}
+	torrcContent := torrc.String()
+	log.Printf("Writing torrc to: %s", sup.torrc)
 	log.Printf("Torrc content:\n%s", torrcContent)
-	if err := os.WriteFile(torrcPath, []byte(torrcContent), 0600); err != nil {
-		log.Fatalf("Failed to write torrc file: %v", err)
+	if err := os.WriteFile(sup.torrc, []byte(torrcContent), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write torrc file: %v", err)
 	}
 
-	// Start the HTTP service in a separate goroutine
-	go serveFunc()
+	if sup.launcher, err = newTorLauncher(opts.TorPath); err != nil {
+		return nil, err
+	}
+	if err := sup.launcher.verify(sup.torrc); err != nil {
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// torStartupTimeout bounds each startup phase: opening the control port,
+// bootstrapping and publishing the descriptor. It is a variable so tests can
+// shorten it.
+var torStartupTimeout = 5 * time.Minute
+
+// connectController waits for tor's control port and connects to it.
+func connectController(controlPortFile, cookieFile string, torExited <-chan struct{}) (*torController, error) {
+	addr, err := readControlPortFile(controlPortFile, torStartupTimeout, torExited)
+	if err != nil {
+		return nil, err
+	}
+	return openController(addr, cookieFile, "")
+}
 
-	// Write the embedded Tor binary to a temporary file
-	tmpTor, err := os.CreateTemp("", "tor-")
+// openController connects to the control port at addr, authenticates and
+// subscribes to HS_DESC events so that no descriptor upload is missed.
+func openController(addr, cookieFile, password string) (*torController, error) {
+	ctrl, err := dialController(addr)
 	if err != nil {
-		log.Fatalf("Failed to create temporary file for embedded tor: %v", err)
+		return nil, err
 	}
-	if _, err = tmpTor.Write(torBinary); err != nil {
-		log.Fatalf("Failed to write embedded tor binary to temp file: %v", err)
+	if err := ctrl.authenticate(cookieFile, password); err != nil {
+		ctrl.close()
+		return nil, fmt.Errorf("control port authentication failed: %v", err)
 	}
-	if err = tmpTor.Chmod(0755); err != nil {
-		log.Fatalf("Failed to set executable permissions on embedded tor binary: %v", err)
+	if err := ctrl.setEvents("HS_DESC"); err != nil {
+		ctrl.close()
+		return nil, err
 	}
-	tmpTorPath := tmpTor.Name()
-	tmpTor.Close()
+	return ctrl, nil
+}
 
-	// Run Tor with the generated config
-	cmd := exec.Command(tmpTorPath, "-f", torrcPath)
-	stdoutPipe, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatalf("Failed to get stdout pipe for tor: %v", err)
+// waitForOnionServices blocks until tor has bootstrapped and uploaded the
+// descriptors for all hostnames.
+func waitForOnionServices(ctrl *torController, hostnames []string, torExited <-chan struct{}) error {
+	if err := ctrl.waitForBootstrap(torStartupTimeout, torExited, log.Printf); err != nil {
+		return err
 	}
-	stderrPipe, err := cmd.StderrPipe()
-	if err != nil {
-		log.Fatalf("Failed to get stderr pipe for tor: %v", err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("Failed to start Tor process: %v", err)
-	}
-	// Read and print Tor logs
-	go io.Copy(os.Stdout, stdoutPipe)
-	go io.Copy(os.Stderr, stderrPipe)
-	// Wait for Tor to generate the onion hostname file
-	time.Sleep(5 * time.Second)
-	hostnamePath := filepath.Join(hsDir, "hostname")
-	hostnameBytes, err := os.ReadFile(hostnamePath)
+	log.Printf("Waiting for the descriptors of %s to be published...", strings.Join(hostnames, ", "))
+	return ctrl.waitForDescriptorUploads(hostnames, torStartupTimeout, torExited, log.Printf)
+}
+
+// verifyVanityKey checks that the key bundle in hsDir is well formed and
+// consistent, tightening its permissions so tor accepts it. Encrypted keys
+// are unlocked with a passphrase read via keys.ReadPassphrase. It returns
+// the 64-byte expanded secret key and the passphrase, nil unless the key
+// was encrypted.
+func verifyVanityKey(hsDir string, passphraseFD int) ([]byte, []byte, error) {
+	log.Printf("Using hidden service directory: %s", hsDir)
+	if err := keys.FixPermissions(hsDir); err != nil {
+		return nil, nil, fmt.Errorf("failed to set permissions on %s: %v", hsDir, err)
+	}
+	bundle, err := keys.Verify(hsDir)
 	if err != nil {
-		log.Printf("Could not read onion hostname yet: %v", err)
-		log.Printf("Tor may still be starting. Waiting a bit longer...")
-		time.Sleep(5 * time.Second)
-		hostnameBytes, err = os.ReadFile(hostnamePath)
+		return nil, nil, fmt.Errorf("invalid vanity key: %v", err)
+	}
+	log.Printf("Using vanity key with onion address: %s", bundle.OnionAddress)
+	log.Printf("Key fingerprint: %s", bundle.Fingerprint)
+
+	var passphrase []byte
+	if bundle.Encrypted {
+		passphrase, err = keys.ReadPassphrase(passphraseFD, fmt.Sprintf("Passphrase for %s: ", bundle.Name), false)
 		if err != nil {
-			log.Fatalf("Still no hostname file: %v", err)
+			return nil, nil, fmt.Errorf("failed to unlock vanity key: %v", err)
 		}
 	}
-	hostname := strings.TrimSpace(string(hostnameBytes))
-	log.Printf("Your onion service is live at: %s", hostname)
-	log.Printf("Press Ctrl+C to stop.\n")
-	// Wait for Tor to exit
-	if err := cmd.Wait(); err != nil {
-		log.Printf("Tor process exited with an error: %v", err)
-	}
-	// Cleanup temporary directories and files if not persistent
-	if !persistent {
-		os.RemoveAll(tempParentDir)
-		os.Remove(tmpTorPath)
-		log.Println("Cleaned up temporary directories and embedded tor binary. Exiting.")
+	expanded, err := keys.Unlock(hsDir, passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unlock vanity key: %v", err)
 	}
+	return expanded, passphrase, nil
 }
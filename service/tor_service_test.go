@@ -0,0 +1,185 @@
+package service
+
+import (
+	"cheeseburger/config"
+	"cheeseburger/vanity"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useFakeTor makes every tor launched during the test a fakeTor, and runs
+// the test in an empty working directory, which cheeseburger's data paths
+// are relative to.
+func useFakeTor(t *testing.T) *fakeTor {
+	shortenSupervisorTimeouts(t)
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	require.NoError(t, os.Chdir(dir))
+	// The blog loads its templates from app/views, relative to the working
+	// directory as when cheeseburger runs from the repository.
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "app"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join(wd, "..", "app", "views"), filepath.Join(dir, "app", "views")))
+	f := newFakeTor()
+	oldLauncher := newTorLauncher
+	newTorLauncher = func(string) (torLauncher, error) { return f, nil }
+	t.Cleanup(func() {
+		newTorLauncher = oldLauncher
+		os.Chdir(wd)
+	})
+	return f
+}
+
+// startServing runs serve in the background; the returned channel is
+// closed when it returns.
+func startServing(serve func()) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve()
+	}()
+	return done
+}
+
+// stopServing sends ourselves the SIGTERM a service manager would and waits
+// for serving to end.
+func stopServing(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		t.Fatal("serving did not stop")
+	}
+}
+
+// getOnion fetches url through f and returns the response and its body.
+func getOnion(t *testing.T, f *fakeTor, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := f.client().Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestServeStaticOverFakeTor(t *testing.T) {
+	f := useFakeTor(t)
+	f.bootstrap = []int{50, 100}
+	site := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(site, "index.html"), []byte("<h1>hello onion</h1>"), 0644))
+
+	done := startServing(func() { RunStaticTorServer(config.Default(), site, nil) })
+	id := f.waitForUploads(t, 1)[0]
+	hostname, err := os.ReadFile(filepath.Join("data", "vanity", "default", "hostname"))
+	require.NoError(t, err)
+	assert.Equal(t, id+".onion\n", string(hostname), "tor generates the key of a temporary service")
+
+	resp, body := getOnion(t, f, "http://"+id+".onion/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "<h1>hello onion</h1>", body)
+	assert.Equal(t, "no-referrer", resp.Header.Get("Referrer-Policy"))
+	socket, ok := strings.CutPrefix(f.target(id, 80), "unix:")
+	require.True(t, ok, "the backend is a unix socket by default")
+
+	stopServing(t, done)
+	assert.Equal(t, 1, f.launches())
+	_, err = f.client().Get("http://" + id + ".onion/")
+	assert.Error(t, err, "tor was stopped")
+	assert.NoFileExists(t, socket)
+}
+
+func TestServeMvcOverFakeTor(t *testing.T) {
+	f := useFakeTor(t)
+
+	done := startServing(func() { RunAppServer(config.Default(), []string{"--ephemeral"}) })
+	id := f.waitForUploads(t, 1)[0]
+
+	resp, _ := getOnion(t, f, "http://"+id+".onion/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the blog renders its templates")
+	resp, _ = getOnion(t, f, "http://"+id+".onion/no-such-page")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "the request reached the router")
+	assert.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"))
+	assert.NoDirExists(t, filepath.Join("data", "vanity", "default"), "an ephemeral key never touches disk")
+
+	stopServing(t, done)
+	assert.Contains(t, f.received(), "DEL_ONION "+id)
+	assert.Empty(t, f.target(id, 80))
+}
+
+func TestServeVanityKeyOverFakeTor(t *testing.T) {
+	f := useFakeTor(t)
+	var seed [32]byte
+	copy(seed[:], "blog")
+	expanded := vanity.ExpandSeed(seed[:])
+	key, err := vanity.SaveBundle(vanity.BundleDir(config.Default().Paths.Vanity, "blog"), expanded[:], 1)
+	require.NoError(t, err)
+
+	done := startServing(func() {
+		RunStaticTorServer(config.Default(), t.TempDir(), []string{"--vanity-name", "blog", "--backend", "tcp", "--listen-port", "18080"})
+	})
+	id := f.waitForUploads(t, 1)[0]
+	assert.Equal(t, key.OnionAddress, id+".onion")
+	assert.Equal(t, "127.0.0.1:18080", f.target(id, 80))
+	for _, cmd := range f.received() {
+		assert.False(t, strings.HasPrefix(cmd, "ADD_ONION"), "a saved key is published from its HiddenServiceDir")
+	}
+	assert.DirExists(t, filepath.Join("data", "tor", "blog"), "a saved key gets a persistent tor data directory")
+
+	stopServing(t, done)
+}
+
+func TestServeRejectsInvalidKey(t *testing.T) {
+	f := useFakeTor(t)
+	for name, corrupt := range map[string]func(dir string){
+		"hostname mismatch": func(dir string) {
+			os.WriteFile(filepath.Join(dir, "hostname"), []byte("aaaa.onion\n"), 0600)
+		},
+		"secret key": func(dir string) {
+			os.WriteFile(filepath.Join(dir, "hs_ed25519_secret_key"), []byte("junk"), 0600)
+		},
+	} {
+		var seed [32]byte
+		copy(seed[:], name)
+		expanded := vanity.ExpandSeed(seed[:])
+		dir := vanity.BundleDir(config.Default().Paths.Vanity, strings.ReplaceAll(name, " ", "-"))
+		_, err := vanity.SaveBundle(dir, expanded[:], 1)
+		require.NoError(t, err)
+		corrupt(dir)
+
+		opts, err := parseServeFlags(config.Default(), "serve", []string{"--vanity-name", filepath.Base(dir)})
+		require.NoError(t, err)
+		err = superviseOnionServices(opts, []site{{opts: opts, handler: http.NotFoundHandler()}})
+		if assert.Error(t, err, name) {
+			assert.Contains(t, err.Error(), "invalid vanity key", name)
+			assert.Contains(t, err.Error(), name)
+		}
+	}
+	assert.Zero(t, f.launches(), "tor is never started with a broken key")
+}
+
+func TestServeRestartsCrashedTor(t *testing.T) {
+	f := useFakeTor(t)
+
+	done := startServing(func() { RunStaticTorServer(config.Default(), t.TempDir(), []string{"--ephemeral"}) })
+	id := f.waitForUploads(t, 1)[0]
+	f.crash()
+
+	ids := f.waitForUploads(t, 2)
+	assert.Equal(t, id, ids[1], "the restarted tor publishes the same address")
+	assert.Equal(t, 2, f.launches())
+	resp, _ := getOnion(t, f, "http://"+id+".onion/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	stopServing(t, done)
+}
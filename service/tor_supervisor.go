@@ -0,0 +1,529 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Restart policy for tor. They are variables so tests can shorten them.
+var (
+	// torRestartBackoff is the delay before the first restart; it doubles
+	// with every consecutive failure up to torMaxRestartBackoff.
+	torRestartBackoff    = time.Second
+	torMaxRestartBackoff = time.Minute
+	// torStableAfter is how long tor must have run for a crash to reset the
+	// backoff.
+	torStableAfter = time.Minute
+	// torMaxStartFailures is how many consecutive failed starts are
+	// tolerated before giving up.
+	torMaxStartFailures = 5
+	// torStopTimeout is how long tor gets to exit after SIGTERM before it
+	// is killed.
+	torStopTimeout = 30 * time.Second
+	// httpShutdownTimeout bounds how long in-flight requests may take to
+	// finish on shutdown.
+	httpShutdownTimeout = 10 * time.Second
+)
+
+// onionService is one onion service published by a torSupervisor, together
+// with the HTTP server behind it.
+type onionService struct {
+	// name identifies the service in logs and status output.
+	name        string
+	hsDir       string
+	ephemeral   bool
+	expandedKey []byte
+	ports       []portMapping
+	// clientAuth holds the x25519 keys of authorized clients, passed to
+	// ADD_ONION for ephemeral services.
+	clientAuth []string
+	// clients is the number of authorized clients, 0 if anyone may
+	// connect.
+	clients int
+	// dos holds the DoS defenses passed to ADD_ONION for ephemeral
+	// services.
+	dos      dosConfig
+	listener net.Listener
+	server   *http.Server
+	// hostname is set once the service is published, for the Onion-Location
+	// of the optional clearnet server.
+	hostname         onionHostname
+	clearnetListener net.Listener
+	clearnetServer   *http.Server
+	// rotation is the signed announcement of a rotated key, served at
+	// rotationPath; retiring is its old key while the overlap lasts.
+	rotation []byte
+	retiring *retiringOnion
+}
+
+// torSupervisor runs the HTTP servers and keeps a tor process publishing
+// their onion services, restarting tor with backoff when it dies. With
+// controlAddr set it attaches to an external tor instead, reconnecting when
+// the control connection is lost.
+type torSupervisor struct {
+	controlAddr     string
+	launcher        torLauncher
+	torrc           string
+	controlPortFile string
+	cookieFile      string
+	services        []*onionService
+	// statsInterval is how often circuit and stream statistics of the
+	// live services are logged; 0 disables them.
+	statsInterval time.Duration
+	// status records what cheeseburger status reports; it may be nil.
+	status *serveStatus
+}
+
+// torProcess is one run of tor, or one control connection to an external
+// tor, in which case signal is nil and exited is closed when the connection
+// is lost.
+type torProcess struct {
+	// signal delivers sig to the launched tor.
+	signal func(sig os.Signal) error
+	exited chan struct{}
+	err    error
+
+	ctrl *torController
+	// hostnames and serviceIDs are indexed like torSupervisor.services;
+	// serviceIDs are only set for ephemeral services. retiringIDs are the
+	// service IDs of the old onions still published after a key rotation.
+	hostnames   []string
+	serviceIDs  []string
+	retiringIDs []string
+}
+
+// run serves HTTP for every service and supervises tor until a signal
+// arrives on sigs or an HTTP server fails. On a signal the HTTP servers are
+// shut down gracefully before tor is stopped, and run returns nil.
+func (s *torSupervisor) run(sigs <-chan os.Signal) error {
+	httpErr := make(chan error, 2*len(s.services))
+	for _, svc := range s.services {
+		go func(svc *onionService) { httpErr <- svc.server.Serve(svc.listener) }(svc)
+		if svc.clearnetServer != nil {
+			go func(svc *onionService) { httpErr <- svc.clearnetServer.Serve(svc.clearnetListener) }(svc)
+		}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		sig, ok := <-sigs
+		if ok {
+			log.Printf("Received %s, shutting down...", sig)
+		}
+		close(stop)
+	}()
+
+	backoff := torRestartBackoff
+	failures := 0
+	for {
+		s.status.torStarting()
+		t, err := s.start()
+		if err == nil {
+			err = s.publish(t, stop)
+		}
+
+		if err == nil {
+			failures = 0
+			for i, svc := range s.services {
+				svc.hostname.set(t.hostnames[i])
+			}
+			s.status.torLive()
+			s.logLive(t)
+			log.Printf("Press Ctrl+C to stop.\n")
+			started := time.Now()
+			quit := make(chan struct{})
+			if s.statsInterval > 0 {
+				go s.logStats(t, quit)
+			}
+			go s.watchDescriptors(t, quit)
+			retire := s.nextRetirement(t)
+			for exited := false; !exited; {
+				select {
+				case <-retire:
+					s.retireOnions(t)
+					retire = s.nextRetirement(t)
+				case <-t.exited:
+					close(quit)
+					log.Printf("Tor exited unexpectedly: %v", t.err)
+					s.status.torDown(torRestarting, fmt.Errorf("tor exited unexpectedly: %v", t.err))
+					t.ctrl.close()
+					if time.Since(started) >= torStableAfter {
+						backoff = torRestartBackoff
+					}
+					exited = true
+				case <-stop:
+					close(quit)
+					s.status.torDown(torStopping, nil)
+					s.shutdown(t)
+					return nil
+				case err := <-httpErr:
+					close(quit)
+					s.status.torDown(torStopping, err)
+					s.shutdown(t)
+					return fmt.Errorf("HTTP server stopped: %v", err)
+				}
+			}
+		} else {
+			if t != nil {
+				s.stopTor(t)
+			}
+			s.status.torDown(torRestarting, err)
+			select {
+			case <-stop:
+				s.shutdown(nil)
+				return nil
+			default:
+			}
+			failures++
+			if failures >= torMaxStartFailures {
+				s.shutdown(nil)
+				return fmt.Errorf("tor failed to start %d times in a row: %v", failures, err)
+			}
+			log.Printf("Tor failed to start: %v", err)
+		}
+
+		log.Printf("Restarting tor in %s", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			s.shutdown(nil)
+			return nil
+		case err := <-httpErr:
+			s.status.torDown(torStopping, err)
+			s.shutdown(nil)
+			return fmt.Errorf("HTTP server stopped: %v", err)
+		}
+		backoff *= 2
+		if backoff > torMaxRestartBackoff {
+			backoff = torMaxRestartBackoff
+		}
+	}
+}
+
+// logLive announces the published services. Several services are shown as
+// a combined status table.
+func (s *torSupervisor) logLive(t *torProcess) {
+	if len(s.services) == 1 {
+		log.Printf("Your onion service is live at: %s", t.hostnames[0])
+		if svc := s.services[0]; svc.retiring.active() {
+			log.Printf("Its previous address %s stays published until %s", svc.retiring.hostname, svc.retiring.retireAt.Format(time.RFC3339))
+		}
+		if svc := s.services[0]; svc.clearnetServer != nil {
+			log.Printf("Clearnet listener on %s advertises it with Onion-Location", svc.clearnetListener.Addr())
+		}
+		return
+	}
+	log.Printf("All %d onion services are live:", len(s.services))
+	for _, line := range s.statusLines(t) {
+		log.Print(line)
+	}
+}
+
+// statusLines formats one line per service: its name, address, backend and
+// how it is published.
+func (s *torSupervisor) statusLines(t *torProcess) []string {
+	lines := []string{fmt.Sprintf("  %-16s %-62s %-21s %s", "SITE", "ADDRESS", "BACKEND", "MODE")}
+	for i, svc := range s.services {
+		lines = append(lines, fmt.Sprintf("  %-16s %-62s %-21s %s", svc.name, t.hostnames[i], svc.listener.Addr(), svc.mode()))
+	}
+	return lines
+}
+
+// mode describes how the service is published.
+func (svc *onionService) mode() string {
+	mode := "HiddenServiceDir"
+	if svc.ephemeral {
+		mode = "ephemeral"
+	}
+	if svc.clients > 0 {
+		mode += ", client auth"
+	}
+	if svc.retiring.active() {
+		mode += ", retiring " + svc.retiring.hostname
+	}
+	if svc.clearnetServer != nil {
+		mode += ", clearnet " + svc.clearnetListener.Addr().String()
+	}
+	return mode
+}
+
+// start launches tor. A stale control port file from an earlier run is
+// removed first so it is not mistaken for the new one.
+func (s *torSupervisor) start() (*torProcess, error) {
+	if s.controlAddr != "" {
+		return s.attach()
+	}
+	os.Remove(s.controlPortFile)
+	return s.launcher.launch(s.torrc)
+}
+
+// attach connects to the external tor's control port.
+func (s *torSupervisor) attach() (*torProcess, error) {
+	ctrl, err := openController(s.controlAddr, "", os.Getenv(controlPasswordEnv))
+	if err != nil {
+		return nil, err
+	}
+	t := &torProcess{ctrl: ctrl, exited: make(chan struct{})}
+	go func() {
+		<-ctrl.done
+		t.err = fmt.Errorf("control connection lost: %v", ctrl.err)
+		close(t.exited)
+	}()
+	return t, nil
+}
+
+// publish connects to tor's control port, adds the ephemeral services and
+// waits until every descriptor is uploaded. It gives up if tor exits or
+// stop is closed.
+func (s *torSupervisor) publish(t *torProcess, stop <-chan struct{}) error {
+	abort := make(chan struct{})
+	go func() {
+		select {
+		case <-t.exited:
+		case <-stop:
+		}
+		close(abort)
+	}()
+
+	ctrl := t.ctrl
+	if ctrl == nil {
+		var err error
+		ctrl, err = connectController(s.controlPortFile, s.cookieFile, abort)
+		if err != nil {
+			return err
+		}
+		t.ctrl = ctrl
+	}
+	s.status.torConnected(ctrl)
+	s.recordSocks(ctrl)
+
+	t.hostnames = make([]string, len(s.services))
+	t.serviceIDs = make([]string, len(s.services))
+	t.retiringIDs = make([]string, len(s.services))
+	for i, svc := range s.services {
+		if svc.ephemeral {
+			id, err := svc.addOnion(ctrl, svc.expandedKey, svc.clientAuth)
+			if err != nil {
+				return fmt.Errorf("failed to add ephemeral onion service %s: %v", svc.name, err)
+			}
+			t.serviceIDs[i] = id
+			t.hostnames[i] = id + ".onion"
+			log.Printf("Added ephemeral onion service: %s", t.hostnames[i])
+		} else {
+			hostnameBytes, err := waitForFile(filepath.Join(svc.hsDir, "hostname"), torStartupTimeout, abort)
+			if err != nil {
+				return fmt.Errorf("failed to read onion hostname of %s: %v", svc.name, err)
+			}
+			t.hostnames[i] = strings.TrimSpace(string(hostnameBytes))
+		}
+	}
+
+	// The old onion of a rotated key is published ephemerally, so that it
+	// can be removed at the end of the overlap without restarting tor.
+	hostnames := append([]string(nil), t.hostnames...)
+	for i, svc := range s.services {
+		if !svc.retiring.active() {
+			continue
+		}
+		id, err := svc.addOnion(ctrl, svc.retiring.expandedKey, svc.retiring.clientAuth)
+		if err != nil {
+			return fmt.Errorf("failed to add the retiring onion service of %s: %v", svc.name, err)
+		}
+		t.retiringIDs[i] = id
+		hostnames = append(hostnames, svc.retiring.hostname)
+		log.Printf("Added retiring onion service %s until %s", svc.retiring.hostname, svc.retiring.retireAt.Format(time.RFC3339))
+	}
+
+	return waitForOnionServices(ctrl, hostnames, abort)
+}
+
+// addOnion publishes svc's ports under expandedKey with ADD_ONION and
+// returns the service ID.
+func (svc *onionService) addOnion(ctrl *torController, expandedKey []byte, clientAuth []string) (string, error) {
+	keySpec := "ED25519-V3:" + base64.StdEncoding.EncodeToString(expandedKey)
+	opts, _ := svc.dos.onionOptions()
+	opts.Flags = append([]string{"DiscardPK"}, opts.Flags...)
+	opts.ClientAuth = clientAuth
+	return ctrl.addOnion(keySpec, addOnionPortSpecs(svc.ports), opts)
+}
+
+// nextRetirement returns a channel that fires when the next old onion
+// published in t is due to be retired, or nil if there is none.
+func (s *torSupervisor) nextRetirement(t *torProcess) <-chan time.Time {
+	var next time.Time
+	for i, id := range t.retiringIDs {
+		if id == "" {
+			continue
+		}
+		if at := s.services[i].retiring.retireAt; next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(next))
+}
+
+// retireOnions removes the old onions published in t whose overlap has
+// ended.
+func (s *torSupervisor) retireOnions(t *torProcess) {
+	for i, id := range t.retiringIDs {
+		svc := s.services[i]
+		if id == "" || svc.retiring.active() {
+			continue
+		}
+		// Not retried on failure: the onion goes away with our control
+		// connection at the latest, and is not added again.
+		t.retiringIDs[i] = ""
+		if err := t.ctrl.delOnion(id); err != nil {
+			log.Printf("Failed to retire %s: %v", svc.retiring.hostname, err)
+			continue
+		}
+		log.Printf("Retired %s; %s is now only reachable at %s", svc.retiring.hostname, svc.name, t.hostnames[i])
+	}
+}
+
+// recordSocks makes tor's SOCKS listener the one TorDialers use by
+// default. With several listeners the first is used.
+func (s *torSupervisor) recordSocks(ctrl *torController) {
+	addrs, err := ctrl.socksListeners()
+	if err != nil {
+		log.Printf("Failed to look up tor's SOCKS port: %v", err)
+		return
+	}
+	if len(addrs) == 0 {
+		setTorSocks("")
+		return
+	}
+	setTorSocks(addrs[0])
+}
+
+// logStats logs the circuit and stream statistics of the live services
+// every statsInterval until quit is closed.
+func (s *torSupervisor) logStats(t *torProcess, quit <-chan struct{}) {
+	ticker := time.NewTicker(s.statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+		for i, svc := range s.services {
+			stats, err := t.ctrl.serviceStats(strings.TrimSuffix(t.hostnames[i], ".onion"))
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			if err != nil {
+				log.Printf("Failed to read onion service statistics: %v", err)
+				break
+			}
+			log.Printf("Onion service %s: %d introduction circuits, %d clients connected, %d open streams",
+				svc.name, stats.IntroCircuits, stats.RendCircuits, stats.Streams)
+		}
+	}
+}
+
+// watchDescriptors records the descriptor uploads tor reports after the
+// services went live, until quit is closed or the control connection is
+// lost.
+func (s *torSupervisor) watchDescriptors(t *torProcess, quit <-chan struct{}) {
+	for {
+		select {
+		case ev := <-t.ctrl.events:
+			fields := strings.Fields(strings.Join(ev.Lines, " "))
+			if len(fields) < 3 || fields[0] != "HS_DESC" || fields[1] != "UPLOADED" {
+				continue
+			}
+			for i, hostname := range t.hostnames {
+				if strings.TrimSuffix(hostname, ".onion") == fields[2] {
+					s.status.descriptorUploaded(i)
+				}
+			}
+		case <-t.ctrl.done:
+			return
+		case <-quit:
+			return
+		}
+	}
+}
+
+// shutdown stops serving: in-flight HTTP requests are given time to finish,
+// then the ephemeral services are removed and tor is stopped. t may be nil
+// if tor is not running.
+func (s *torSupervisor) shutdown(t *torProcess) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	for _, svc := range s.services {
+		if err := svc.server.Shutdown(ctx); err != nil {
+			log.Printf("HTTP server of %s did not shut down cleanly: %v", svc.name, err)
+		}
+		if svc.clearnetServer == nil {
+			continue
+		}
+		if err := svc.clearnetServer.Shutdown(ctx); err != nil {
+			log.Printf("Clearnet server of %s did not shut down cleanly: %v", svc.name, err)
+		}
+	}
+	if t != nil {
+		s.stopTor(t)
+	}
+}
+
+// stopTor removes the ephemeral services, asks tor to exit with SIGTERM and
+// kills it if it has not exited after torStopTimeout. An external tor is
+// left running.
+func (s *torSupervisor) stopTor(t *torProcess) {
+	if t.ctrl != nil {
+		for i, id := range t.serviceIDs {
+			if id == "" {
+				continue
+			}
+			if err := t.ctrl.delOnion(id); err != nil {
+				log.Printf("Failed to remove ephemeral onion service: %v", err)
+			} else {
+				log.Printf("Removed ephemeral onion service: %s", t.hostnames[i])
+			}
+		}
+		for i, id := range t.retiringIDs {
+			if id == "" {
+				continue
+			}
+			if err := t.ctrl.delOnion(id); err != nil {
+				log.Printf("Failed to remove retiring onion service: %v", err)
+			} else {
+				log.Printf("Removed retiring onion service: %s", s.services[i].retiring.hostname)
+			}
+		}
+		t.ctrl.close()
+	}
+	if t.signal == nil {
+		return
+	}
+	select {
+	case <-t.exited:
+		return
+	default:
+	}
+	t.signal(syscall.SIGTERM)
+	select {
+	case <-t.exited:
+		log.Printf("Tor stopped")
+	case <-time.After(torStopTimeout):
+		log.Printf("Tor did not exit within %s, killing it", torStopTimeout)
+		t.signal(os.Kill)
+		<-t.exited
+	}
+}
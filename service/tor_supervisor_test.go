@@ -0,0 +1,227 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSupervisor returns a supervisor running script as tor, with an
+// HTTP server answering "ok".
+func newTestSupervisor(t *testing.T, script string) (*torSupervisor, net.Listener) {
+	t.Helper()
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "tor")
+	require.NoError(t, os.WriteFile(binary, []byte("#!/bin/sh\n"+script+"\n"), 0700))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	return &torSupervisor{
+		launcher:        execTorLauncher{binary: binary},
+		torrc:           filepath.Join(dir, "torrc"),
+		controlPortFile: filepath.Join(dir, "control_port"),
+		cookieFile:      filepath.Join(dir, "cookie"),
+		services: []*onionService{{
+			name:     "test",
+			hsDir:    dir,
+			listener: ln,
+			server:   &http.Server{Handler: handler},
+		}},
+	}, ln
+}
+
+// shortenSupervisorTimeouts makes restarts fast for the duration of a test.
+func shortenSupervisorTimeouts(t *testing.T) {
+	oldBackoff, oldMaxBackoff, oldFailures := torRestartBackoff, torMaxRestartBackoff, torMaxStartFailures
+	oldStartup, oldStop := torStartupTimeout, torStopTimeout
+	torRestartBackoff = 10 * time.Millisecond
+	torMaxRestartBackoff = 40 * time.Millisecond
+	torMaxStartFailures = 3
+	torStartupTimeout = 2 * time.Second
+	torStopTimeout = 2 * time.Second
+	t.Cleanup(func() {
+		torRestartBackoff, torMaxRestartBackoff, torMaxStartFailures = oldBackoff, oldMaxBackoff, oldFailures
+		torStartupTimeout, torStopTimeout = oldStartup, oldStop
+	})
+}
+
+func TestSupervisorRestartsAndGivesUp(t *testing.T) {
+	shortenSupervisorTimeouts(t)
+	counter := filepath.Join(t.TempDir(), "starts")
+	sup, ln := newTestSupervisor(t, "echo start >> "+counter+"\nexit 1")
+
+	err := sup.run(make(chan os.Signal))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to start 3 times")
+
+	starts, err := os.ReadFile(counter)
+	require.NoError(t, err)
+	assert.Equal(t, "start\nstart\nstart\n", string(starts))
+
+	// The HTTP server is shut down with tor.
+	_, err = net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	assert.Error(t, err)
+}
+
+func TestSupervisorStopsWhenHTTPServerFailsDuringBackoff(t *testing.T) {
+	shortenSupervisorTimeouts(t)
+	torRestartBackoff = time.Hour
+	sup, ln := newTestSupervisor(t, "exit 1")
+	sup.status = newServeStatus(sup.services, []site{{}})
+	ln.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- sup.run(make(chan os.Signal)) }()
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "HTTP server stopped")
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor kept waiting to restart tor")
+	}
+	assert.Equal(t, torStopping, sup.status.report().Tor.State)
+	assert.ErrorIs(t, sup.services[0].server.Serve(ln), http.ErrServerClosed, "everything is shut down")
+}
+
+func TestSupervisorStopsOnSignal(t *testing.T) {
+	shortenSupervisorTimeouts(t)
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	// A tor that never opens its control port.
+	sup, ln := newTestSupervisor(t, "echo $$ > "+pidFile+"\nexec sleep 30")
+
+	sigs := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- sup.run(sigs) }()
+
+	resp, err := http.Get("http://" + ln.Addr().String())
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(pidFile)
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	sigs <- syscall.SIGTERM
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+
+	var pid int
+	data, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	_, err = fmt.Sscan(string(data), &pid)
+	require.NoError(t, err)
+	assert.Error(t, syscall.Kill(pid, 0), "tor should have been stopped")
+}
+
+func TestSupervisorAttachesToExternalTor(t *testing.T) {
+	shortenSupervisorTimeouts(t)
+	control, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer control.Close()
+
+	// Two sites share the external tor.
+	var services []*onionService
+	for _, name := range []string{"blog", "docs"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		services = append(services, &onionService{
+			name:        name,
+			ephemeral:   true,
+			expandedKey: make([]byte, 64),
+			ports:       []portMapping{{VirtPort: 80, Target: ln.Addr().String()}},
+			listener:    ln,
+			server:      &http.Server{},
+		})
+	}
+	docsPort := services[1].listener.Addr().String()
+
+	received := make(chan string, 64)
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := control.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			port := &scriptedControlPort{conn: conn, received: received, respond: func(cmd string) []string {
+				switch {
+				case cmd == "PROTOCOLINFO 1":
+					return []string{"250-PROTOCOLINFO 1", "250-AUTH METHODS=NULL", "250 OK"}
+				case cmd == "AUTHENTICATE", cmd == "SETEVENTS HS_DESC", strings.HasPrefix(cmd, "DEL_ONION"):
+					return []string{"250 OK"}
+				case strings.HasPrefix(cmd, "ADD_ONION ED25519-V3:"):
+					// Tell the two services apart by their backend port.
+					id := "blogonion"
+					if strings.HasSuffix(cmd, docsPort) {
+						id = "docsonion"
+					}
+					return []string{"250-ServiceID=" + id, "250 OK",
+						"650 HS_DESC UPLOADED " + id + " UNKNOWN $AAAA"}
+				case cmd == "GETINFO status/bootstrap-phase":
+					return []string{`250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`, "250 OK"}
+				}
+				return nil
+			}}
+			go port.serve()
+		}
+	}()
+
+	sup := &torSupervisor{controlAddr: control.Addr().String(), services: services}
+	sigs := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- sup.run(sigs) }()
+
+	waitFor := func(prefix string) {
+		t.Helper()
+		for {
+			select {
+			case cmd := <-received:
+				if strings.HasPrefix(cmd, prefix) {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s received", prefix)
+			}
+		}
+	}
+
+	// Losing the control connection makes the supervisor attach again and
+	// re-add the services; the external tor itself is never signalled.
+	waitFor("ADD_ONION")
+	waitFor("ADD_ONION")
+	waitFor("GETINFO")
+	(<-conns).Close()
+	waitFor("ADD_ONION")
+	waitFor("ADD_ONION")
+	waitFor("GETINFO")
+
+	sigs <- syscall.SIGTERM
+	waitFor("DEL_ONION blogonion")
+	waitFor("DEL_ONION docsonion")
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+}
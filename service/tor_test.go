@@ -0,0 +1,76 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractTorBinaryIsCachedAndVerified(t *testing.T) {
+	oldBinary, oldDir := torBinary, torCacheDir
+	torBinary = []byte("#!/bin/sh\necho fake tor\n")
+	torCacheDir = t.TempDir()
+	t.Cleanup(func() { torBinary, torCacheDir = oldBinary, oldDir })
+
+	path, err := extractTorBinary()
+	require.NoError(t, err)
+	assert.Equal(t, torCacheDir, filepath.Dir(path))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, torBinary, data)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// A second run reuses the cached copy.
+	before := info.ModTime()
+	again, err := extractTorBinary()
+	require.NoError(t, err)
+	assert.Equal(t, path, again)
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, before, info.ModTime())
+
+	// A modified copy fails verification and is replaced.
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\necho tampered\n"), 0700))
+	again, err = extractTorBinary()
+	require.NoError(t, err)
+	assert.Equal(t, path, again)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, torBinary, data)
+
+	// A different embedded binary gets its own file.
+	torBinary = []byte("#!/bin/sh\necho newer tor\n")
+	newer, err := extractTorBinary()
+	require.NoError(t, err)
+	assert.NotEqual(t, path, newer)
+
+	entries, err := os.ReadDir(torCacheDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "no temporary files are left behind")
+}
+
+func TestResolveTorBinary(t *testing.T) {
+	path, err := resolveTorBinary("sh")
+	require.NoError(t, err)
+	assert.True(t, filepath.IsAbs(path))
+
+	_, err = resolveTorBinary(filepath.Join(t.TempDir(), "no-such-tor"))
+	assert.Error(t, err)
+}
+
+func TestTorEnvDropsSecrets(t *testing.T) {
+	t.Setenv("CHEESEBURGER_PASSPHRASE", "hunter2")
+	t.Setenv("CHEESEBURGER_TOR_CONTROL_PASSWORD", "s3cret")
+	t.Setenv("TZ", "UTC")
+	env := torEnv()
+	assert.Contains(t, env, "TZ=UTC")
+	for _, kv := range env {
+		assert.False(t, strings.HasPrefix(kv, "CHEESEBURGER_"), kv)
+	}
+}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// portMapping maps a virtual port of the onion service to a local target,
+// either "host:port" or "unix:/path".
+type portMapping struct {
+	VirtPort int
+	Target   string
+}
+
+// String formats the mapping as accepted by --hs-port.
+func (m portMapping) String() string {
+	return fmt.Sprintf("%d:%s", m.VirtPort, m.Target)
+}
+
+// parsePortMapping parses VIRT:TARGET where TARGET is a port on 127.0.0.1,
+// a host:port or unix:/path.
+func parsePortMapping(s string) (portMapping, error) {
+	virt, target, ok := strings.Cut(s, ":")
+	if !ok || target == "" {
+		return portMapping{}, fmt.Errorf("port mapping %q must be VIRTPORT:TARGET", s)
+	}
+	port, err := strconv.Atoi(virt)
+	if err != nil || !validPort(port) {
+		return portMapping{}, fmt.Errorf("invalid virtual port in %q", s)
+	}
+	switch {
+	case strings.HasPrefix(target, "unix:"):
+		if !filepath.IsAbs(strings.TrimPrefix(target, "unix:")) {
+			return portMapping{}, fmt.Errorf("unix socket in %q must be an absolute path", s)
+		}
+	case !strings.Contains(target, ":"):
+		p, err := strconv.Atoi(target)
+		if err != nil || !validPort(p) {
+			return portMapping{}, fmt.Errorf("invalid target port in %q", s)
+		}
+		target = net.JoinHostPort("127.0.0.1", target)
+	default:
+		_, p, err := net.SplitHostPort(target)
+		if err != nil {
+			return portMapping{}, fmt.Errorf("invalid target in %q: %v", s, err)
+		}
+		if n, err := strconv.Atoi(p); err != nil || !validPort(n) {
+			return portMapping{}, fmt.Errorf("invalid target port in %q", s)
+		}
+	}
+	return portMapping{VirtPort: port, Target: target}, nil
+}
+
+func validPort(p int) bool {
+	return p > 0 && p < 65536
+}
+
+// portMappingsFlag collects repeated --hs-port flags.
+type portMappingsFlag struct {
+	mappings *[]portMapping
+}
+
+func (f portMappingsFlag) String() string {
+	if f.mappings == nil {
+		return ""
+	}
+	var parts []string
+	for _, m := range *f.mappings {
+		parts = append(parts, m.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f portMappingsFlag) Set(v string) error {
+	m, err := parsePortMapping(v)
+	if err != nil {
+		return err
+	}
+	*f.mappings = append(*f.mappings, m)
+	return nil
+}
+
+// hiddenServiceConfig is one HiddenServiceDir block of a torrc.
+type hiddenServiceConfig struct {
+	Dir   string
+	Ports []portMapping
+	DoS   dosConfig
+}
+
+// torrcConfig describes the torrc cheeseburger generates for tor.
+type torrcConfig struct {
+	DataDirectory string
+	// SocksPort is tor's SOCKS port; 0 disables it.
+	SocksPort int
+	// ControlPort is tor's control port; 0 lets tor pick a free one.
+	ControlPort     int
+	ControlPortFile string
+	CookieAuthFile  string
+	// HiddenServices omits ephemeral services, which are added over the
+	// control port instead.
+	HiddenServices []hiddenServiceConfig
+	// Include is an optional file of extra directives, pulled in with
+	// %include.
+	Include string
+}
+
+// validate checks the configuration before it is written.
+func (c torrcConfig) validate() error {
+	if c.DataDirectory == "" {
+		return fmt.Errorf("torrc: DataDirectory is required")
+	}
+	if c.SocksPort != 0 && !validPort(c.SocksPort) {
+		return fmt.Errorf("torrc: invalid SOCKS port %d", c.SocksPort)
+	}
+	if c.ControlPort != 0 && !validPort(c.ControlPort) {
+		return fmt.Errorf("torrc: invalid control port %d", c.ControlPort)
+	}
+	if c.ControlPort != 0 && c.ControlPort == c.SocksPort {
+		return fmt.Errorf("torrc: SOCKS and control port are both %d", c.SocksPort)
+	}
+	dirs := make(map[string]bool)
+	for _, hs := range c.HiddenServices {
+		if dirs[hs.Dir] {
+			return fmt.Errorf("torrc: hidden service directory %s is used twice", hs.Dir)
+		}
+		dirs[hs.Dir] = true
+		if len(hs.Ports) == 0 {
+			return fmt.Errorf("torrc: hidden service %s needs at least one port", hs.Dir)
+		}
+		seen := make(map[int]bool)
+		for _, p := range hs.Ports {
+			if seen[p.VirtPort] {
+				return fmt.Errorf("torrc: virtual port %d is mapped twice", p.VirtPort)
+			}
+			seen[p.VirtPort] = true
+		}
+	}
+	if c.Include != "" {
+		if !filepath.IsAbs(c.Include) {
+			return fmt.Errorf("torrc: include file %s must be an absolute path", c.Include)
+		}
+		if _, err := os.Stat(c.Include); err != nil {
+			return fmt.Errorf("torrc: include file: %v", err)
+		}
+	}
+	return nil
+}
+
+// String renders the torrc.
+func (c torrcConfig) String() string {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+
+	line("# Write Tor's runtime data here")
+	line("DataDirectory %s", c.DataDirectory)
+	line("")
+	if c.SocksPort == 0 {
+		line("# SOCKS proxy disabled")
+		line("SocksPort 0")
+	} else {
+		line("# Open a SOCKS port for local connections")
+		line("SocksPort 127.0.0.1:%d", c.SocksPort)
+	}
+	line("")
+	line("# Control port used to follow bootstrap and descriptor publication")
+	if c.ControlPort == 0 {
+		line("ControlPort auto")
+	} else {
+		line("ControlPort 127.0.0.1:%d", c.ControlPort)
+	}
+	line("ControlPortWriteToFile %s", c.ControlPortFile)
+	line("CookieAuthentication 1")
+	line("CookieAuthFile %s", c.CookieAuthFile)
+	line("")
+	for _, hs := range c.HiddenServices {
+		line("# Our hidden service")
+		line("HiddenServiceDir %s", hs.Dir)
+		for _, p := range hs.Ports {
+			line("HiddenServicePort %d %s", p.VirtPort, p.Target)
+		}
+		if dos := hs.DoS.torrcLines(); len(dos) > 0 {
+			line("# DoS defenses")
+			for _, l := range dos {
+				line("%s", l)
+			}
+		}
+		line("")
+	}
+	line("# Log notice to stdout")
+	line("Log notice stdout")
+	if c.Include != "" {
+		line("")
+		line("# User supplied directives")
+		line("%%include %s", c.Include)
+	}
+	return b.String()
+}
+
+// addOnionPortSpecs returns the mappings in ADD_ONION's Port= syntax.
+func addOnionPortSpecs(ports []portMapping) []string {
+	var out []string
+	for _, p := range ports {
+		out = append(out, fmt.Sprintf("%d,%s", p.VirtPort, p.Target))
+	}
+	return out
+}
+
+// verifyTorrc asks tor to check the generated configuration without
+// starting, so mistakes in user overrides are reported before launch.
+func verifyTorrc(torPath, torrcPath string) error {
+	var out bytes.Buffer
+	cmd := exec.Command(torPath, "--verify-config", "-f", torrcPath)
+	cmd.Env = torEnv()
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("tor rejected the generated torrc (%v):\n%s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
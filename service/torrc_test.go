@@ -0,0 +1,125 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	cases := map[string]portMapping{
+		"22:2222":               {VirtPort: 22, Target: "127.0.0.1:2222"},
+		"443:127.0.0.1:8443":    {VirtPort: 443, Target: "127.0.0.1:8443"},
+		"6667:[::1]:6667":       {VirtPort: 6667, Target: "[::1]:6667"},
+		"81:unix:/run/app.sock": {VirtPort: 81, Target: "unix:/run/app.sock"},
+	}
+	for in, want := range cases {
+		got, err := parsePortMapping(in)
+		if assert.NoError(t, err, in) {
+			assert.Equal(t, want, got, in)
+		}
+	}
+
+	for _, in := range []string{"", "22", "22:", "x:22", "0:22", "22:70000", "22:host:", "81:unix:relative.sock"} {
+		_, err := parsePortMapping(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestTorrcString(t *testing.T) {
+	c := torrcConfig{
+		DataDirectory:   "/tmp/data",
+		SocksPort:       0,
+		ControlPort:     9151,
+		ControlPortFile: "/tmp/control_port",
+		CookieAuthFile:  "/tmp/cookie",
+		HiddenServices: []hiddenServiceConfig{{
+			Dir: "/tmp/hs",
+			Ports: []portMapping{
+				{VirtPort: 80, Target: "127.0.0.1:8080"},
+				{VirtPort: 22, Target: "127.0.0.1:22"},
+			},
+		}, {
+			Dir:   "/tmp/hs2",
+			Ports: []portMapping{{VirtPort: 80, Target: "127.0.0.1:8081"}},
+		}},
+		Include: "/etc/cheeseburger/extra.torrc",
+	}
+	s := c.String()
+	assert.Contains(t, s, "DataDirectory /tmp/data\n")
+	assert.Contains(t, s, "SocksPort 0\n")
+	assert.Contains(t, s, "ControlPort 127.0.0.1:9151\n")
+	assert.Contains(t, s, "HiddenServiceDir /tmp/hs\nHiddenServicePort 80 127.0.0.1:8080\nHiddenServicePort 22 127.0.0.1:22\n")
+	assert.Contains(t, s, "HiddenServiceDir /tmp/hs2\nHiddenServicePort 80 127.0.0.1:8081\n")
+	assert.Contains(t, s, "Log notice stdout\n")
+	assert.True(t, strings.HasSuffix(s, "%include /etc/cheeseburger/extra.torrc\n"))
+
+	c.SocksPort = 9150
+	c.ControlPort = 0
+	c.HiddenServices = nil
+	c.Include = ""
+	s = c.String()
+	assert.Contains(t, s, "SocksPort 127.0.0.1:9150\n")
+	assert.Contains(t, s, "ControlPort auto\n")
+	assert.NotContains(t, s, "HiddenService")
+	assert.NotContains(t, s, "%include")
+}
+
+func TestTorrcValidate(t *testing.T) {
+	include := filepath.Join(t.TempDir(), "extra.torrc")
+	require.NoError(t, os.WriteFile(include, []byte("NumEntryGuards 4\n"), 0600))
+
+	valid := torrcConfig{
+		DataDirectory: "/tmp/data",
+		SocksPort:     9050,
+		HiddenServices: []hiddenServiceConfig{{
+			Dir:   "/tmp/hs",
+			Ports: []portMapping{{VirtPort: 80, Target: "127.0.0.1:8080"}},
+		}},
+		Include: include,
+	}
+	assert.NoError(t, valid.validate())
+
+	broken := []func(c *torrcConfig){
+		func(c *torrcConfig) { c.DataDirectory = "" },
+		func(c *torrcConfig) { c.SocksPort = 70000 },
+		func(c *torrcConfig) { c.ControlPort = -1 },
+		func(c *torrcConfig) { c.ControlPort = 9050 },
+		func(c *torrcConfig) { c.HiddenServices[0].Ports = nil },
+		func(c *torrcConfig) {
+			c.HiddenServices[0].Ports = append(c.HiddenServices[0].Ports, portMapping{VirtPort: 80, Target: "127.0.0.1:9090"})
+		},
+		func(c *torrcConfig) { c.HiddenServices = append(c.HiddenServices, c.HiddenServices[0]) },
+		func(c *torrcConfig) { c.Include = "extra.torrc" },
+		func(c *torrcConfig) { c.Include = include + ".missing" },
+	}
+	for i, f := range broken {
+		c := valid
+		c.HiddenServices = []hiddenServiceConfig{{
+			Dir:   valid.HiddenServices[0].Dir,
+			Ports: append([]portMapping(nil), valid.HiddenServices[0].Ports...),
+		}}
+		f(&c)
+		assert.Error(t, c.validate(), "case %d", i)
+	}
+}
+
+func TestVerifyTorrc(t *testing.T) {
+	dir := t.TempDir()
+	torrc := filepath.Join(dir, "torrc")
+	require.NoError(t, os.WriteFile(torrc, []byte("SocksPort 0\n"), 0600))
+
+	ok := filepath.Join(dir, "tor-ok")
+	require.NoError(t, os.WriteFile(ok, []byte("#!/bin/sh\n[ \"$1\" = --verify-config ] && [ \"$2\" = -f ] && [ -f \"$3\" ]\n"), 0700))
+	assert.NoError(t, verifyTorrc(ok, torrc))
+
+	bad := filepath.Join(dir, "tor-bad")
+	require.NoError(t, os.WriteFile(bad, []byte("#!/bin/sh\necho '[warn] Failed to parse/validate config: Unknown option Bogus'\nexit 1\n"), 0700))
+	err := verifyTorrc(bad, torrc)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Unknown option Bogus")
+}
@@ -0,0 +1,289 @@
+package service
+
+import (
+	"bytes"
+	"cheeseburger/app/routes"
+	"cheeseburger/config"
+	"cheeseburger/keys"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultSitesFile is the configuration "cheeseburger up" reads by default.
+const defaultSitesFile = "sites.yaml"
+
+// upConfig is the sites file of "cheeseburger up": one tor and any number
+// of sites published through it. Paths and defaults the sites file does not
+// cover come from the project configuration (cheeseburger.yaml).
+type upConfig struct {
+	Tor   upTorConfig    `yaml:"tor"`
+	Sites []upSiteConfig `yaml:"sites"`
+
+	project *config.Config
+}
+
+// upTorConfig mirrors the tor flags of "serve". Pointers distinguish an
+// explicit 0 from an omitted value.
+type upTorConfig struct {
+	SocksPort     *int          `yaml:"socks_port"`
+	ControlPort   int           `yaml:"control_port"`
+	DataDir       string        `yaml:"data_dir"`
+	TorPath       string        `yaml:"tor_path"`
+	Control       string        `yaml:"control"`
+	TorrcInclude  string        `yaml:"torrc_include"`
+	StatsInterval time.Duration `yaml:"stats_interval"`
+}
+
+// upSiteConfig is one site: a static directory or the MVC app, served
+// under its own vanity key from a private Unix socket, or from a loopback
+// port if Port is set.
+type upSiteConfig struct {
+	// Name is the vanity key under paths.vanity the site is published with.
+	Name      string `yaml:"name"`
+	Type      string `yaml:"type"`
+	Dir       string `yaml:"dir"`
+	DB        string `yaml:"db"`
+	Port      int    `yaml:"port"`
+	Ephemeral bool   `yaml:"ephemeral"`
+	DoSPreset string `yaml:"dos_preset"`
+	// ClearnetAddr, ClearnetCert and ClearnetKey also serve the site on
+	// clearnet, as --clearnet-addr and friends do for serve.
+	ClearnetAddr string `yaml:"clearnet_addr"`
+	ClearnetCert string `yaml:"clearnet_cert"`
+	ClearnetKey  string `yaml:"clearnet_key"`
+	// Cache sets the Cache-Control of a static site's files, as
+	// --cache-control does for serve; serve.cache applies if it is empty.
+	Cache []config.CacheRule `yaml:"cache"`
+
+	// vanityDir holds the key bundle named by Name (paths.vanity).
+	vanityDir string
+}
+
+// loadUpConfig reads and validates the sites file at path, taking defaults
+// from the project configuration. Unknown keys are rejected so that typos
+// do not silently fall back to defaults.
+func loadUpConfig(cfg *config.Config, path string) (*upConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := upConfig{project: cfg}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range c.Sites {
+		s := &c.Sites[i]
+		s.vanityDir = cfg.Paths.Vanity
+		if s.Type == "mvc" && s.DB == "" {
+			s.DB = cfg.Paths.DB
+		}
+		if s.Type == "static" && s.Cache == nil {
+			s.Cache = cfg.Serve.Cache
+		}
+		if s.DoSPreset == "" {
+			s.DoSPreset = "off"
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &c, nil
+}
+
+// validate checks the sites against each other and the tor settings.
+func (c *upConfig) validate() error {
+	if len(c.Sites) == 0 {
+		return fmt.Errorf("no sites configured")
+	}
+	t := c.Tor
+	if t.Control != "" && (t.SocksPort != nil || t.ControlPort != 0 || t.DataDir != "" || t.TorPath != "" || t.TorrcInclude != "") {
+		return fmt.Errorf("tor.control cannot be combined with settings for a launched tor")
+	}
+	if t.StatsInterval < 0 {
+		return fmt.Errorf("invalid tor.stats_interval %s", t.StatsInterval)
+	}
+	torPorts := map[int]bool{c.torOptions().SocksPort: true, t.ControlPort: true}
+
+	names := make(map[string]bool)
+	ports := make(map[int]string)
+	dbs := make(map[string]string)
+	clearnet := make(map[string]string)
+	for i, s := range c.Sites {
+		if err := keys.ValidateName(s.Name); err != nil {
+			return fmt.Errorf("site %d: %v", i+1, err)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("site %s is configured twice", s.Name)
+		}
+		names[s.Name] = true
+
+		if s.Port == 0 && t.Control != "" {
+			// The external tor usually cannot open our private socket.
+			return fmt.Errorf("site %s needs a port when attaching to the tor at %s", s.Name, t.Control)
+		}
+		if s.Port != 0 {
+			if !validPort(s.Port) {
+				return fmt.Errorf("site %s: invalid port %d", s.Name, s.Port)
+			}
+			if other, ok := ports[s.Port]; ok {
+				return fmt.Errorf("sites %s and %s both use port %d", other, s.Name, s.Port)
+			}
+			if torPorts[s.Port] {
+				return fmt.Errorf("site %s: port %d is used by tor", s.Name, s.Port)
+			}
+			ports[s.Port] = s.Name
+		}
+
+		switch s.Type {
+		case "static":
+			info, err := os.Stat(s.Dir)
+			if err != nil {
+				return fmt.Errorf("site %s: %v", s.Name, err)
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("site %s: %s is not a directory", s.Name, s.Dir)
+			}
+			for _, r := range s.Cache {
+				if err := r.Validate(); err != nil {
+					return fmt.Errorf("site %s: %v", s.Name, err)
+				}
+			}
+		case "mvc":
+			if len(s.Cache) > 0 {
+				return fmt.Errorf("site %s: cache applies to static sites only", s.Name)
+			}
+			db := filepath.Clean(s.DB)
+			if other, ok := dbs[db]; ok {
+				return fmt.Errorf("sites %s and %s both use the database %s", other, s.Name, s.DB)
+			}
+			dbs[db] = s.Name
+		default:
+			return fmt.Errorf("site %s: type must be static or mvc, not %q", s.Name, s.Type)
+		}
+
+		if _, ok := dosPresets[s.DoSPreset]; !ok {
+			return fmt.Errorf("site %s: unknown dos_preset %q (choose from %s)", s.Name, s.DoSPreset, dosPresetNames())
+		}
+
+		if err := s.serveOptions().validateClearnet(); err != nil {
+			return fmt.Errorf("site %s: %v", s.Name, err)
+		}
+		if s.ClearnetAddr != "" {
+			if other, ok := clearnet[s.ClearnetAddr]; ok {
+				return fmt.Errorf("sites %s and %s both use the clearnet address %s", other, s.Name, s.ClearnetAddr)
+			}
+			clearnet[s.ClearnetAddr] = s.Name
+		}
+	}
+	return nil
+}
+
+// torOptions returns the tor level options shared by every site.
+func (c *upConfig) torOptions() serveOptions {
+	opts := serveOptions{
+		SocksPort:     c.project.Serve.SocksPort,
+		ControlPort:   c.Tor.ControlPort,
+		TorDataDir:    c.Tor.DataDir,
+		TorDataBase:   c.project.Paths.TorData,
+		TorrcInclude:  c.Tor.TorrcInclude,
+		TorPath:       c.Tor.TorPath,
+		TorControl:    c.Tor.Control,
+		StatsInterval: c.Tor.StatsInterval,
+		AdminSocket:   c.project.Paths.AdminSocket,
+		PassphraseFD:  -1,
+	}
+	if c.Tor.SocksPort != nil {
+		opts.SocksPort = *c.Tor.SocksPort
+	}
+	if opts.TorDataDir == "" && opts.TorControl == "" {
+		// Several keys share this tor, so none of them names its data.
+		opts.TorDataDir = filepath.Join(c.project.Paths.TorData, "up")
+	}
+	return opts
+}
+
+// serveOptions returns the service level options of the site.
+func (s upSiteConfig) serveOptions() serveOptions {
+	opts := serveOptions{
+		VanityName:   s.Name,
+		VanityDir:    s.vanityDir,
+		Ephemeral:    s.Ephemeral,
+		PassphraseFD: -1,
+		Backend:      "unix",
+		ListenPort:   s.Port,
+		DoS:          dosPresets[s.DoSPreset],
+		ClearnetAddr: s.ClearnetAddr,
+		ClearnetCert: s.ClearnetCert,
+		ClearnetKey:  s.ClearnetKey,
+	}
+	if s.Port != 0 {
+		opts.Backend = "tcp"
+	}
+	return opts
+}
+
+// RunUp serves every site of a sites file through a single tor and returns
+// an exit code.
+func RunUp(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("up", flag.ContinueOnError)
+	sitesPath := fs.String("sites", defaultSitesFile, "sites file to serve")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() != 0 {
+		fmt.Println("Error: usage: cheeseburger up [--sites <file>]")
+		return 1
+	}
+	up, err := loadUpConfig(cfg, *sitesPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	// MVC sites make their outgoing requests through the shared tor.
+	client, err := NewTorHTTPClient("")
+	if err != nil {
+		log.Printf("Failed to create the tor HTTP client: %v", err)
+		return 1
+	}
+	var sites []site
+	for _, s := range up.Sites {
+		st := site{opts: s.serveOptions()}
+		switch s.Type {
+		case "static":
+			log.Printf("Site %s: serving directory %s", s.Name, s.Dir)
+			st.handler = newStaticHandler(s.Dir, s.Cache)
+		case "mvc":
+			db, err := badger.Open(badger.DefaultOptions(s.DB))
+			if err != nil {
+				log.Printf("Site %s: failed to open Badger DB %s: %v", s.Name, s.DB, err)
+				return 1
+			}
+			defer db.Close()
+			router := routes.SetupMVCRoutesWithClient(db, client)
+			if router == nil {
+				log.Printf("Site %s: failed to setup MVC routes", s.Name)
+				return 1
+			}
+			log.Printf("Site %s: serving the MVC blog from %s", s.Name, s.DB)
+			st.handler, st.dbPath, st.db = router, s.DB, db
+		}
+		sites = append(sites, st)
+	}
+
+	if err := superviseOnionServices(up.torOptions(), sites); err != nil {
+		log.Printf("Onion services failed: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"cheeseburger/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSitesFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "sites.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadUpConfig(t *testing.T) {
+	public := t.TempDir()
+	path := writeSitesFile(t, `
+tor:
+  socks_port: 0
+  stats_interval: 1m
+sites:
+  - name: blog
+    type: mvc
+  - name: docs
+    type: static
+    dir: `+public+`
+    port: 8081
+    ephemeral: true
+    dos_preset: moderate
+    cache:
+      - {pattern: "*.css", control: "max-age=3600"}
+`)
+	project := config.Default()
+	project.Serve.Cache = []config.CacheRule{{Pattern: "*", Control: "no-cache"}}
+	cfg, err := loadUpConfig(project, path)
+	require.NoError(t, err)
+	require.Len(t, cfg.Sites, 2)
+	assert.Equal(t, config.Default().Paths.DB, cfg.Sites[0].DB)
+	assert.Equal(t, "off", cfg.Sites[0].DoSPreset)
+	assert.Empty(t, cfg.Sites[0].Cache, "serve.cache is for static sites")
+	assert.Equal(t, []config.CacheRule{{Pattern: "*.css", Control: "max-age=3600"}}, cfg.Sites[1].Cache)
+
+	torOpts := cfg.torOptions()
+	assert.Equal(t, 0, torOpts.SocksPort)
+	assert.Equal(t, time.Minute, torOpts.StatsInterval)
+	assert.Equal(t, filepath.Join("data", "tor", "up"), torOpts.TorDataDir)
+
+	blog := cfg.Sites[0].serveOptions()
+	assert.Equal(t, "unix", blog.Backend, "sites without a port use a socket")
+
+	docs := cfg.Sites[1].serveOptions()
+	assert.Equal(t, "docs", docs.VanityName)
+	assert.Equal(t, config.Default().Paths.Vanity, docs.VanityDir)
+	assert.True(t, docs.Ephemeral)
+	assert.Equal(t, "127.0.0.1:8081", docs.backendTarget())
+	assert.Equal(t, dosPresets["moderate"], docs.DoS)
+}
+
+func TestLoadUpConfigDefaults(t *testing.T) {
+	cfg, err := loadUpConfig(config.Default(), writeSitesFile(t, `
+tor:
+  control: 127.0.0.1:9051
+sites:
+  - {name: blog, type: mvc, port: 8080}
+`))
+	require.NoError(t, err)
+	torOpts := cfg.torOptions()
+	assert.Equal(t, 9050, torOpts.SocksPort)
+	assert.Equal(t, "127.0.0.1:9051", torOpts.TorControl)
+	assert.Empty(t, torOpts.TorDataDir, "an attached tor has no data directory of ours")
+}
+
+func TestLoadUpConfigInvalid(t *testing.T) {
+	public := t.TempDir()
+	for _, tc := range []struct{ name, yaml, err string }{
+		{"empty", ``, "no sites"},
+		{"unknown key", "sites:\n  - {name: a, type: mvc, port: 8080, prot: 1}", "prot"},
+		{"bad name", "sites:\n  - {name: a/b, type: mvc, port: 8080}", "invalid key bundle name"},
+		{"duplicate name", "sites:\n  - {name: a, type: mvc, port: 8080}\n  - {name: a, type: static, dir: " + public + ", port: 8081}", "configured twice"},
+		{"bad port", "sites:\n  - {name: a, type: mvc, port: 70000}", "invalid port"},
+		{"socket with control", "tor: {control: 127.0.0.1:9051}\nsites:\n  - {name: a, type: mvc}", "needs a port"},
+		{"shared port", "sites:\n  - {name: a, type: mvc, port: 8080}\n  - {name: b, type: static, dir: " + public + ", port: 8080}", "both use port 8080"},
+		{"tor port", "sites:\n  - {name: a, type: mvc, port: 9050}", "used by tor"},
+		{"shared db", "sites:\n  - {name: a, type: mvc, port: 8080}\n  - {name: b, type: mvc, port: 8081}", "both use the database"},
+		{"missing dir", "sites:\n  - {name: a, type: static, dir: " + filepath.Join(public, "missing") + ", port: 8080}", "no such file"},
+		{"bad type", "sites:\n  - {name: a, type: php, port: 8080}", "type must be static or mvc"},
+		{"bad preset", "sites:\n  - {name: a, type: mvc, port: 8080, dos_preset: max}", "unknown dos_preset"},
+		{"clearnet key", "sites:\n  - {name: a, type: mvc, clearnet_addr: ':8443', clearnet_cert: a.pem}", "must be given together"},
+		{"shared clearnet", "sites:\n  - {name: a, type: mvc, clearnet_addr: ':80'}\n  - {name: b, type: static, dir: " + public + ", clearnet_addr: ':80'}", "both use the clearnet address"},
+		{"bad cache pattern", "sites:\n  - {name: a, type: static, dir: " + public + ", cache: [{pattern: '[', control: no-cache}]}", "invalid cache pattern"},
+		{"mvc cache", "sites:\n  - {name: a, type: mvc, cache: [{pattern: '*', control: no-cache}]}", "static sites only"},
+		{"control conflict", "tor: {control: 127.0.0.1:9051, socks_port: 9150}\nsites:\n  - {name: a, type: mvc, port: 8080}", "tor.control cannot be combined"},
+	} {
+		_, err := loadUpConfig(config.Default(), writeSitesFile(t, tc.yaml))
+		if assert.Error(t, err, tc.name) {
+			assert.True(t, strings.Contains(err.Error(), tc.err), "%s: %v", tc.name, err)
+		}
+	}
+}
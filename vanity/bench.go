@@ -0,0 +1,79 @@
+package vanity
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchReport is the result of "vanity bench".
+type benchReport struct {
+	Type      string    `json:"type"`
+	Workers   int       `json:"workers"`
+	Duration  float64   `json:"duration_seconds"`
+	PerWorker []float64 `json:"per_worker_keys_per_second"`
+	Total     float64   `json:"keys_per_second"`
+}
+
+// runBench measures search throughput per worker. It searches for a prefix
+// long enough to never match, so every worker runs for the whole duration.
+func runBench() {
+	workers := flag.Int("workers", runtime.NumCPU(), "number of parallel workers")
+	duration := flag.Duration("duration", 10*time.Second, "how long to run the benchmark")
+	jsonOutput := flag.Bool("json", false, "print the result as JSON")
+	flag.Parse()
+
+	report := benchmarkSearch(*workers, *duration)
+	if *jsonOutput {
+		writeJSONLine(os.Stdout, report)
+		return
+	}
+
+	fmt.Printf("Benchmarked vanity search with %d workers for %s\n", report.Workers, *duration)
+	for i, rate := range report.PerWorker {
+		fmt.Printf("  worker %d: %s keys/s\n", i+1, humanCount(rate))
+	}
+	fmt.Printf("  total:    %s keys/s\n\n", humanCount(report.Total))
+	fmt.Println("Expected search time by prefix length:")
+	for n := 1; n <= 10; n++ {
+		expected := math.Pow(32, float64(n))
+		fmt.Printf("  %2d characters: %s attempts, ~%s\n", n, humanCount(expected), humanDuration(expected/report.Total))
+	}
+}
+
+// benchmarkSearch runs the given number of search workers for duration.
+func benchmarkSearch(workers int, duration time.Duration) benchReport {
+	patterns, _ := parsePatterns([]string{"aaaaaaaaaaaaaaaaaaaa"}, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	counts := make([]uint64, workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := searchKeys(ctx, patterns, nil, &counts[i], func(candidate) {}); err != nil {
+				log.Printf("Benchmark worker failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start).Seconds()
+
+	report := benchReport{Type: "bench", Workers: workers, Duration: elapsed}
+	for i := range counts {
+		rate := float64(atomic.LoadUint64(&counts[i])) / elapsed
+		report.PerWorker = append(report.PerWorker, rate)
+		report.Total += rate
+	}
+	return report
+}
@@ -0,0 +1,77 @@
+package vanity
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// VanityKey is the metadata stored in vanity.json alongside the tor key
+// files. The secret key itself only lives in hs_ed25519_secret_key.
+type VanityKey struct {
+	OnionAddress string `json:"onion_address"`
+	PublicKey    string `json:"public_key"`
+	Attempts     uint64 `json:"attempts"`
+	Timestamp    string `json:"timestamp"`
+}
+
+// BundleDir returns the directory for the named key bundle under baseDir,
+// which holds one sub-directory per bundle.
+func BundleDir(baseDir, name string) string {
+	if name == "" {
+		name = "default"
+	}
+	return filepath.Join(baseDir, name)
+}
+
+// SaveBundle writes a complete key bundle into dir: tor's
+// hs_ed25519_secret_key, hs_ed25519_public_key and hostname files, plus
+// vanity.json. It refuses to overwrite an existing key. vanity.json is
+// written last, so its presence marks a complete bundle.
+func SaveBundle(dir string, expanded []byte, attempts uint64) (*VanityKey, error) {
+	pub, err := PublicKeyFromExpanded(expanded)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []string{"hs_ed25519_secret_key", "vanity.json"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			return nil, fmt.Errorf("a key already exists in %s; choose another --name or remove it first", dir)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	hostname := OnionAddress(pub) + ".onion"
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"hs_ed25519_secret_key", append([]byte(SecretKeyHeader), expanded...)},
+		{"hs_ed25519_public_key", append([]byte(PublicKeyHeader), pub...)},
+		{"hostname", []byte(hostname + "\n")},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(dir, f.name), f.data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", f.name, err)
+		}
+	}
+
+	vk := &VanityKey{
+		OnionAddress: hostname,
+		PublicKey:    hex.EncodeToString(pub),
+		Attempts:     attempts,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+	}
+	data, err := json.MarshalIndent(vk, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "vanity.json"), append(data, '\n'), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write vanity.json: %v", err)
+	}
+	return vk, nil
+}
@@ -0,0 +1,88 @@
+package vanity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveBundle(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "myblog")
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	expanded := ExpandSeed(priv.Seed())
+
+	vk, err := SaveBundle(dir, expanded[:], 42)
+	if err != nil {
+		t.Fatalf("SaveBundle: %v", err)
+	}
+
+	wantHost := OnionAddress(pub) + ".onion"
+	if vk.OnionAddress != wantHost {
+		t.Errorf("OnionAddress = %s, want %s", vk.OnionAddress, wantHost)
+	}
+
+	secret, err := os.ReadFile(filepath.Join(dir, "hs_ed25519_secret_key"))
+	if err != nil {
+		t.Fatalf("read secret: %v", err)
+	}
+	if got, err := ParseSecretKeyFile(secret); err != nil || !bytes.Equal(got, expanded[:]) {
+		t.Errorf("secret key file does not round-trip: %v", err)
+	}
+	public, err := os.ReadFile(filepath.Join(dir, "hs_ed25519_public_key"))
+	if err != nil {
+		t.Fatalf("read public: %v", err)
+	}
+	if got, err := ParsePublicKeyFile(public); err != nil || !pub.Equal(got) {
+		t.Errorf("public key file does not match: %v", err)
+	}
+	hostname, err := os.ReadFile(filepath.Join(dir, "hostname"))
+	if err != nil {
+		t.Fatalf("read hostname: %v", err)
+	}
+	if strings.TrimSpace(string(hostname)) != wantHost {
+		t.Errorf("hostname = %q, want %q", hostname, wantHost)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "vanity.json"))
+	if err != nil {
+		t.Fatalf("read vanity.json: %v", err)
+	}
+	var stored VanityKey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatalf("unmarshal vanity.json: %v", err)
+	}
+	if stored.OnionAddress != wantHost || stored.PublicKey != hex.EncodeToString(pub) || stored.Attempts != 42 || stored.Timestamp == "" {
+		t.Errorf("unexpected vanity.json contents: %+v", stored)
+	}
+	if strings.Contains(string(data), hex.EncodeToString(expanded[:32])) {
+		t.Error("vanity.json must not contain the secret key")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "hs_ed25519_secret_key"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("secret key should be 0600, got %v", info.Mode().Perm())
+	}
+
+	if _, err := SaveBundle(dir, expanded[:], 1); err == nil {
+		t.Error("expected SaveBundle to refuse overwriting an existing key")
+	}
+}
+
+func TestBundleDir(t *testing.T) {
+	base := t.TempDir()
+	if got := BundleDir(base, "myblog"); got != filepath.Join(base, "myblog") {
+		t.Errorf("BundleDir = %s", got)
+	}
+	if got := BundleDir(base, ""); got != filepath.Join(base, "default") {
+		t.Errorf("BundleDir(\"\") = %s", got)
+	}
+}
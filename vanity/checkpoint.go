@@ -0,0 +1,105 @@
+package vanity
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpoint records the progress of a search so that a restarted search
+// continues its statistics instead of starting from zero. Key search is
+// memoryless, so nothing but the counters needs to survive.
+type checkpoint struct {
+	Patterns  []string `json:"patterns"`
+	Satisfied []string `json:"satisfied,omitempty"`
+	Attempts  uint64   `json:"attempts"`
+	Elapsed   float64  `json:"elapsed_seconds"`
+	Started   string   `json:"started"`
+	Updated   string   `json:"updated"`
+}
+
+// patternStrings describes patterns in checkpoint form.
+func patternStrings(patterns []*pattern) []string {
+	out := make([]string, len(patterns))
+	for i, p := range patterns {
+		out[i] = p.String()
+	}
+	return out
+}
+
+// loadCheckpoint reads the checkpoint at path. It returns nil without an
+// error if there is none yet, or if it belongs to a search for different
+// patterns.
+func loadCheckpoint(path string, patterns []*pattern) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %v", path, err)
+	}
+	want := patternStrings(patterns)
+	if len(cp.Patterns) != len(want) {
+		return nil, nil
+	}
+	for i := range want {
+		if cp.Patterns[i] != want[i] {
+			return nil, nil
+		}
+	}
+	return &cp, nil
+}
+
+// satisfiedFlags maps the recorded satisfied patterns back onto patterns.
+func (cp *checkpoint) satisfiedFlags(patterns []*pattern) []bool {
+	satisfied := make([]bool, len(patterns))
+	for _, s := range cp.Satisfied {
+		for i, p := range patterns {
+			if p.String() == s {
+				satisfied[i] = true
+			}
+		}
+	}
+	return satisfied
+}
+
+// save atomically replaces the checkpoint file at path.
+func (cp *checkpoint) save(path string, patterns []*pattern, satisfied []bool, attempts uint64, elapsed time.Duration) error {
+	cp.Patterns = patternStrings(patterns)
+	cp.Satisfied = nil
+	for i, s := range satisfied {
+		if s {
+			cp.Satisfied = append(cp.Satisfied, patterns[i].String())
+		}
+	}
+	cp.Attempts = attempts
+	cp.Elapsed = elapsed.Seconds()
+	cp.Updated = time.Now().UTC().Format(time.RFC3339)
+	if cp.Started == "" {
+		cp.Started = cp.Updated
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create checkpoint directory: %v", err)
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package vanity
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.json")
+	patterns, _ := parsePatterns([]string{"team", "blog"}, nil, nil)
+
+	cp, err := loadCheckpoint(path, patterns)
+	if err != nil || cp != nil {
+		t.Fatalf("expected no checkpoint yet, got %v, %v", cp, err)
+	}
+
+	cp = &checkpoint{}
+	if err := cp.save(path, patterns, []bool{false, true}, 12345, 3*time.Second); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("checkpoint not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("checkpoint mode %v, want 0600", info.Mode().Perm())
+	}
+
+	loaded, err := loadCheckpoint(path, patterns)
+	if err != nil || loaded == nil {
+		t.Fatalf("loadCheckpoint: %v, %v", loaded, err)
+	}
+	if loaded.Attempts != 12345 || loaded.Elapsed != 3 || loaded.Started == "" {
+		t.Errorf("unexpected checkpoint: %+v", loaded)
+	}
+	if got := loaded.satisfiedFlags(patterns); got[0] || !got[1] {
+		t.Errorf("satisfied = %v, want [false true]", got)
+	}
+
+	// A checkpoint for other patterns is ignored.
+	other, _ := parsePatterns([]string{"shop"}, nil, nil)
+	if cp, err := loadCheckpoint(path, other); err != nil || cp != nil {
+		t.Errorf("expected checkpoint for other patterns to be ignored, got %v, %v", cp, err)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCheckpoint(path, patterns); err == nil {
+		t.Errorf("expected error for corrupt checkpoint")
+	}
+}
+
+// runVanityArgs runs RunVanity with args, saving key bundles under dir, and
+// returns its exit code and log.
+func runVanityArgs(t *testing.T, dir string, args ...string) (int, string) {
+	t.Helper()
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	os.Args = append([]string{"cmd"}, args...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	var logOutput strings.Builder
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	code := RunVanity(testSettings(dir))
+	return code, logOutput.String()
+}
+
+func TestRunVanityLimitsAndResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.json")
+	impossible := strings.Repeat("a", 20)
+
+	code, output := runVanityArgs(t, t.TempDir(), "-workers", "1", "-prefix", impossible, "-max-attempts", "1000", "-checkpoint", path)
+	if code != ExitNoMatch {
+		t.Fatalf("exit code %d, want %d; log: %s", code, ExitNoMatch, output)
+	}
+	if !strings.Contains(output, "Reached --max-attempts") {
+		t.Errorf("expected limit message, got: %s", output)
+	}
+	patterns, _ := parsePatterns([]string{impossible}, nil, nil)
+	first, err := loadCheckpoint(path, patterns)
+	if err != nil || first == nil {
+		t.Fatalf("checkpoint not saved: %v, %v", first, err)
+	}
+	if first.Attempts < 1000 {
+		t.Errorf("checkpoint records %d attempts, want at least 1000", first.Attempts)
+	}
+
+	code, output = runVanityArgs(t, t.TempDir(), "-workers", "1", "-prefix", impossible, "-timeout", "100ms", "-checkpoint", path)
+	if code != ExitNoMatch {
+		t.Fatalf("exit code %d, want %d; log: %s", code, ExitNoMatch, output)
+	}
+	if !strings.Contains(output, "Resuming from checkpoint") || !strings.Contains(output, "Reached --timeout") {
+		t.Errorf("expected resume and timeout messages, got: %s", output)
+	}
+	second, err := loadCheckpoint(path, patterns)
+	if err != nil || second == nil {
+		t.Fatalf("checkpoint not saved: %v, %v", second, err)
+	}
+	if second.Attempts <= first.Attempts || second.Started != first.Started {
+		t.Errorf("statistics did not continue: first %+v, second %+v", first, second)
+	}
+}
+
+func TestRunVanityRemovesCheckpointOnMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.json")
+	code, output := runVanityArgs(t, t.TempDir(), "-workers", "1", "-prefix", "a", "-checkpoint", path)
+	if code != 0 {
+		t.Fatalf("exit code %d; log: %s", code, output)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected checkpoint to be removed after a match, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package vanity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// Headers of tor's hs_ed25519_* key files. Both are NUL padded to 32 bytes.
+const (
+	SecretKeyHeader = "== ed25519v1-secret: type0 ==\x00\x00\x00"
+	PublicKeyHeader = "== ed25519v1-public: type0 ==\x00\x00\x00"
+)
+
+const onionVersion = byte(0x03)
+
+var onionEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// OnionAddress returns the v3 onion address (without ".onion") for an
+// ed25519 public key.
+func OnionAddress(pub ed25519.PublicKey) string {
+	checksumData := append(append([]byte(".onion checksum"), pub...), onionVersion)
+	torHash := sha3.Sum256(checksumData)
+
+	onionBytes := append(append([]byte{}, pub...), torHash[0:2]...)
+	onionBytes = append(onionBytes, onionVersion)
+	return strings.ToLower(onionEncoding.EncodeToString(onionBytes))
+}
+
+// PublicKeyFromOnion decodes a v3 onion address, with or without the
+// ".onion" suffix, and verifies its checksum and version.
+func PublicKeyFromOnion(addr string) (ed25519.PublicKey, error) {
+	addr = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(addr)), ".onion")
+	raw, err := onionEncoding.DecodeString(strings.ToUpper(addr))
+	if err != nil || len(raw) != 35 {
+		return nil, fmt.Errorf("invalid v3 onion address: %s", addr)
+	}
+	pub := ed25519.PublicKey(raw[:32])
+	if OnionAddress(pub) != addr {
+		return nil, fmt.Errorf("onion address checksum mismatch: %s", addr)
+	}
+	return pub, nil
+}
+
+// PublicKeyFromExpanded derives the ed25519 public key for a tor expanded
+// secret key (the clamped scalar followed by the 32-byte nonce prefix).
+func PublicKeyFromExpanded(expanded []byte) (ed25519.PublicKey, error) {
+	if len(expanded) != 64 {
+		return nil, fmt.Errorf("expanded secret key must be 64 bytes, got %d", len(expanded))
+	}
+	s, err := edwards25519.NewScalar().SetBytesWithClamping(expanded[:32])
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(new(edwards25519.Point).ScalarBaseMult(s).Bytes()), nil
+}
+
+// SignExpanded signs message with a tor expanded secret key, following
+// RFC 8032 from the point where the seed has been hashed: the nonce comes
+// from the prefix and the message, and S = H(R,A,M)*a + r. Signatures
+// verify with ed25519.Verify against the key's public key.
+func SignExpanded(expanded, message []byte) ([]byte, error) {
+	pub, err := PublicKeyFromExpanded(expanded)
+	if err != nil {
+		return nil, err
+	}
+	a, err := edwards25519.NewScalar().SetBytesWithClamping(expanded[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha512.New()
+	h.Write(expanded[32:])
+	h.Write(message)
+	r, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(pub)
+	h.Write(message)
+	k, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	S := edwards25519.NewScalar().MultiplyAdd(k, a, r)
+	return append(R, S.Bytes()...), nil
+}
+
+// ExpandSeed converts a standard 32-byte ed25519 seed into tor's expanded
+// secret key format.
+func ExpandSeed(seed []byte) [64]byte {
+	expanded := sha512.Sum512(seed)
+	expanded[0] &= 248
+	expanded[31] &= 127
+	expanded[31] |= 64
+	return expanded
+}
+
+// ParseSecretKeyFile validates the contents of an hs_ed25519_secret_key
+// file and returns the 64-byte expanded secret key.
+func ParseSecretKeyFile(data []byte) ([]byte, error) {
+	if len(data) != 96 || !bytes.Equal(data[:32], []byte(SecretKeyHeader)) {
+		return nil, fmt.Errorf("secret key file has invalid format")
+	}
+	return data[32:], nil
+}
+
+// ParsePublicKeyFile validates the contents of an hs_ed25519_public_key
+// file and returns the 32-byte public key.
+func ParsePublicKeyFile(data []byte) (ed25519.PublicKey, error) {
+	if len(data) != 64 || !bytes.Equal(data[:32], []byte(PublicKeyHeader)) {
+		return nil, fmt.Errorf("public key file has invalid format")
+	}
+	return ed25519.PublicKey(data[32:]), nil
+}
@@ -0,0 +1,109 @@
+package vanity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestPublicKeyFromExpandedMatchesStdlib(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		expanded := ExpandSeed(priv.Seed())
+		derived, err := PublicKeyFromExpanded(expanded[:])
+		if err != nil {
+			t.Fatalf("PublicKeyFromExpanded: %v", err)
+		}
+		if !pub.Equal(derived) {
+			t.Fatalf("derived public key %x does not match %x", derived, pub)
+		}
+	}
+
+	if _, err := PublicKeyFromExpanded(make([]byte, 32)); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
+
+func TestSignExpandedMatchesStdlib(t *testing.T) {
+	msg := []byte("moving to a new onion")
+	for i := 0; i < 8; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		expanded := ExpandSeed(priv.Seed())
+		sig, err := SignExpanded(expanded[:], msg)
+		if err != nil {
+			t.Fatalf("SignExpanded: %v", err)
+		}
+		if !bytes.Equal(sig, ed25519.Sign(priv, msg)) {
+			t.Fatalf("signature differs from crypto/ed25519")
+		}
+		if !ed25519.Verify(pub, msg, sig) || ed25519.Verify(pub, []byte("moving elsewhere"), sig) {
+			t.Fatalf("signature does not verify for exactly its message")
+		}
+	}
+
+	if _, err := SignExpanded(make([]byte, 32), msg); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
+
+func TestOnionAddressRoundTrip(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	addr := OnionAddress(pub)
+	if len(addr) != 56 || strings.ToLower(addr) != addr {
+		t.Fatalf("unexpected onion address %q", addr)
+	}
+
+	decoded, err := PublicKeyFromOnion(addr + ".onion")
+	if err != nil {
+		t.Fatalf("PublicKeyFromOnion: %v", err)
+	}
+	if !pub.Equal(decoded) {
+		t.Errorf("decoded key does not match")
+	}
+
+	// Flip one character: the checksum must catch it.
+	bad := []byte(addr)
+	if bad[0] == 'a' {
+		bad[0] = 'b'
+	} else {
+		bad[0] = 'a'
+	}
+	if _, err := PublicKeyFromOnion(string(bad)); err == nil {
+		t.Error("expected checksum error for a corrupted address")
+	}
+}
+
+func TestKnownOnionAddress(t *testing.T) {
+	// The Tor Project's own onion service.
+	const addr = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid"
+	if _, err := PublicKeyFromOnion(addr); err != nil {
+		t.Errorf("PublicKeyFromOnion(%s): %v", addr, err)
+	}
+}
+
+func TestParseKeyFiles(t *testing.T) {
+	expanded := make([]byte, 64)
+	if _, err := ParseSecretKeyFile(append([]byte(SecretKeyHeader), expanded...)); err != nil {
+		t.Errorf("ParseSecretKeyFile: %v", err)
+	}
+	if _, err := ParseSecretKeyFile(append([]byte(PublicKeyHeader), expanded...)); err == nil {
+		t.Error("expected header mismatch error")
+	}
+	if _, err := ParsePublicKeyFile(append([]byte(PublicKeyHeader), expanded[:32]...)); err != nil {
+		t.Errorf("ParsePublicKeyFile: %v", err)
+	}
+	if _, err := ParsePublicKeyFile([]byte(PublicKeyHeader)); err == nil {
+		t.Error("expected length error")
+	}
+}
@@ -0,0 +1,165 @@
+package vanity
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// onionAlphabet is the lowercase base32 alphabet used by onion addresses.
+const onionAlphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+// onionAddressLen is the length of a v3 onion address without ".onion".
+const onionAddressLen = 56
+
+type patternKind int
+
+const (
+	prefixPattern patternKind = iota
+	suffixPattern
+	regexPattern
+)
+
+// pattern is a single search criterion checked against every generated
+// address.
+type pattern struct {
+	kind  patternKind
+	text  string
+	re    *regexp.Regexp
+	index int
+}
+
+// match reports whether addr (without ".onion") satisfies the pattern.
+func (p *pattern) match(addr string) bool {
+	switch p.kind {
+	case prefixPattern:
+		return strings.HasPrefix(addr, p.text)
+	case suffixPattern:
+		return strings.HasSuffix(addr, p.text)
+	default:
+		return p.re.MatchString(addr)
+	}
+}
+
+// String describes the pattern for log output.
+func (p *pattern) String() string {
+	switch p.kind {
+	case prefixPattern:
+		return fmt.Sprintf("prefix %q", p.text)
+	case suffixPattern:
+		return fmt.Sprintf("suffix %q", p.text)
+	default:
+		return fmt.Sprintf("regex %q", p.text)
+	}
+}
+
+// label is a filesystem-friendly name for the pattern, used to name saved
+// key bundles when searching for several patterns at once.
+func (p *pattern) label() string {
+	switch p.kind {
+	case prefixPattern:
+		return p.text
+	case suffixPattern:
+		return "suffix-" + p.text
+	default:
+		return fmt.Sprintf("regex-%d", p.index+1)
+	}
+}
+
+// listFlag is a flag.Value collecting comma separated values from one or
+// more occurrences of the same flag.
+type listFlag struct {
+	values []string
+	split  bool
+}
+
+func (l *listFlag) String() string {
+	return strings.Join(l.values, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	if !l.split {
+		l.values = append(l.values, v)
+		return nil
+	}
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			l.values = append(l.values, part)
+		}
+	}
+	return nil
+}
+
+// validateBase32 rejects text containing characters that can never appear
+// in an onion address.
+func validateBase32(text string) error {
+	if len(text) > onionAddressLen {
+		return fmt.Errorf("%q is longer than an onion address (%d characters)", text, onionAddressLen)
+	}
+	for _, c := range text {
+		if !strings.ContainsRune(onionAlphabet, c) {
+			return fmt.Errorf("%q contains %q, which is not in the onion alphabet (a-z, 2-7)", text, c)
+		}
+	}
+	return nil
+}
+
+// validateSuffix additionally rejects suffixes that clash with the fixed
+// tail of a v3 address: the last character encodes the version byte (0x03)
+// and is always "d"; the one before it can only be "a", "i", "q" or "y".
+func validateSuffix(text string) error {
+	if err := validateBase32(text); err != nil {
+		return err
+	}
+	n := len(text)
+	if n >= 1 && text[n-1] != 'd' {
+		return fmt.Errorf("suffix %q is impossible: v3 onion addresses always end in \"d\"", text)
+	}
+	if n >= 2 && !strings.ContainsRune("aiqy", rune(text[n-2])) {
+		return fmt.Errorf("suffix %q is impossible: the second to last character is always one of a, i, q, y", text)
+	}
+	return nil
+}
+
+// parsePatterns validates and compiles the requested prefixes, suffixes and
+// regular expressions.
+func parsePatterns(prefixes, suffixes, regexes []string) ([]*pattern, error) {
+	var patterns []*pattern
+	add := func(p *pattern) {
+		p.index = len(patterns)
+		patterns = append(patterns, p)
+	}
+	for _, text := range prefixes {
+		text = strings.ToLower(text)
+		if err := validateBase32(text); err != nil {
+			return nil, fmt.Errorf("invalid prefix: %v", err)
+		}
+		add(&pattern{kind: prefixPattern, text: text})
+	}
+	for _, text := range suffixes {
+		text = strings.ToLower(strings.TrimSuffix(text, ".onion"))
+		if err := validateSuffix(text); err != nil {
+			return nil, fmt.Errorf("invalid suffix: %v", err)
+		}
+		add(&pattern{kind: suffixPattern, text: text})
+	}
+	for _, text := range regexes {
+		re, err := regexp.Compile(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", text, err)
+		}
+		add(&pattern{kind: regexPattern, text: text, re: re})
+	}
+	return patterns, nil
+}
+
+// matchPatterns returns the indexes of every pattern addr satisfies.
+func matchPatterns(patterns []*pattern, addr string) []int {
+	var matched []int
+	for _, p := range patterns {
+		if p.match(addr) {
+			matched = append(matched, p.index)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,104 @@
+package vanity
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePatternsValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		suffixes []string
+		regexes  []string
+		wantErr  string
+	}{
+		{name: "valid prefixes", prefixes: []string{"team", "blog", "shop"}},
+		{name: "uppercase prefix is lowered", prefixes: []string{"TEAM"}},
+		{name: "digit outside alphabet", prefixes: []string{"test1"}, wantErr: "not in the onion alphabet"},
+		{name: "digit zero", prefixes: []string{"b0b"}, wantErr: "not in the onion alphabet"},
+		{name: "too long", prefixes: []string{strings.Repeat("a", 57)}, wantErr: "longer than an onion address"},
+		{name: "valid suffix", suffixes: []string{"yd"}},
+		{name: "suffix with onion tld", suffixes: []string{"qd.onion"}},
+		{name: "suffix not ending in d", suffixes: []string{"blog"}, wantErr: "always end in"},
+		{name: "suffix impossible second to last", suffixes: []string{"bd"}, wantErr: "second to last"},
+		{name: "valid regex", regexes: []string{"^(team|blog)[2-7]"}},
+		{name: "bad regex", regexes: []string{"("}, wantErr: "invalid regex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePatterns(tt.prefixes, tt.suffixes, tt.regexes)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestMatchPatterns(t *testing.T) {
+	patterns, err := parsePatterns([]string{"team", "te"}, []string{"id"}, []string{"^t.*q"})
+	if err != nil {
+		t.Fatalf("parsePatterns: %v", err)
+	}
+	got := matchPatterns(patterns, "teamxyzqid")
+	if len(got) != 4 {
+		t.Errorf("expected all four patterns to match, got %v", got)
+	}
+	got = matchPatterns(patterns, "tezzzzzzad")
+	if len(got) != 1 || got[0] != 1 {
+		t.Errorf("expected only the \"te\" prefix to match, got %v", got)
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	prefixes := &listFlag{split: true}
+	regexes := &listFlag{}
+	fs.Var(prefixes, "prefix", "")
+	fs.Var(regexes, "regex", "")
+	if err := fs.Parse([]string{"-prefix", "team,blog", "-prefix", "shop", "-regex", "^a{2,3}", "-regex", "b$"}); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if strings.Join(prefixes.values, " ") != "team blog shop" {
+		t.Errorf("prefixes = %v", prefixes.values)
+	}
+	if len(regexes.values) != 2 || regexes.values[0] != "^a{2,3}" {
+		t.Errorf("regexes = %v", regexes.values)
+	}
+}
+
+func TestRunVanityMultiplePatterns(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	dataDir := t.TempDir()
+
+	os.Args = []string{"cmd", "-workers", "2", "-prefix", "a,b", "-save"}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	var logOutput strings.Builder
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	RunVanity(testSettings(dataDir))
+
+	for _, label := range []string{"a", "b"} {
+		hostname, err := os.ReadFile(filepath.Join(dataDir, label, "hostname"))
+		if err != nil {
+			t.Fatalf("bundle for prefix %s not saved: %v", label, err)
+		}
+		if !strings.HasPrefix(string(hostname), label) {
+			t.Errorf("bundle %s holds %s", label, hostname)
+		}
+	}
+	if !strings.Contains(logOutput.String(), `Matched prefix "a"`) {
+		t.Errorf("expected match report, got: %s", logOutput.String())
+	}
+}
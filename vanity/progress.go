@@ -0,0 +1,171 @@
+package vanity
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+// patternProbability estimates the chance that a single random key
+// satisfies p. It returns 0 when no estimate is possible (regexes).
+func patternProbability(p *pattern) float64 {
+	switch p.kind {
+	case prefixPattern:
+		return math.Pow(32, -float64(len(p.text)))
+	case suffixPattern:
+		// The final "d" is fixed and the character before it takes one of
+		// four values; every other character is uniformly distributed.
+		switch n := len(p.text); {
+		case n <= 1:
+			return 1
+		default:
+			return 0.25 * math.Pow(32, -float64(n-2))
+		}
+	default:
+		return 0
+	}
+}
+
+// hardestProbability returns the per-key probability of the least likely
+// pattern still being searched for, which dominates the expected run time.
+// ok is false if that cannot be estimated.
+func hardestProbability(patterns []*pattern, satisfied []bool) (p float64, ok bool) {
+	p = 1
+	for i, pat := range patterns {
+		if satisfied[i] {
+			continue
+		}
+		pp := patternProbability(pat)
+		if pp == 0 {
+			return 0, false
+		}
+		p = math.Min(p, pp)
+	}
+	return p, true
+}
+
+// attemptsForChance returns how many attempts are needed to find a match
+// with the given probability when each attempt succeeds with chance p.
+func attemptsForChance(p, chance float64) float64 {
+	if p >= 1 {
+		return 1
+	}
+	return math.Log1p(-chance) / math.Log1p(-p)
+}
+
+// progressReport is a snapshot of a running search. It is printed as a log
+// line, or as one JSON object per line with --json.
+type progressReport struct {
+	Type        string  `json:"type"`
+	Attempts    uint64  `json:"attempts"`
+	Elapsed     float64 `json:"elapsed_seconds"`
+	Rate        float64 `json:"keys_per_second"`
+	Expected    float64 `json:"expected_attempts,omitempty"`
+	Probability float64 `json:"probability,omitempty"`
+	ETA50       float64 `json:"eta50_seconds,omitempty"`
+	ETA90       float64 `json:"eta90_seconds,omitempty"`
+	Remaining   int     `json:"patterns_remaining"`
+}
+
+// newProgressReport computes rate, expected attempts and a probabilistic
+// ETA. Key search is memoryless, so the ETA is measured from now
+// regardless of how long the search has already run. attempts includes the
+// resumed attempts of earlier runs, which do not count towards the rate.
+func newProgressReport(attempts, resumed uint64, elapsed time.Duration, patterns []*pattern, satisfied []bool) progressReport {
+	r := progressReport{Type: "progress", Attempts: attempts, Elapsed: elapsed.Seconds()}
+	for _, s := range satisfied {
+		if !s {
+			r.Remaining++
+		}
+	}
+	if elapsed > 0 && attempts >= resumed {
+		r.Rate = float64(attempts-resumed) / elapsed.Seconds()
+	}
+	p, ok := hardestProbability(patterns, satisfied)
+	if !ok || len(patterns) == 0 {
+		return r
+	}
+	r.Expected = 1 / p
+	r.Probability = -math.Expm1(float64(attempts) * math.Log1p(-p))
+	if r.Rate > 0 {
+		r.ETA50 = attemptsForChance(p, 0.5) / r.Rate
+		r.ETA90 = attemptsForChance(p, 0.9) / r.Rate
+	}
+	return r
+}
+
+// emit writes the report either as JSON to out or as a log line.
+func (r progressReport) emit(asJSON bool, out io.Writer) {
+	if asJSON {
+		writeJSONLine(out, r)
+		return
+	}
+	line := fmt.Sprintf("Total Attempts: %d (%s keys/s)", r.Attempts, humanCount(r.Rate))
+	if r.Expected > 0 {
+		line += fmt.Sprintf(", expected %s, %.1f%% chance so far, ETA 50%%: %s, 90%%: %s",
+			humanCount(r.Expected), r.Probability*100, humanDuration(r.ETA50), humanDuration(r.ETA90))
+	}
+	log.Print(line)
+}
+
+// matchReport is emitted with --json for every match.
+type matchReport struct {
+	Type         string   `json:"type"`
+	OnionAddress string   `json:"onion_address"`
+	PublicKey    string   `json:"public_key"`
+	Patterns     []string `json:"patterns"`
+	Attempts     uint64   `json:"attempts"`
+	SavedTo      string   `json:"saved_to,omitempty"`
+
+	// ExpandedSecretKey is only reported when the key is not saved.
+	ExpandedSecretKey string `json:"expanded_secret_key,omitempty"`
+	// Offset is reported by split-key searches instead of a secret key.
+	Offset string `json:"offset,omitempty"`
+}
+
+func writeJSONLine(out io.Writer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode progress: %v", err)
+		return
+	}
+	fmt.Fprintln(out, string(data))
+}
+
+// humanCount formats large counts with a metric suffix.
+func humanCount(n float64) string {
+	switch {
+	case n >= 1e12:
+		return fmt.Sprintf("%.2fT", n/1e12)
+	case n >= 1e9:
+		return fmt.Sprintf("%.2fG", n/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.2fM", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.2fk", n/1e3)
+	default:
+		return fmt.Sprintf("%.0f", n)
+	}
+}
+
+// humanDuration formats a number of seconds for progress output.
+func humanDuration(seconds float64) string {
+	if seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return "unknown"
+	}
+	if seconds > 100*365*24*3600 {
+		return "centuries"
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%.1f days", d.Hours()/24)
+	case d >= time.Minute:
+		return d.Round(time.Second).String()
+	default:
+		return d.Round(100 * time.Millisecond).String()
+	}
+}
@@ -0,0 +1,91 @@
+package vanity
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPatternProbability(t *testing.T) {
+	patterns, err := parsePatterns([]string{"abcde"}, []string{"d", "qd", "aqd"}, []string{"^a"})
+	if err != nil {
+		t.Fatalf("parsePatterns: %v", err)
+	}
+	want := []float64{math.Pow(32, -5), 1, 0.25, 0.25 / 32, 0}
+	for i, p := range patterns {
+		if got := patternProbability(p); math.Abs(got-want[i]) > 1e-15 {
+			t.Errorf("%s: probability %g, want %g", p, got, want[i])
+		}
+	}
+}
+
+func TestNewProgressReport(t *testing.T) {
+	patterns, err := parsePatterns([]string{"ab", "abcde"}, nil, nil)
+	if err != nil {
+		t.Fatalf("parsePatterns: %v", err)
+	}
+	satisfied := []bool{true, false}
+
+	r := newProgressReport(1000000, 0, 10*time.Second, patterns, satisfied)
+	if r.Rate != 100000 {
+		t.Errorf("rate = %g, want 100000", r.Rate)
+	}
+	if r.Expected != math.Pow(32, 5) {
+		t.Errorf("expected attempts = %g, want 32^5", r.Expected)
+	}
+	if r.Remaining != 1 {
+		t.Errorf("remaining = %d, want 1", r.Remaining)
+	}
+	// Half the expected attempts gives roughly 1-e^-0.5.
+	wantProb := 1 - math.Exp(-1000000/math.Pow(32, 5))
+	if math.Abs(r.Probability-wantProb) > 1e-6 {
+		t.Errorf("probability = %g, want %g", r.Probability, wantProb)
+	}
+	if r.ETA50 <= 0 || r.ETA90 <= r.ETA50 {
+		t.Errorf("ETAs not increasing: 50%% %g, 90%% %g", r.ETA50, r.ETA90)
+	}
+	if eta := math.Ln2 * math.Pow(32, 5) / 100000; math.Abs(r.ETA50-eta)/eta > 1e-3 {
+		t.Errorf("ETA50 = %g, want about %g", r.ETA50, eta)
+	}
+
+	// Regexes have no estimate; only the rate is reported.
+	regex, _ := parsePatterns(nil, nil, []string{"^a"})
+	r = newProgressReport(1000, 0, time.Second, regex, []bool{false})
+	if r.Expected != 0 || r.ETA50 != 0 || r.Rate != 1000 {
+		t.Errorf("unexpected regex report: %+v", r)
+	}
+}
+
+func TestProgressReportJSON(t *testing.T) {
+	patterns, _ := parsePatterns([]string{"ab"}, nil, nil)
+	var out bytes.Buffer
+	newProgressReport(2048, 0, 2*time.Second, patterns, []bool{false}).emit(true, &out)
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("progress is not JSON: %v (%q)", err, out.String())
+	}
+	if decoded["type"] != "progress" || decoded["attempts"] != float64(2048) || decoded["expected_attempts"] != float64(1024) {
+		t.Errorf("unexpected JSON progress: %s", out.String())
+	}
+	if out.Bytes()[out.Len()-1] != '\n' {
+		t.Errorf("progress line not newline terminated")
+	}
+}
+
+func TestBenchmarkSearch(t *testing.T) {
+	report := benchmarkSearch(2, 200*time.Millisecond)
+	if report.Workers != 2 || len(report.PerWorker) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	for i, rate := range report.PerWorker {
+		if rate <= 0 {
+			t.Errorf("worker %d reported no progress", i)
+		}
+	}
+	if report.Total < report.PerWorker[0] {
+		t.Errorf("total %g less than a single worker", report.Total)
+	}
+}
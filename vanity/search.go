@@ -0,0 +1,280 @@
+package vanity
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+)
+
+// batchSize is the number of points normalised with a single field
+// inversion. Larger batches amortise the inversion further but delay
+// cancellation slightly.
+const batchSize = 256
+
+// maxWalk bounds how far a worker walks from one random starting scalar
+// before drawing a new one. It keeps s0 + 8*i far away from overflowing the
+// clamped scalar range.
+const maxWalk = 1 << 24
+
+// candidate is a key whose onion address matched at least one pattern.
+type candidate struct {
+	onionAddr string
+	pub       ed25519.PublicKey
+	expanded  [64]byte
+	matched   []int
+
+	// offset is set instead of expanded in split-key searches: the key is
+	// base + offset*B, and only the owner of base can derive its secret.
+	offset uint64
+}
+
+// walker enumerates consecutive keys s0*B, (s0+8)*B, (s0+16)*B, ... by
+// repeated point addition. Stepping by 8 keeps the low three bits of the
+// scalar clear, so every key stays a valid clamped tor secret.
+//
+// In a split-key search the walker does not know s0. It walks
+// base + t0*B, base + (t0+8)*B, ... instead, where base is someone else's
+// public key and start holds the offset t0.
+type walker struct {
+	start  [32]byte
+	nonce  [32]byte
+	point  *edwards25519.Point
+	offset uint64
+	split  bool
+
+	// Scratch space for batch normalisation.
+	xs, ys, zs, prefix []field.Element
+}
+
+// eightB is the walk step, 8*B.
+var eightB = func() *edwards25519.Point {
+	eight := [32]byte{8}
+	s, _ := edwards25519.NewScalar().SetCanonicalBytes(eight[:])
+	return new(edwards25519.Point).ScalarBaseMult(s)
+}()
+
+// maxSplitStart bounds the random starting offset of a split-key walk. It
+// keeps base + offset far below the top of the clamped range.
+const maxSplitStart = 1 << 60
+
+// newWalker draws a random clamped starting scalar and nonce prefix. With a
+// base point it draws a random starting offset from base instead.
+func newWalker(base *edwards25519.Point) (*walker, error) {
+	w := &walker{}
+	if base != nil {
+		var buf [8]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return nil, err
+		}
+		t0 := binary.LittleEndian.Uint64(buf[:]) % maxSplitStart &^ 7
+		binary.LittleEndian.PutUint64(w.start[:], t0)
+		s, err := edwards25519.NewScalar().SetCanonicalBytes(w.start[:])
+		if err != nil {
+			return nil, err
+		}
+		w.point = new(edwards25519.Point).ScalarBaseMult(s)
+		w.point.Add(w.point, base)
+		w.split = true
+		return w, nil
+	}
+	if _, err := rand.Read(w.start[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(w.nonce[:]); err != nil {
+		return nil, err
+	}
+	w.start[0] &= 248
+	w.start[31] &= 127
+	w.start[31] |= 64
+	s, err := edwards25519.NewScalar().SetBytesWithClamping(w.start[:])
+	if err != nil {
+		return nil, err
+	}
+	w.point = new(edwards25519.Point).ScalarBaseMult(s)
+	return w, nil
+}
+
+// next fills out with the encoded public keys of the next len(out) keys and
+// returns the offset of the first one.
+func (w *walker) next(out [][32]byte) uint64 {
+	n := len(out)
+	if len(w.xs) < n {
+		w.xs = make([]field.Element, n)
+		w.ys = make([]field.Element, n)
+		w.zs = make([]field.Element, n)
+		w.prefix = make([]field.Element, n)
+	}
+	for i := 0; i < n; i++ {
+		X, Y, Z, _ := w.point.ExtendedCoordinates()
+		w.xs[i].Set(X)
+		w.ys[i].Set(Y)
+		w.zs[i].Set(Z)
+		w.point.Add(w.point, eightB)
+	}
+	encodeBatch(w.xs[:n], w.ys[:n], w.zs[:n], w.prefix[:n], out)
+
+	first := w.offset
+	w.offset += uint64(n)
+	return first
+}
+
+// expandedAt returns tor's expanded secret key for the key at offset, that is
+// the little-endian scalar start + 8*offset followed by the nonce prefix.
+func (w *walker) expandedAt(offset uint64) ([64]byte, error) {
+	var expanded [64]byte
+	scalar, err := addScalarOffset(w.start, offset*8)
+	if err != nil {
+		return expanded, err
+	}
+	copy(expanded[:32], scalar[:])
+	copy(expanded[32:], w.nonce[:])
+	return expanded, nil
+}
+
+// splitOffsetAt returns the offset from the base point of the key at offset
+// in a split-key walk.
+func (w *walker) splitOffsetAt(offset uint64) uint64 {
+	return binary.LittleEndian.Uint64(w.start[:8]) + offset*8
+}
+
+// addScalarOffset adds n to the little-endian clamped scalar s. The sum is
+// computed on the integers, not modulo the group order, and must still be a
+// clamped scalar so that tor and PublicKeyFromExpanded agree on the key.
+func addScalarOffset(s [32]byte, n uint64) ([32]byte, error) {
+	var sum [32]byte
+	carry := n
+	for i := 0; i < 32; i += 8 {
+		limb := binary.LittleEndian.Uint64(s[i:])
+		v := limb + carry
+		if v < limb {
+			carry = 1
+		} else {
+			carry = 0
+		}
+		binary.LittleEndian.PutUint64(sum[i:], v)
+	}
+	if carry != 0 || n%8 != 0 || sum[0]&7 != 0 || sum[31]&0xc0 != 0x40 {
+		return sum, fmt.Errorf("scalar walked out of the clamped range")
+	}
+	return sum, nil
+}
+
+// encodeBatch converts projective points (X:Y:Z) into their 32-byte
+// encodings using a single field inversion for the whole batch
+// (Montgomery's trick). prefix is scratch space of the same length.
+func encodeBatch(xs, ys, zs, prefix []field.Element, out [][32]byte) {
+	n := len(zs)
+	prefix[0].Set(&zs[0])
+	for i := 1; i < n; i++ {
+		prefix[i].Multiply(&prefix[i-1], &zs[i])
+	}
+
+	var inv, zInv, x, y field.Element
+	inv.Invert(&prefix[n-1])
+	for i := n - 1; i >= 0; i-- {
+		if i > 0 {
+			zInv.Multiply(&inv, &prefix[i-1])
+			inv.Multiply(&inv, &zs[i])
+		} else {
+			zInv.Set(&inv)
+		}
+		x.Multiply(&xs[i], &zInv)
+		y.Multiply(&ys[i], &zInv)
+		copy(out[i][:], y.Bytes())
+		out[i][31] |= byte(x.IsNegative() << 7)
+	}
+}
+
+// quickPrefix base32-encodes just the public key, which is enough to check
+// prefixes of up to 51 characters without computing the checksum.
+func quickPrefix(pub []byte) string {
+	return strings.ToLower(onionEncoding.EncodeToString(pub))
+}
+
+// needsFullAddress reports whether any pattern looks beyond the characters
+// determined by the public key alone.
+func needsFullAddress(patterns []*pattern) bool {
+	for _, p := range patterns {
+		if p.kind != prefixPattern || len(p.text) > 51 {
+			return true
+		}
+	}
+	return false
+}
+
+// searchKeys runs one search worker until ctx is cancelled. Every key is
+// counted in attempts and checked against all patterns; matches are passed
+// to found. With no patterns every key matches. With a base point the search
+// is split-key: it walks offsets from base and reports those instead of
+// secret keys.
+//
+// Instead of generating each key from scratch (SHA-512 plus a full scalar
+// multiplication), the worker starts from a random scalar and walks keys by
+// point addition, normalising whole batches with one inversion. The
+// expanded secret is only derived for keys that match.
+func searchKeys(ctx context.Context, patterns []*pattern, base *edwards25519.Point, attempts *uint64, found func(candidate)) error {
+	full := needsFullAddress(patterns)
+	batch := make([][32]byte, batchSize)
+	for {
+		w, err := newWalker(base)
+		if err != nil {
+			return fmt.Errorf("failed to seed key search: %v", err)
+		}
+		for w.offset < maxWalk {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+
+			first := w.next(batch)
+			atomic.AddUint64(attempts, uint64(len(batch)))
+			for i := range batch {
+				pub := batch[i][:]
+				var addr string
+				if full || len(patterns) == 0 {
+					addr = OnionAddress(pub)
+				} else {
+					addr = quickPrefix(pub)
+				}
+				matched := matchPatterns(patterns, addr)
+				if len(patterns) > 0 && len(matched) == 0 {
+					continue
+				}
+
+				c := candidate{
+					onionAddr: OnionAddress(pub),
+					pub:       append(ed25519.PublicKey(nil), pub...),
+					matched:   matched,
+				}
+				// Only the matching key pays for the full derivation; it
+				// doubles as a check that the walk produced the right key.
+				var derived ed25519.PublicKey
+				if w.split {
+					c.offset = w.splitOffsetAt(first + uint64(i))
+					derived, err = splitPublicKey(base, c.offset)
+				} else {
+					c.expanded, err = w.expandedAt(first + uint64(i))
+					if err != nil {
+						continue
+					}
+					derived, err = PublicKeyFromExpanded(c.expanded[:])
+				}
+				if err != nil || !derived.Equal(c.pub) {
+					return fmt.Errorf("derived public key does not match the searched key")
+				}
+				found(c)
+				if ctx.Err() != nil {
+					return nil
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package vanity
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+)
+
+func TestWalkerMatchesScalarMultiplication(t *testing.T) {
+	w, err := newWalker(nil)
+	if err != nil {
+		t.Fatalf("newWalker: %v", err)
+	}
+	batch := make([][32]byte, 40)
+	for round := 0; round < 2; round++ {
+		first := w.next(batch)
+		for i := range batch {
+			expanded, err := w.expandedAt(first + uint64(i))
+			if err != nil {
+				t.Fatalf("expandedAt: %v", err)
+			}
+			if expanded[0]&7 != 0 || expanded[31]&0xc0 != 0x40 {
+				t.Fatalf("expanded key %x is not a clamped scalar", expanded[:32])
+			}
+			pub, err := PublicKeyFromExpanded(expanded[:])
+			if err != nil {
+				t.Fatalf("PublicKeyFromExpanded: %v", err)
+			}
+			if !bytes.Equal(pub, batch[i][:]) {
+				t.Fatalf("key %d: walked %x, derived %x", first+uint64(i), batch[i], pub)
+			}
+		}
+	}
+}
+
+func TestEncodeBatchMatchesPointBytes(t *testing.T) {
+	const n = 17
+	points := make([]*edwards25519.Point, n)
+	for i := range points {
+		var seed [64]byte
+		rand.Read(seed[:])
+		s, _ := edwards25519.NewScalar().SetUniformBytes(seed[:])
+		points[i] = new(edwards25519.Point).ScalarBaseMult(s)
+	}
+
+	w := &walker{}
+	out := make([][32]byte, n)
+	w.xs = make([]field.Element, n)
+	w.ys = make([]field.Element, n)
+	w.zs = make([]field.Element, n)
+	w.prefix = make([]field.Element, n)
+	for i, p := range points {
+		X, Y, Z, _ := p.ExtendedCoordinates()
+		w.xs[i].Set(X)
+		w.ys[i].Set(Y)
+		w.zs[i].Set(Z)
+	}
+	encodeBatch(w.xs, w.ys, w.zs, w.prefix, out)
+	for i, p := range points {
+		if !bytes.Equal(out[i][:], p.Bytes()) {
+			t.Errorf("point %d: batch encoding %x, want %x", i, out[i], p.Bytes())
+		}
+	}
+}
+
+func TestExpandedAtRejectsOverflow(t *testing.T) {
+	w := &walker{}
+	for i := range w.start {
+		w.start[i] = 0xff
+	}
+	w.start[0] = 0xf8
+	w.start[31] = 0x7f
+	if _, err := w.expandedAt(1 << 40); err == nil {
+		t.Error("expected an error once the scalar leaves the clamped range")
+	}
+}
+
+func TestSearchKeysDerivedKeyMatchesOnionAddress(t *testing.T) {
+	patterns, err := parsePatterns([]string{"ab"}, nil, nil)
+	if err != nil {
+		t.Fatalf("parsePatterns: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var attempts uint64
+	var found []candidate
+	err = searchKeys(ctx, patterns, nil, &attempts, func(c candidate) {
+		found = append(found, c)
+		cancel()
+	})
+	if err != nil {
+		t.Fatalf("searchKeys: %v", err)
+	}
+	if len(found) == 0 {
+		t.Fatal("no match found")
+	}
+
+	c := found[0]
+	if !strings.HasPrefix(c.onionAddr, "ab") {
+		t.Errorf("address %s does not start with the prefix", c.onionAddr)
+	}
+	pub, err := PublicKeyFromExpanded(c.expanded[:])
+	if err != nil {
+		t.Fatalf("PublicKeyFromExpanded: %v", err)
+	}
+	if OnionAddress(pub) != c.onionAddr {
+		t.Errorf("secret key belongs to %s, not %s", OnionAddress(pub), c.onionAddr)
+	}
+	if attempts == 0 {
+		t.Error("attempts were not counted")
+	}
+
+	// The saved secret key file must round-trip through tor's format.
+	dir := t.TempDir()
+	vk, err := SaveBundle(dir, c.expanded[:], attempts)
+	if err != nil {
+		t.Fatalf("SaveBundle: %v", err)
+	}
+	if vk.OnionAddress != c.onionAddr+".onion" {
+		t.Errorf("bundle address %s, want %s.onion", vk.OnionAddress, c.onionAddr)
+	}
+}
+
+func BenchmarkWalker(b *testing.B) {
+	w, err := newWalker(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	batch := make([][32]byte, batchSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		w.next(batch)
+	}
+}
+
+func BenchmarkGenerateKey(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		ExpandSeed(priv.Seed())
+		OnionAddress(pub)
+	}
+}
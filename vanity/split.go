@@ -0,0 +1,163 @@
+package vanity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/edwards25519"
+)
+
+// Split-key vanity search lets an untrusted machine search for an address
+// without ever seeing its secret key:
+//
+//  1. "vanity split" generates a clamped secret scalar s locally and prints
+//     only the base public key S = s*B.
+//  2. "vanity --base S" searches offsets t (multiples of 8) until the address
+//     of S + t*B matches, and prints t.
+//  3. "vanity combine --offset t" computes the secret s + t locally.
+//
+// t on its own is worthless without s, so it may be sent back in the clear.
+const (
+	splitSecretFile = "split_secret_key"
+	splitPublicFile = "split_public_key"
+)
+
+// splitPublicKey returns base + offset*B.
+func splitPublicKey(base *edwards25519.Point, offset uint64) (ed25519.PublicKey, error) {
+	var t [32]byte
+	binary.LittleEndian.PutUint64(t[:], offset)
+	s, err := edwards25519.NewScalar().SetCanonicalBytes(t[:])
+	if err != nil {
+		return nil, err
+	}
+	p := new(edwards25519.Point).ScalarBaseMult(s)
+	p.Add(p, base)
+	return ed25519.PublicKey(p.Bytes()), nil
+}
+
+// parseBasePoint accepts the base public key printed by "vanity split",
+// either as 64 hex characters or as the onion address of the base key.
+func parseBasePoint(s string) (*edwards25519.Point, error) {
+	s = strings.TrimSpace(s)
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) != 32 {
+		pub, onionErr := PublicKeyFromOnion(s)
+		if onionErr != nil {
+			return nil, fmt.Errorf("base must be a 32-byte hex public key or an onion address: %s", s)
+		}
+		raw = pub
+	}
+	p, err := new(edwards25519.Point).SetBytes(raw)
+	if err != nil {
+		return nil, fmt.Errorf("base is not a valid ed25519 public key: %v", err)
+	}
+	return p, nil
+}
+
+// combineSplitKey adds a split-key search offset to the expanded base
+// secret and returns the expanded secret key of the found address.
+func combineSplitKey(baseExpanded []byte, offset uint64) ([]byte, error) {
+	if len(baseExpanded) != 64 {
+		return nil, fmt.Errorf("expanded secret key must be 64 bytes, got %d", len(baseExpanded))
+	}
+	var scalar [32]byte
+	copy(scalar[:], baseExpanded[:32])
+	sum, err := addScalarOffset(scalar, offset)
+	if err != nil {
+		return nil, fmt.Errorf("offset %d cannot be combined with this key: %v", offset, err)
+	}
+	expanded := make([]byte, 64)
+	copy(expanded, sum[:])
+	copy(expanded[32:], baseExpanded[32:])
+	return expanded, nil
+}
+
+// runSplit generates the local half of a split-key search, saved under
+// baseDir.
+func runSplit(baseDir string) int {
+	name := flag.String("name", "", "name of the key bundle under data/vanity the result will be saved as")
+	flag.Parse()
+
+	dir := BundleDir(baseDir, *name)
+	secretPath := filepath.Join(dir, splitSecretFile)
+	if _, err := os.Stat(secretPath); err == nil {
+		log.Fatalf("A split key already exists in %s; combine it or remove it first", dir)
+	}
+
+	var seed [32]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	expanded := ExpandSeed(seed[:])
+	pub, err := PublicKeyFromExpanded(expanded[:])
+	if err != nil {
+		log.Fatalf("Failed to derive public key: %v", err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(secretPath, append([]byte(SecretKeyHeader), expanded[:]...), 0600); err != nil {
+		log.Fatalf("Failed to write %s: %v", splitSecretFile, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, splitPublicFile), append([]byte(PublicKeyHeader), pub...), 0600); err != nil {
+		log.Fatalf("Failed to write %s: %v", splitPublicFile, err)
+	}
+
+	log.Printf("Split key saved to: %s (keep %s private)", dir, splitSecretFile)
+	log.Printf("Base Public Key (hex): %s", hex.EncodeToString(pub))
+	log.Printf("Search on another machine with: cheeseburger vanity --base %s --prefix <prefix>", hex.EncodeToString(pub))
+	return 0
+}
+
+// runCombine turns a split-key search result under baseDir into a complete
+// key bundle.
+func runCombine(baseDir string) int {
+	name := flag.String("name", "", "name of the key bundle under data/vanity holding the split key")
+	offset := flag.Uint64("offset", 0, "offset reported by the split-key search")
+	address := flag.String("address", "", "onion address reported by the split-key search, checked against the result")
+	flag.Parse()
+
+	dir := BundleDir(baseDir, *name)
+	data, err := os.ReadFile(filepath.Join(dir, splitSecretFile))
+	if err != nil {
+		log.Fatalf("Failed to read split key (run vanity split first): %v", err)
+	}
+	baseExpanded, err := ParseSecretKeyFile(data)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", splitSecretFile, err)
+	}
+	expanded, err := combineSplitKey(baseExpanded, *offset)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	pub, err := PublicKeyFromExpanded(expanded)
+	if err != nil {
+		log.Fatalf("Failed to derive public key: %v", err)
+	}
+	if *address != "" {
+		want, err := PublicKeyFromOnion(*address)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if !want.Equal(pub) {
+			log.Fatalf("Combined key belongs to %s.onion, not %s; check --name and --offset", OnionAddress(pub), *address)
+		}
+	}
+
+	vk, err := SaveBundle(dir, expanded, 0)
+	if err != nil {
+		log.Fatalf("Failed to save key bundle: %v", err)
+	}
+	log.Printf("Combined vanity address: %s", vk.OnionAddress)
+	log.Printf("Keys saved to: %s", dir)
+	return 0
+}
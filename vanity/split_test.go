@@ -0,0 +1,127 @@
+package vanity
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitKeyWorkflow(t *testing.T) {
+	baseDir := t.TempDir()
+	dataDir := BundleDir(baseDir, "")
+
+	if code, output := runVanityArgs(t, baseDir, "split"); code != 0 {
+		t.Fatalf("split exited %d: %s", code, output)
+	}
+	pubData, err := os.ReadFile(filepath.Join(dataDir, splitPublicFile))
+	if err != nil {
+		t.Fatalf("split public key not written: %v", err)
+	}
+	basePub, err := ParsePublicKeyFile(pubData)
+	if err != nil {
+		t.Fatalf("ParsePublicKeyFile: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dataDir, splitSecretFile))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("split secret key missing or not private: %v %v", info, err)
+	}
+
+	// The untrusted worker only gets the base public key.
+	code, output := runVanityArgs(t, baseDir, "-workers", "1", "-prefix", "b", "-base", hex.EncodeToString(basePub))
+	if code != 0 {
+		t.Fatalf("split-key search exited %d: %s", code, output)
+	}
+	if strings.Contains(output, "Expanded Private Key") {
+		t.Errorf("split-key search reported a secret key: %s", output)
+	}
+	var offset, address string
+	for _, line := range strings.Split(output, "\n") {
+		if i := strings.Index(line, "Split-key Offset: "); i >= 0 {
+			offset = line[i+len("Split-key Offset: "):]
+		}
+		if i := strings.Index(line, "Vanity Onion Address: "); i >= 0 {
+			address = line[i+len("Vanity Onion Address: "):]
+		}
+	}
+	if offset == "" || !strings.HasPrefix(address, "b") {
+		t.Fatalf("no offset or address reported: %s", output)
+	}
+
+	if code, output := runVanityArgs(t, baseDir, "combine", "-offset", offset, "-address", address); code != 0 {
+		t.Fatalf("combine exited %d: %s", code, output)
+	}
+	hostname, err := os.ReadFile(filepath.Join(dataDir, "hostname"))
+	if err != nil {
+		t.Fatalf("bundle not saved: %v", err)
+	}
+	if string(hostname) != address+".onion\n" {
+		t.Errorf("combined bundle is for %q, want %s.onion", hostname, address)
+	}
+	secret, err := os.ReadFile(filepath.Join(dataDir, "hs_ed25519_secret_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded, err := ParseSecretKeyFile(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := PublicKeyFromExpanded(expanded)
+	if err != nil || OnionAddress(pub) != address {
+		t.Errorf("combined secret key does not derive %s: %v", address, err)
+	}
+}
+
+func TestSearchKeysWithBase(t *testing.T) {
+	var seed [32]byte
+	seed[0] = 1
+	baseExpanded := ExpandSeed(seed[:])
+	basePub, _ := PublicKeyFromExpanded(baseExpanded[:])
+	base, err := parseBasePoint(OnionAddress(basePub) + ".onion")
+	if err != nil {
+		t.Fatalf("parseBasePoint: %v", err)
+	}
+
+	patterns, _ := parsePatterns([]string{"c"}, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var attempts uint64
+	var found []candidate
+	err = searchKeys(ctx, patterns, base, &attempts, func(c candidate) {
+		found = append(found, c)
+		cancel()
+	})
+	if err != nil || len(found) == 0 {
+		t.Fatalf("searchKeys: %v, %d found", err, len(found))
+	}
+	c := found[0]
+	if c.offset%8 != 0 || c.expanded != [64]byte{} {
+		t.Errorf("unexpected split candidate: offset %d, expanded %x", c.offset, c.expanded)
+	}
+
+	expanded, err := combineSplitKey(baseExpanded[:], c.offset)
+	if err != nil {
+		t.Fatalf("combineSplitKey: %v", err)
+	}
+	pub, _ := PublicKeyFromExpanded(expanded)
+	if !pub.Equal(c.pub) || !strings.HasPrefix(OnionAddress(pub), "c") {
+		t.Errorf("combined key %s does not match found %s", OnionAddress(pub), c.onionAddr)
+	}
+	if string(expanded[32:]) != string(baseExpanded[32:]) {
+		t.Error("nonce prefix not taken from the base key")
+	}
+}
+
+func TestCombineSplitKeyRejectsBadOffsets(t *testing.T) {
+	var seed [32]byte
+	expanded := ExpandSeed(seed[:])
+	if _, err := combineSplitKey(expanded[:], 12); err == nil {
+		t.Error("expected an error for an offset that is not a multiple of 8")
+	}
+	if _, err := parseBasePoint("nothex"); err == nil {
+		t.Error("expected an error for an invalid base")
+	}
+}
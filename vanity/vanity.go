@@ -2,131 +2,311 @@ package vanity
 
 import (
 	"context"
-	"crypto/ed25519"
-	"crypto/rand"
-	"crypto/sha512"
-	"encoding/base32"
 	"encoding/hex"
 	"flag"
 	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"runtime"
-	"strings"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
-	"golang.org/x/crypto/sha3"
+	"filippo.io/edwards25519"
 )
 
-// getDataDir returns the path to store vanity key data
-// Can be overridden with VANITY_DATA_DIR environment variable for testing
-func getDataDir() string {
-	if dir := os.Getenv("VANITY_DATA_DIR"); dir != "" {
-		return dir
-	}
-	return filepath.Join("data", "vanity", "default")
+// Exit codes returned by RunVanity.
+const (
+	// ExitNoMatch means --timeout or --max-attempts stopped the search
+	// before every pattern was matched.
+	ExitNoMatch = 3
+	// ExitInterrupted means the search was stopped by SIGINT or SIGTERM.
+	ExitInterrupted = 130
+)
+
+// limitPollInterval is how often --max-attempts is checked.
+const limitPollInterval = 50 * time.Millisecond
+
+// Settings are the defaults of RunVanity that do not come from its flags.
+type Settings struct {
+	// Dir holds one sub-directory per named key bundle.
+	Dir string
+	// Workers is the default number of workers; 0 means one per CPU.
+	Workers int
+	// Progress is the default interval between progress reports.
+	Progress time.Duration
 }
 
-func RunVanity() {
-	prefix := flag.String("prefix", "", "vanity prefix for onion address (in lowercase)")
+// RunVanity searches for vanity onion addresses and returns the process exit
+// code: 0 once every pattern has matched, ExitNoMatch when a limit was
+// reached first and ExitInterrupted on SIGINT/SIGTERM. Flags that are not
+// given take their value from settings.
+func RunVanity(settings Settings) int {
+	if len(os.Args) > 1 {
+		subcommands := map[string]func() int{
+			"bench":   func() int { runBench(); return 0 },
+			"split":   func() int { return runSplit(settings.Dir) },
+			"combine": func() int { return runCombine(settings.Dir) },
+		}
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+			return run()
+		}
+	}
+
+	prefixes := &listFlag{split: true}
+	suffixes := &listFlag{split: true}
+	regexes := &listFlag{}
+	flag.Var(prefixes, "prefix", "vanity prefix for onion address (in lowercase); comma separated or repeated for several")
+	flag.Var(suffixes, "suffix", "vanity suffix for onion address; comma separated or repeated for several")
+	flag.Var(regexes, "regex", "regular expression the onion address must match; may be repeated")
 	saveMode := flag.Bool("save", false, "save the generated key information to a file")
-	workers := flag.Int("workers", runtime.NumCPU(), "number of parallel workers")
+	name := flag.String("name", "", "name of the key bundle under data/vanity (used by serve --vanity-name)")
+	defaultWorkers := settings.Workers
+	if defaultWorkers == 0 {
+		defaultWorkers = runtime.NumCPU()
+	}
+	workers := flag.Int("workers", defaultWorkers, "number of parallel workers")
+	jsonOutput := flag.Bool("json", false, "stream progress and matches as JSON lines on stdout")
+	interval := flag.Duration("progress", settings.Progress, "interval between progress reports")
+	timeout := flag.Duration("timeout", 0, "give up after this long (0 means no limit)")
+	maxAttempts := flag.Uint64("max-attempts", 0, "give up after this many attempts, including resumed ones (0 means no limit)")
+	checkpointPath := flag.String("checkpoint", "", "file recording search progress; an interrupted search resumes its statistics from it")
+	baseKey := flag.String("base", "", "base public key from \"vanity split\"; search offsets for someone else's key")
 	flag.Parse()
+	if *interval <= 0 {
+		log.Fatalf("--progress must be positive")
+	}
+
+	var base *edwards25519.Point
+	if *baseKey != "" {
+		if *saveMode {
+			log.Fatalf("--save cannot be used with --base: a split-key search never sees the secret key")
+		}
+		var err error
+		if base, err = parseBasePoint(*baseKey); err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Printf("Split-key search from base %s", hex.EncodeToString(base.Bytes()))
+	}
+
+	patterns, err := parsePatterns(prefixes.values, suffixes.values, regexes.values)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, p := range patterns {
+		log.Printf("Searching for %s", p)
+	}
+
+	cp := &checkpoint{}
+	satisfied := make([]bool, len(patterns))
+	var resumedElapsed time.Duration
+	if *checkpointPath != "" {
+		loaded, err := loadCheckpoint(*checkpointPath, patterns)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if loaded != nil {
+			cp = loaded
+			satisfied = cp.satisfiedFlags(patterns)
+			resumedElapsed = time.Duration(cp.Elapsed * float64(time.Second))
+			log.Printf("Resuming from checkpoint %s: %d attempts over %s", *checkpointPath, cp.Attempts, humanDuration(cp.Elapsed))
+		}
+	}
+	remaining := len(patterns)
+	for _, s := range satisfied {
+		if s {
+			remaining--
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var totalAttempts uint64
-	prefixLower := strings.ToLower(*prefix)
-	version := byte(0x03)
+	// SIGINT and SIGTERM stop the workers through the same context, so the
+	// checkpoint is written before exiting.
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	var deadline <-chan time.Time
+	if *timeout > 0 {
+		timer := time.NewTimer(*timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	resumed := cp.Attempts
+	totalAttempts := resumed
 
 	type result struct {
-		onionAddr string
-		finalPub  ed25519.PublicKey
-		expanded  [64]byte
-		attempts  uint64
+		candidate
+		attempts uint64
 	}
 
-	resultChan := make(chan result)
+	resultChan := make(chan result, *workers)
 
+	// Every generated key is checked against all patterns at once.
+	var wg sync.WaitGroup
 	worker := func() {
-		for {
+		defer wg.Done()
+		err := searchKeys(ctx, patterns, base, &totalAttempts, func(c candidate) {
 			select {
+			case resultChan <- result{candidate: c, attempts: atomic.LoadUint64(&totalAttempts)}:
 			case <-ctx.Done():
-				return
-			default:
-				pub, priv, err := ed25519.GenerateKey(rand.Reader)
-				if err != nil {
-					log.Fatalf("Failed to generate key pair: %v", err)
-				}
-				atomic.AddUint64(&totalAttempts, 1)
-				expanded := sha512.Sum512(priv[:32])
-				expanded[0] &= 248
-				expanded[31] &= 127
-				expanded[31] |= 64
-
-				checksumData := append(append([]byte(".onion checksum"), pub...), version)
-				torHash := sha3.Sum256(checksumData)
-
-				onionBytes := append(append([]byte{}, pub...), torHash[0:2]...)
-				onionBytes = append(onionBytes, version)
-				encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(onionBytes)
-				onionAddr := strings.ToLower(encoded)
-
-				if prefixLower == "" || strings.HasPrefix(onionAddr, prefixLower) {
-					resultChan <- result{
-						onionAddr: onionAddr,
-						finalPub:  pub,
-						expanded:  expanded,
-						attempts:  atomic.LoadUint64(&totalAttempts),
-					}
-					return
-				}
-
-				if atomic.LoadUint64(&totalAttempts)%1000000 == 0 {
-					log.Printf("Total Attempts: %d", atomic.LoadUint64(&totalAttempts))
-				}
 			}
+		})
+		if err != nil {
+			log.Fatalf("Key search failed: %v", err)
 		}
 	}
 
 	for i := 0; i < *workers; i++ {
+		wg.Add(1)
 		go worker()
 	}
 
-	res := <-resultChan
-	cancel()
+	start := time.Now()
+	saveCheckpoint := func() {
+		if *checkpointPath == "" {
+			return
+		}
+		err := cp.save(*checkpointPath, patterns, satisfied, atomic.LoadUint64(&totalAttempts), resumedElapsed+time.Since(start))
+		if err != nil {
+			log.Printf("Failed to save checkpoint: %v", err)
+		}
+	}
 
-	if *saveMode {
-		saveDir := getDataDir()
-		if err := os.MkdirAll(saveDir, 0700); err != nil {
-			log.Fatalf("Failed to create directory: %v", err)
+	// Collect matches until every pattern has been satisfied at least once,
+	// reporting progress in between.
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	poll := time.NewTicker(limitPollInterval)
+	defer poll.Stop()
+	exitCode := 0
+search:
+	for remaining > 0 || len(patterns) == 0 {
+		var res result
+		select {
+		case res = <-resultChan:
+		case <-ticker.C:
+			report := newProgressReport(atomic.LoadUint64(&totalAttempts), resumed, time.Since(start), patterns, satisfied)
+			report.emit(*jsonOutput, os.Stdout)
+			saveCheckpoint()
+			continue
+		case <-poll.C:
+			if *maxAttempts > 0 && atomic.LoadUint64(&totalAttempts) >= *maxAttempts {
+				log.Printf("Reached --max-attempts %d without a match", *maxAttempts)
+				exitCode = ExitNoMatch
+				break search
+			}
+			continue
+		case <-deadline:
+			log.Printf("Reached --timeout %s without a match", *timeout)
+			exitCode = ExitNoMatch
+			break search
+		case sig := <-interrupted:
+			log.Printf("Received %s, stopping search", sig)
+			exitCode = ExitInterrupted
+			break search
 		}
 
-		secretFilePath := filepath.Join(saveDir, "hs_ed25519_secret_key")
-		secretData := append([]byte("== ed25519v1-secret: type0 ==\x00\x00\x00"), res.expanded[:]...)
-		if err := os.WriteFile(secretFilePath, secretData, 0600); err != nil {
-			log.Fatalf("Failed to write secret key: %v", err)
+		var fresh []*pattern
+		for _, idx := range res.matched {
+			if !satisfied[idx] {
+				satisfied[idx] = true
+				remaining--
+				fresh = append(fresh, patterns[idx])
+			}
+		}
+		if len(patterns) > 0 && len(fresh) == 0 {
+			continue
+		}
+		match := matchReport{
+			Type:         "match",
+			OnionAddress: res.onionAddr + ".onion",
+			PublicKey:    hex.EncodeToString(res.pub),
+			Attempts:     res.attempts,
+		}
+		for _, p := range fresh {
+			log.Printf("Matched %s", p)
+			match.Patterns = append(match.Patterns, p.String())
 		}
-		log.Printf("Secret key saved to: %s", secretFilePath)
 
-		pubFilePath := filepath.Join(saveDir, "hs_ed25519_public_key")
-		pubData := append([]byte("== ed25519v1-public: type0 ==\x00\x00\x00"), res.finalPub...)
-		if err := os.WriteFile(pubFilePath, pubData, 0600); err != nil {
-			log.Fatalf("Failed to write public key: %v", err)
+		if base != nil {
+			log.Printf("Vanity Onion Address: %s", res.onionAddr)
+			log.Printf("Split-key Offset: %d", res.offset)
+			log.Printf("Total Attempts: %d", res.attempts)
+			log.Printf("Combine on the machine holding the split key with: cheeseburger vanity combine --offset %d --address %s [--name <name>]", res.offset, res.onionAddr)
+			match.Offset = strconv.FormatUint(res.offset, 10)
+		} else if *saveMode {
+			bundle := bundleName(*name, fresh, len(patterns) > 1)
+			saveDir := BundleDir(settings.Dir, bundle)
+			vk, err := SaveBundle(saveDir, res.expanded[:], res.attempts)
+			if err != nil {
+				log.Fatalf("Failed to save key bundle: %v", err)
+			}
+			log.Printf("Found matching address: %s", vk.OnionAddress)
+			log.Printf("Keys saved to: %s", saveDir)
+			log.Printf("Total Attempts: %d", res.attempts)
+			match.SavedTo = saveDir
+		} else {
+			log.Printf("Vanity Onion Address: %s", res.onionAddr)
+			log.Printf("Public Key (hex): %s", hex.EncodeToString(res.pub))
+			log.Printf("Expanded Private Key (hex): %s", hex.EncodeToString(res.expanded[:]))
+			log.Printf("Total Attempts: %d", res.attempts)
+			match.ExpandedSecretKey = hex.EncodeToString(res.expanded[:])
 		}
-		log.Printf("Public key saved to: %s", pubFilePath)
+		if *jsonOutput {
+			writeJSONLine(os.Stdout, match)
+		}
+		saveCheckpoint()
 
-		hostnamePath := filepath.Join(saveDir, "hostname")
-		hostnameContent := res.onionAddr + ".onion\n"
-		if err := os.WriteFile(hostnamePath, []byte(hostnameContent), 0600); err != nil {
-			log.Fatalf("Failed to write hostname: %v", err)
+		if len(patterns) == 0 {
+			break
 		}
-		log.Printf("Hostname saved to: %s", hostnamePath)
-	} else {
-		log.Printf("Vanity Onion Address: %s", res.onionAddr)
-		log.Printf("Public Key (hex): %s", hex.EncodeToString(res.finalPub))
-		log.Printf("Expanded Private Key (hex): %s", hex.EncodeToString(res.expanded[:]))
-		log.Printf("Total Attempts: %d", res.attempts)
 	}
+	cancel()
+	wg.Wait()
+
+	if exitCode == 0 {
+		// A finished search has nothing left to resume.
+		if *checkpointPath != "" {
+			if err := os.Remove(*checkpointPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to remove checkpoint: %v", err)
+			}
+		}
+		return 0
+	}
+
+	saveCheckpoint()
+	report := newProgressReport(atomic.LoadUint64(&totalAttempts), resumed, time.Since(start), patterns, satisfied)
+	report.emit(*jsonOutput, os.Stdout)
+	for i, p := range patterns {
+		if !satisfied[i] {
+			log.Printf("No match for %s", p)
+		}
+	}
+	if *checkpointPath != "" {
+		log.Printf("Progress saved to %s; rerun with the same patterns and --checkpoint to resume", *checkpointPath)
+	}
+	return exitCode
+}
+
+// bundleName picks the bundle name for a match. A single search saves under
+// --name (or "default"); a multi-pattern search saves each match under the
+// label of the pattern it satisfied, prefixed by --name when given.
+func bundleName(name string, matched []*pattern, multi bool) string {
+	if !multi || len(matched) == 0 {
+		if name == "" {
+			return "default"
+		}
+		return name
+	}
+	if name == "" {
+		return matched[0].label()
+	}
+	return name + "-" + matched[0].label()
 }
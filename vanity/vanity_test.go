@@ -7,8 +7,15 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
+// testSettings returns the settings of a search that saves key bundles
+// under dir.
+func testSettings(dir string) Settings {
+	return Settings{Dir: dir, Progress: 5 * time.Second}
+}
+
 func TestRunVanity(t *testing.T) {
 	// Save original args and restore after test
 	oldArgs := os.Args
@@ -36,7 +43,7 @@ func TestRunVanity(t *testing.T) {
 		log.SetOutput(&logOutput)
 		defer log.SetOutput(os.Stderr)
 		
-		RunVanity()
+		RunVanity(testSettings(filepath.Dir(testDataDir)))
 		
 		output := logOutput.String()
 		if !strings.Contains(output, "Vanity Onion Address:") {
@@ -52,10 +59,6 @@ func TestRunVanity(t *testing.T) {
 	
 	// Test case 2: With save flag
 	t.Run("WithSave", func(t *testing.T) {
-		// Temporarily replace the data dir path
-		os.Setenv("VANITY_DATA_DIR", testDataDir)
-		defer os.Unsetenv("VANITY_DATA_DIR")
-		
 		// Set up args for this test
 		os.Args = []string{"cmd", "-workers", "1", "-save"}
 		
@@ -67,7 +70,7 @@ func TestRunVanity(t *testing.T) {
 		log.SetOutput(&logOutput)
 		defer log.SetOutput(os.Stderr)
 		
-		RunVanity()
+		RunVanity(testSettings(filepath.Dir(testDataDir)))
 		
 		// Check if files were created
 		files := []string{
@@ -106,7 +109,7 @@ func TestRunVanity(t *testing.T) {
 		log.SetOutput(&logOutput)
 		defer log.SetOutput(os.Stderr)
 		
-		RunVanity()
+		RunVanity(testSettings(filepath.Dir(testDataDir)))
 		
 		output := logOutput.String()
 		if !strings.Contains(output, "Vanity Onion Address: a") {